@@ -0,0 +1,268 @@
+// Package keyvalues implements a parser for Valve's KeyValues text format,
+// as used by .vmt materials, surface properties and other game scripts.
+package keyvalues
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyValue is a single key with either a string value or child key-values (block).
+// Order and duplicate keys are preserved.
+type KeyValue struct {
+	Key      string
+	Value    string
+	Children []*KeyValue
+}
+
+// IsBlock returns true if the key-value has a block ({ ... }) instead of a string value.
+func (kv *KeyValue) IsBlock() bool {
+	return kv.Children != nil
+}
+
+// Find returns the first child with the given key (case-insensitive) or nil.
+func (kv *KeyValue) Find(key string) *KeyValue {
+	for _, c := range kv.Children {
+		if strings.EqualFold(c.Key, key) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// FindAll returns all children with the given key (case-insensitive).
+func (kv *KeyValue) FindAll(key string) []*KeyValue {
+	var res []*KeyValue
+
+	for _, c := range kv.Children {
+		if strings.EqualFold(c.Key, key) {
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+// String returns the value of the first child with the given key or "".
+func (kv *KeyValue) String(key string) string {
+	c := kv.Find(key)
+	if c == nil {
+		return ""
+	}
+
+	return c.Value
+}
+
+// Token types returned by Tokenizer.
+const (
+	TokenString = iota
+	TokenOpen
+	TokenClose
+)
+
+// Token is a single token of KeyValues text.
+type Token struct {
+	Type   int
+	Value  string
+	Quoted bool
+}
+
+// Tokenizer splits KeyValues text into tokens.
+// Quoted strings may contain any character except for an unescaped quote,
+// comments (//) and conditionals ([$WIN32]) are skipped.
+type Tokenizer struct {
+	r *bufio.Reader
+}
+
+// NewTokenizer returns a new Tokenizer reading from r.
+func NewTokenizer(r io.Reader) *Tokenizer {
+	return &Tokenizer{r: bufio.NewReader(r)}
+}
+
+var errUnterminatedString = errors.New("unterminated quoted string")
+
+// Next returns the next token or io.EOF.
+func (t *Tokenizer) Next() (Token, error) {
+	for {
+		c, _, err := t.r.ReadRune()
+		if err != nil {
+			return Token{}, err //nolint:wrapcheck // io.EOF must not be wrapped
+		}
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\uFEFF':
+			continue
+
+		case c == '{':
+			return Token{Type: TokenOpen, Value: "{"}, nil
+
+		case c == '}':
+			return Token{Type: TokenClose, Value: "}"}, nil
+
+		case c == '"':
+			return t.quoted()
+
+		case c == '/':
+			next, _, err := t.r.ReadRune()
+			if err == nil && next == '/' {
+				_, err = t.r.ReadString('\n')
+				if err != nil && !errors.Is(err, io.EOF) {
+					return Token{}, errors.Wrap(err, "failed to read comment")
+				}
+
+				continue
+			}
+
+			if err == nil {
+				_ = t.r.UnreadRune()
+			}
+
+			return t.unquoted(c)
+
+		case c == '[':
+			// conditional, e.g. [$X360]
+			_, err = t.r.ReadString(']')
+			if err != nil {
+				return Token{}, errors.Wrap(err, "failed to read conditional")
+			}
+
+			continue
+
+		default:
+			return t.unquoted(c)
+		}
+	}
+}
+
+func (t *Tokenizer) quoted() (Token, error) {
+	var sb strings.Builder
+
+	for {
+		c, _, err := t.r.ReadRune()
+		if err != nil {
+			return Token{}, errUnterminatedString
+		}
+
+		if c == '"' {
+			return Token{Type: TokenString, Value: sb.String(), Quoted: true}, nil
+		}
+
+		if c == '\\' {
+			next, _, err := t.r.ReadRune()
+			if err != nil {
+				return Token{}, errUnterminatedString
+			}
+
+			switch next {
+			case '"', '\\':
+				c = next
+			default:
+				sb.WriteRune(c)
+
+				c = next
+			}
+		}
+
+		sb.WriteRune(c)
+	}
+}
+
+func (t *Tokenizer) unquoted(first rune) (Token, error) {
+	var sb strings.Builder
+
+	sb.WriteRune(first)
+
+	for {
+		c, _, err := t.r.ReadRune()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return Token{}, errors.Wrap(err, "failed to read string")
+		}
+
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '{' || c == '}' || c == '"' {
+			_ = t.r.UnreadRune()
+
+			break
+		}
+
+		sb.WriteRune(c)
+	}
+
+	return Token{Type: TokenString, Value: sb.String()}, nil
+}
+
+// Parse parses KeyValues text and returns all top-level key-values.
+// Blocks without a key (like in the BSP entity lump) are returned with an empty key.
+func Parse(r io.Reader) ([]*KeyValue, error) {
+	t := NewTokenizer(r)
+
+	root := &KeyValue{Children: []*KeyValue{}}
+	stack := []*KeyValue{root}
+
+	var key *Token
+
+	for {
+		tok, err := t.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+
+		switch tok.Type {
+		case TokenOpen:
+			block := &KeyValue{Children: []*KeyValue{}}
+
+			if key != nil {
+				block.Key = key.Value
+				key = nil
+			}
+
+			parent.Children = append(parent.Children, block)
+			stack = append(stack, block)
+
+		case TokenClose:
+			if len(stack) == 1 {
+				return nil, errors.New("unexpected '}'")
+			}
+
+			if key != nil {
+				return nil, errors.Errorf("key %q without value", key.Value)
+			}
+
+			stack = stack[:len(stack)-1]
+
+		case TokenString:
+			if key == nil {
+				tok := tok
+				key = &tok
+
+				continue
+			}
+
+			parent.Children = append(parent.Children, &KeyValue{Key: key.Value, Value: tok.Value})
+			key = nil
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, errors.New("unexpected end of input, missing '}'")
+	}
+
+	if key != nil {
+		return nil, errors.Errorf("key %q without value", key.Value)
+	}
+
+	return root.Children, nil
+}
@@ -0,0 +1,66 @@
+package keyvalues_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/internal/keyvalues"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	kvs, err := keyvalues.Parse(strings.NewReader(`
+// comment
+"LightmappedGeneric"
+{
+	"$basetexture" "concrete/wall" // trailing comment
+	$surfaceprop concrete
+	"$translucent" "1" [$X360]
+	"Proxies"
+	{
+		"AnimatedTexture" { "animatedTextureVar" "$basetexture" }
+	}
+	"file" "a.txt"
+	"file" "b.txt"
+	"escaped" "say \"hi\""
+}
+`))
+	assert.NoError(t, err)
+	assert.Len(t, kvs, 1)
+
+	root := kvs[0]
+	assert.Equal(t, "LightmappedGeneric", root.Key)
+	assert.Equal(t, "concrete/wall", root.String("$BaseTexture"))
+	assert.Equal(t, "concrete", root.String("$surfaceprop"))
+	assert.Equal(t, "1", root.String("$translucent"))
+	assert.True(t, root.Find("proxies").IsBlock())
+	assert.Equal(t, "$basetexture", root.Find("proxies").Find("animatedtexture").String("animatedTextureVar"))
+	assert.Len(t, root.FindAll("file"), 2)
+	assert.Equal(t, `say "hi"`, root.String("escaped"))
+}
+
+func TestParse_KeylessBlocks(t *testing.T) {
+	t.Parallel()
+
+	kvs, err := keyvalues.Parse(strings.NewReader("{\n\"classname\" \"worldspawn\"\n}\n{\n\"classname\" \"info_player_terrorist\"\n}\n"))
+	assert.NoError(t, err)
+	assert.Len(t, kvs, 2)
+	assert.Equal(t, "", kvs[1].Key)
+	assert.Equal(t, "info_player_terrorist", kvs[1].String("classname"))
+}
+
+func TestParse_Errors(t *testing.T) {
+	t.Parallel()
+
+	_, err := keyvalues.Parse(strings.NewReader(`"a" { "b" "c"`))
+	assert.Error(t, err)
+
+	_, err = keyvalues.Parse(strings.NewReader(`"a" "b" }`))
+	assert.Error(t, err)
+
+	_, err = keyvalues.Parse(strings.NewReader(`"a" "b`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package bsptracer
+
+import (
+	"strconv"
+
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/lumps"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// AreaPortal is a func_areaportal entity, it connects two areas of the map.
+// Area portals are usually placed in door frames and closed while the door is closed.
+type AreaPortal struct {
+	Key       uint16   // portalnumber of the entity, identifies the portal in the AreaPortals lump
+	Areas     [2]int16 // the areas this portal connects
+	Door      string   // targetname of the door that opens and closes the portal, may be empty
+	StartOpen bool
+}
+
+// AreaPortalState is the open / closed state of all area portals of a map, see Map.NewAreaPortalState().
+// It's not safe for concurrent modification.
+type AreaPortalState struct {
+	open  map[uint16]bool
+	doors map[string][]uint16 // door targetname -> portal keys
+}
+
+func loadAreaPortals(bspfile *bsp.Bsp, entities []Entity) []AreaPortal {
+	portals := bspfile.Lump(bsp.LumpAreaPortals).(*lumps.AreaPortal).GetData()
+	areas := bspfile.Lump(bsp.LumpAreas).(*lumps.Area).GetData()
+
+	// every portal is stored once for each area it connects
+	areasByKey := make(map[uint16][2]int16)
+
+	for areaIndex, a := range areas {
+		for i := a.FirstAreaPortal; i < a.FirstAreaPortal+a.NumAreaPortals && int(i) < len(portals); i++ {
+			p := portals[i]
+			areasByKey[p.PortalKey] = [2]int16{int16(areaIndex), int16(p.OtherArea)}
+		}
+	}
+
+	var res []AreaPortal
+
+	for _, ent := range entities {
+		if ent.ClassName() != "func_areaportal" {
+			continue
+		}
+
+		key, err := strconv.ParseUint(ent.Get("portalnumber"), 10, 16)
+		if err != nil {
+			continue
+		}
+
+		res = append(res, AreaPortal{
+			Key:       uint16(key),
+			Areas:     areasByKey[uint16(key)],
+			Door:      ent.Get("target"),
+			StartOpen: ent.Get("StartOpen") != "0",
+		})
+	}
+
+	return res
+}
+
+// AreaPortals returns all func_areaportal entities of the map.
+func (m Map) AreaPortals() []AreaPortal {
+	return m.areaPortals
+}
+
+// NewAreaPortalState returns the initial (StartOpen) state of all area portals.
+// Portals without a func_areaportal entity are always open.
+func (m Map) NewAreaPortalState() *AreaPortalState {
+	s := &AreaPortalState{
+		open:  make(map[uint16]bool, len(m.areaPortals)),
+		doors: make(map[string][]uint16),
+	}
+
+	for _, p := range m.areaPortals {
+		s.open[p.Key] = p.StartOpen
+
+		if p.Door != "" {
+			s.doors[p.Door] = append(s.doors[p.Door], p.Key)
+		}
+	}
+
+	return s
+}
+
+// SetOpen opens or closes the area portal with the given key (AreaPortal.Key).
+func (s *AreaPortalState) SetOpen(key uint16, open bool) {
+	s.open[key] = open
+}
+
+// SetDoorOpen opens or closes all area portals linked to the door with the given targetname,
+// e.g. when a prop_door_rotating is opened or closed in a demo.
+func (s *AreaPortalState) SetDoorOpen(door string, open bool) {
+	for _, key := range s.doors[door] {
+		s.open[key] = open
+	}
+}
+
+// IsOpen returns true if the area portal with the given key is open.
+func (s *AreaPortalState) IsOpen(key uint16) bool {
+	open, ok := s.open[key]
+
+	return !ok || open
+}
+
+// AreasConnected returns true if area b can be reached from area a through open area portals, see FloodArea_r.
+// If state is nil all area portals are considered open.
+func (m Map) AreasConnected(a, b int16, state *AreaPortalState) bool {
+	if a == b {
+		return true
+	}
+
+	if a < 0 || b < 0 || int(a) >= len(m.areas) || int(b) >= len(m.areas) {
+		return false
+	}
+
+	visited := make([]bool, len(m.areas))
+	stack := []int16{a}
+	visited[a] = true
+
+	for len(stack) > 0 {
+		current := m.areas[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+
+		for i := current.FirstAreaPortal; i < current.FirstAreaPortal+current.NumAreaPortals && int(i) < len(m.areaPortalLump); i++ {
+			p := m.areaPortalLump[i]
+			other := int16(p.OtherArea)
+
+			if int(other) >= len(m.areas) || visited[other] || (state != nil && !state.IsOpen(p.PortalKey)) {
+				continue
+			}
+
+			if other == b {
+				return true
+			}
+
+			visited[other] = true
+			stack = append(stack, other)
+		}
+	}
+
+	return false
+}
+
+// IsVisibleWithAreaPortals is like IsVisible but also returns false if the areas of origin and destination
+// aren't connected through open area portals (e.g. a closed door is in between).
+func (m Map) IsVisibleWithAreaPortals(origin, destination mgl32.Vec3, state *AreaPortalState) bool {
+	if !m.AreasConnected(m.LeafAt(origin).Area, m.LeafAt(destination).Area, state) {
+		return false
+	}
+
+	return m.IsVisible(origin, destination)
+}
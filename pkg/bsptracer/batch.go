@@ -0,0 +1,219 @@
+package bsptracer
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Ray is a single trace of TraceBatch.
+type Ray struct {
+	Origin      mgl32.Vec3
+	Destination mgl32.Vec3
+	Mins, Maxs  mgl32.Vec3 // bounds of the swept box relative to Origin / Destination, both zero for a ray
+}
+
+// BatchOptions configure TraceBatch and VisibilityMatrixWithOptions, the zero value is the default.
+type BatchOptions struct {
+	// Mask defines which contents are solid, 0 means MaskShotHull (like TraceRay and IsVisible).
+	Mask int32
+	// Workers is the number of goroutines, <= 0 means runtime.GOMAXPROCS(0).
+	Workers int
+	// Packets traces groups of PacketSize neighboring rays together, sharing the traversal of the BSP tree.
+	// This is faster if neighboring rays are coherent, e.g. rays from one origin to a grid of points.
+	// The results are the same, traces with bounds (Ray.Mins / Ray.Maxs) are always traced one by one.
+	Packets bool
+}
+
+func (opts BatchOptions) mask() int32 {
+	if opts.Mask == 0 {
+		return MaskShotHull
+	}
+
+	return opts.Mask
+}
+
+// batchChunkSize is the number of traces a worker takes at once, to reduce contention on the shared counter.
+// It's a multiple of PacketSize so chunks don't split packets.
+const batchChunkSize = 2 * PacketSize
+
+// traceScratch is the memory a worker reuses for all of its traces.
+type traceScratch struct {
+	ti        [PacketSize]traceInfo // only ti[0] is used without packets
+	mailboxes [PacketSize]mailbox
+	out       [PacketSize]Trace
+	index     [PacketSize]int // index of the trace in every lane of a packet
+}
+
+func newTraceScratch() *traceScratch {
+	s := new(traceScratch)
+
+	for i := range s.ti {
+		s.ti[i].mailbox = &s.mailboxes[i]
+	}
+
+	return s
+}
+
+// parallelTraces does the traces [0, n) on opts.Workers goroutines.
+// init sets up the trace with index i, done receives its result (which is only valid until done returns).
+// Both are called concurrently for different indices.
+func (m Map) parallelTraces(n int, opts BatchOptions, init func(ti *traceInfo, i int), done func(i int, out *Trace)) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	if maxWorkers := (n + batchChunkSize - 1) / batchChunkSize; workers > maxWorkers {
+		workers = maxWorkers
+	}
+
+	var (
+		next int64
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(workers)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+
+			s := newTraceScratch()
+
+			for {
+				first := int(atomic.AddInt64(&next, batchChunkSize)) - batchChunkSize
+				if first >= n {
+					return
+				}
+
+				end := first + batchChunkSize
+				if end > n {
+					end = n
+				}
+
+				if opts.Packets {
+					m.tracePackets(s, first, end, init, done)
+
+					continue
+				}
+
+				for i := first; i < end; i++ {
+					init(&s.ti[0], i)
+					m.traceInto(&s.ti[0], &s.out[0])
+					done(i, &s.out[0])
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// tracePackets does the traces [first, end) in packets, see parallelTraces.
+func (m Map) tracePackets(s *traceScratch, first, end int, init func(ti *traceInfo, i int), done func(i int, out *Trace)) {
+	lanes := 0
+
+	for i := first; i < end; i++ {
+		ti := &s.ti[lanes]
+		init(ti, i)
+
+		// the traversal of boxes depends on their extents, they can't share it
+		if !ti.isPoint {
+			m.traceInto(ti, &s.out[lanes])
+			done(i, &s.out[lanes])
+
+			continue
+		}
+
+		s.index[lanes] = i
+
+		if lanes++; lanes == PacketSize {
+			m.flushPacket(s, lanes, done)
+
+			lanes = 0
+		}
+	}
+
+	m.flushPacket(s, lanes, done)
+}
+
+// flushPacket traces the first lanes traces of the scratch memory as a packet.
+func (m Map) flushPacket(s *traceScratch, lanes int, done func(i int, out *Trace)) {
+	if lanes == 0 {
+		return
+	}
+
+	m.tracePacket(s.ti[:lanes], s.out[:lanes])
+
+	for l := 0; l < lanes; l++ {
+		done(s.index[l], &s.out[l])
+	}
+}
+
+// TraceBatch traces all rays in parallel, res[i] is the result of rays[i].
+// The results are the same as of TraceHullWithMask (or TraceRayWithMask for rays without bounds),
+// but scratch memory is reused across traces and only the result slice is allocated.
+func (m Map) TraceBatch(rays []Ray, opts BatchOptions) []Trace {
+	res := make([]Trace, len(rays))
+	mask := opts.mask()
+
+	m.parallelTraces(len(rays), opts, func(ti *traceInfo, i int) {
+		r := &rays[i]
+
+		ti.init(r.Origin, r.Destination, r.Mins, r.Maxs, mask)
+	}, func(i int, out *Trace) {
+		res[i] = *out
+	})
+
+	return res
+}
+
+// VisibilityMatrix returns whether each pair of points is visible, res[i][j] is IsVisible(points[i], points[j]).
+// Every pair is only traced once (from the lower to the higher index) and the result is mirrored,
+// which only makes a difference for points inside of solids.
+// Points are always visible to themselves.
+func (m Map) VisibilityMatrix(points []mgl32.Vec3) [][]bool {
+	return m.VisibilityMatrixWithOptions(points, BatchOptions{})
+}
+
+// VisibilityMatrixWithOptions is like VisibilityMatrix with a custom mask, worker count and packet mode.
+// Packets share their origin except at the end of a row, so they're usually coherent.
+func (m Map) VisibilityMatrixWithOptions(points []mgl32.Vec3, opts BatchOptions) [][]bool {
+	n := len(points)
+	res := make([][]bool, n)
+	cells := make([]bool, n*n)
+
+	for i := range res {
+		res[i] = cells[i*n : (i+1)*n]
+		res[i][i] = true
+	}
+
+	mask := opts.mask()
+
+	// pair k of row i is (i, i+1+k), rows are flattened so work is spread evenly
+	m.parallelTraces(n*(n-1)/2, opts, func(ti *traceInfo, k int) {
+		i, j := pairIndex(n, k)
+
+		ti.init(points[i], points[j], mgl32.Vec3{}, mgl32.Vec3{}, mask)
+	}, func(k int, out *Trace) {
+		i, j := pairIndex(n, k)
+
+		res[i][j] = out.Fraction >= 1
+		res[j][i] = res[i][j]
+	})
+
+	return res
+}
+
+// pairIndex returns the k-th pair (i, j) with i < j < n, ordered by i then j.
+func pairIndex(n, k int) (i, j int) {
+	for rowLen := n - 1; k >= rowLen; rowLen-- {
+		k -= rowLen
+		i++
+	}
+
+	return i, i + 1 + k
+}
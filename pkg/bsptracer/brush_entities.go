@@ -0,0 +1,247 @@
+package bsptracer
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/lumps"
+	"github.com/galaco/bsp/primitives/plane"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// brush entities that never collide with anything
+var nonSolidBrushEntityClasses = map[string]struct{}{
+	"func_illusionary":      {},
+	"func_buyzone":          {},
+	"func_bomb_target":      {},
+	"func_hostage_rescue":   {},
+	"func_occluder":         {},
+	"func_precipitation":    {},
+	"func_areaportalwindow": {},
+	"func_dustmotes":        {},
+	"func_dustcloud":        {},
+	"func_smokevolume":      {},
+}
+
+// BrushEntity is an entity that uses one of the map's brush models ("model" "*N"),
+// e.g. func_brush, func_door or func_breakable.
+type BrushEntity struct {
+	Entity     int32      // index in the entities lump
+	Model      int32      // index in the models lump, the N in "*N"
+	ClassName  string     // e.g. "func_door"
+	TargetName string     // name of the entity, may be empty
+	Origin     mgl32.Vec3 // position of the model
+	Angles     mgl32.Vec3 // orientation of the model (pitch, yaw, roll in degrees)
+	Enabled    bool       // disabled entities are ignored by traces
+}
+
+type brushEntity struct {
+	BrushEntity
+
+	headNode int32
+	rotation mgl32.Mat3 // local to world
+	rotated  bool
+	min, max mgl32.Vec3 // AABB in world space
+}
+
+// parseVec3 parses a vector entity value, e.g. "0 90 0".
+func parseVec3(s string) (v mgl32.Vec3) {
+	for i, f := range strings.Fields(s) {
+		if i >= 3 {
+			break
+		}
+
+		v[i] = parseFloat32(f, 0)
+	}
+
+	return v
+}
+
+// angleMatrix is a port of AngleMatrix, it returns the rotation matrix for Source engine angles (pitch, yaw, roll).
+func angleMatrix(angles mgl32.Vec3) mgl32.Mat3 {
+	sp, cp := math.Sincos(float64(mgl32.DegToRad(angles[0])))
+	sy, cy := math.Sincos(float64(mgl32.DegToRad(angles[1])))
+	sr, cr := math.Sincos(float64(mgl32.DegToRad(angles[2])))
+
+	// columns are the forward, left and up vectors
+	return mgl32.Mat3{
+		float32(cp * cy), float32(cp * sy), float32(-sp),
+		float32(sr*sp*cy - cr*sy), float32(sr*sp*sy + cr*cy), float32(sr * cp),
+		float32(cr*sp*cy + sr*sy), float32(cr*sp*sy - sr*cy), float32(cr * cp),
+	}
+}
+
+// loadBrushEntities returns the solid brush entities and the non-solid ones (volumes, e.g. func_buyzone).
+func loadBrushEntities(bspfile *bsp.Bsp, entities []Entity) (solid, volumes []brushEntity) {
+	models := bspfile.Lump(bsp.LumpModels).(*lumps.Model).GetData()
+
+	for _, ent := range entities {
+		modelName := ent.Model()
+		if !strings.HasPrefix(modelName, "*") {
+			continue
+		}
+
+		modelIndex, err := strconv.Atoi(modelName[1:])
+		if err != nil || modelIndex <= 0 || modelIndex >= len(models) {
+			continue
+		}
+
+		className := ent.ClassName()
+
+		e := brushEntity{
+			BrushEntity: BrushEntity{
+				Entity:     ent.Index,
+				Model:      int32(modelIndex),
+				ClassName:  className,
+				TargetName: ent.TargetName(),
+				Origin:     ent.Origin(),
+				Angles:     ent.Angles(),
+				Enabled:    ent.Get("StartDisabled") != "1",
+			},
+			headNode: models[modelIndex].HeadNode,
+		}
+
+		e.updateTransform(models[modelIndex].Mins, models[modelIndex].Maxs)
+
+		// func_brush with "Solidity" "1" is never solid
+		if _, ok := nonSolidBrushEntityClasses[className]; ok || strings.HasPrefix(className, "trigger_") || ent.Get("Solidity") == "1" {
+			volumes = append(volumes, e)
+		} else {
+			solid = append(solid, e)
+		}
+	}
+
+	return solid, volumes
+}
+
+// updateTransform updates the rotation and world space AABB after Origin or Angles changed.
+func (e *brushEntity) updateTransform(localMin, localMax mgl32.Vec3) {
+	e.rotated = e.Angles != mgl32.Vec3{}
+	e.rotation = angleMatrix(e.Angles)
+	e.min, e.max = transformedBounds(e.rotation, e.Origin, localMin, localMax)
+}
+
+// transformedBounds returns the AABB of the box localMin/localMax after rotating it and moving it to origin.
+func transformedBounds(rotation mgl32.Mat3, origin, localMin, localMax mgl32.Vec3) (min, max mgl32.Vec3) {
+	center := localMin.Add(localMax).Mul(0.5)
+	extents := localMax.Sub(localMin).Mul(0.5)
+	worldCenter := rotation.Mul3x1(center).Add(origin)
+
+	var worldExtents mgl32.Vec3
+
+	for i := 0; i < 3; i++ {
+		worldExtents[i] = dotAbs(rotation.Row(i), extents)
+	}
+
+	return worldCenter.Sub(worldExtents), worldCenter.Add(worldExtents)
+}
+
+// localTrace transforms the trace into the local space of the entity's model.
+// Rotated boxes are approximated by the axis-aligned box that contains them, like CM_TransformedBoxTrace.
+func (e *brushEntity) localTrace(ti *traceInfo) *traceInfo {
+	inv := e.rotation.Transpose()
+	local := *ti
+	local.headNode = e.headNode
+
+	local.origin = inv.Mul3x1(ti.origin.Sub(e.Origin))
+	local.destination = inv.Mul3x1(ti.destination.Sub(e.Origin))
+	local.start = inv.Mul3x1(ti.start.Sub(e.Origin))
+	local.end = inv.Mul3x1(ti.end.Sub(e.Origin))
+	local.delta = local.end.Sub(local.start)
+
+	if e.rotated && !ti.isPoint {
+		for i := 0; i < 3; i++ {
+			local.extents[i] = dotAbs(inv.Row(i), ti.extents)
+		}
+	}
+
+	return &local
+}
+
+// touches returns true if the swept box of the trace may touch the entity.
+func (e *brushEntity) touches(ti *traceInfo) bool {
+	for i := 0; i < 3; i++ {
+		lo, hi := ti.start[i], ti.end[i]
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+
+		lo -= ti.extents[i]
+		hi += ti.extents[i]
+
+		if hi < e.min[i] || lo > e.max[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// worldPlane transforms a plane from the entity's local space to world space.
+func (e *brushEntity) worldPlane(p plane.Plane) plane.Plane {
+	if !e.rotated {
+		p.Distance += p.Normal.Dot(e.Origin)
+
+		return p
+	}
+
+	normal := e.rotation.Mul3x1(p.Normal)
+
+	return newPlane(normal, normal.Mul(p.Distance).Add(e.Origin))
+}
+
+// traceBrushEntities traces against all enabled brush entities.
+func (m Map) traceBrushEntities(ti *traceInfo, out *Trace) {
+	for i := range m.brushEntities {
+		e := &m.brushEntities[i]
+
+		if !e.Enabled || !e.touches(ti) {
+			continue
+		}
+
+		fraction := out.Fraction
+		local := e.localTrace(ti)
+
+		m.rayCastNode(local, e.headNode, 0, 1, local.start, local.end, out)
+
+		// brushes, faces and displacements of the model are hit in its local space
+		if out.Fraction < fraction {
+			out.Plane = e.worldPlane(out.Plane)
+			out.Entity = e.Entity
+		}
+
+		if out.Fraction == 0 {
+			return
+		}
+	}
+}
+
+// BrushEntities returns all solid brush entities of the map, indices match SetBrushEntityEnabled.
+func (m Map) BrushEntities() []BrushEntity {
+	res := make([]BrushEntity, len(m.brushEntities))
+
+	for i, e := range m.brushEntities {
+		res[i] = e.BrushEntity
+	}
+
+	return res
+}
+
+// SetBrushEntityEnabled enables or disables the brush entity at index (see BrushEntities) for traces,
+// e.g. to remove a func_breakable once it's broken or a func_brush that is toggled by the map.
+// This affects all copies of the Map and must not be called concurrently with traces.
+func (m Map) SetBrushEntityEnabled(index int, enabled bool) {
+	m.brushEntities[index].Enabled = enabled
+}
+
+// SetBrushEntityEnabledByName enables or disables all brush entities with the given targetname.
+// This affects all copies of the Map and must not be called concurrently with traces.
+func (m Map) SetBrushEntityEnabledByName(targetName string, enabled bool) {
+	for i := range m.brushEntities {
+		if m.brushEntities[i].TargetName == targetName {
+			m.brushEntities[i].Enabled = enabled
+		}
+	}
+}
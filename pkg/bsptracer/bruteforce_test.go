@@ -0,0 +1,138 @@
+package bsptracer
+
+import (
+	"github.com/galaco/bsp"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// traceBruteForce traces like trace, but without BVHs and mailboxes:
+// static props and displacements are re-tested in every leaf along the trace, against all of their triangles and hulls.
+// It's the baseline for benchmarks and tests.
+func (m Map) traceBruteForce(ti *traceInfo) *Trace {
+	out := &Trace{Fraction: 1}
+
+	ti.visitLeaf = func(leafIndex int32) {
+		m.rayCastLeafBruteForce(ti, leafIndex, out)
+	}
+
+	m.rayCastNode(ti, 0, 0, 1, ti.start, ti.end, out)
+
+	ti.visitLeaf = nil
+
+	m.finishTrace(ti, out)
+
+	return out
+}
+
+// rayCastLeafBruteForce is rayCastLeaf without mailboxes.
+func (m Map) rayCastLeafBruteForce(ti *traceInfo, leafIndex int32, out *Trace) {
+	leaf := m.leaves[leafIndex]
+
+	for i := uint16(0); i < leaf.NumLeafBrushes; i++ {
+		brush := &m.brushes[m.leafBrushes[leaf.FirstLeafBrush+i]]
+
+		if !m.brushMatchesMask(brush, ti.mask) {
+			continue
+		}
+
+		m.rayCastBrush(ti, brush, out)
+
+		if out.Fraction == 0 {
+			return
+		}
+	}
+
+	for _, p := range m.staticPropsByLeaf[uint16(leafIndex)] {
+		if ti.mask&bsp.CONTENTS_SOLID == 0 {
+			break
+		}
+
+		if !p.touches(ti) {
+			continue
+		}
+
+		r := p.rayCastBruteForce(ti)
+
+		if r.Hit && float32(r.T) < out.Fraction {
+			out.Fraction = float32(r.T)
+			out.Contents = bsp.CONTENTS_SOLID
+			out.setHit(HitStaticProp)
+			out.Plane = ti.hitPlane(r)
+			out.StaticProp = int32(p.Index)
+			out.Model = p.Model
+
+			if p.model != nil {
+				out.Surface.SurfaceProp = p.model.surfaceProp
+			}
+		}
+
+		if out.Fraction == 0 {
+			return
+		}
+	}
+
+	for _, d := range m.displacementsByLeaf[uint16(leafIndex)] {
+		if d.contents&ti.mask == 0 {
+			continue
+		}
+
+		if (ti.isPoint && d.flags&dispInfoFlagNoRay != 0) || (!ti.isPoint && d.flags&dispInfoFlagNoHull != 0) {
+			continue
+		}
+
+		m.rayCastDisplacementBruteForce(ti, d, out)
+
+		if out.Fraction == 0 {
+			return
+		}
+	}
+
+	if out.StartSolid || !ti.isPoint {
+		return
+	}
+
+	for i := uint16(0); i < leaf.NumLeafFaces; i++ {
+		m.rayCastSurface(ti, int(m.leafFaces[leaf.FirstLeafFace+i]), out)
+	}
+}
+
+// rayCastBruteForce is rayCast without BVHs.
+func (p *propCollision) rayCastBruteForce(ti *traceInfo) (r collision.RayCastResult) {
+	if p.effectiveSolid() != SolidVPhysics {
+		return p.rayCast(ti)
+	}
+
+	closest := func(hit collision.RayCastResult) {
+		if hit.Hit && hit.T <= 1 && (!r.Hit || hit.T < r.T) {
+			r = hit
+		}
+	}
+
+	for _, t := range p.triangles {
+		closest(rayCastTriangle(ti, t))
+	}
+
+	for _, hull := range p.hulls {
+		closest(collision.SweepConvexHull(ti.start, ti.end, ti.extents, hull))
+	}
+
+	return r
+}
+
+// rayCastDisplacementBruteForce is rayCastDisplacement without BVHs.
+func (m Map) rayCastDisplacementBruteForce(ti *traceInfo, disp *displacement, out *Trace) {
+	for i, t := range disp.triangles {
+		r := rayCastTriangle(ti, t)
+
+		if r.Hit && r.T <= 1 && float32(r.T) < out.Fraction {
+			out.Fraction = float32(r.T)
+			out.Contents = disp.contents
+			out.setHit(HitDisplacement)
+			out.Plane = ti.hitPlane(r)
+			out.Face = int32(disp.face)
+			out.DispFlags = disp.tags[i]
+			out.Surface = m.surface(m.surfaces[disp.face].TexInfo)
+		}
+	}
+}
@@ -3,8 +3,12 @@
 package bsptracer
 
 import (
+	"io"
+
 	"github.com/galaco/bsp"
 	"github.com/galaco/bsp/lumps"
+	"github.com/galaco/bsp/primitives/area"
+	"github.com/galaco/bsp/primitives/areaportal"
 	"github.com/galaco/bsp/primitives/brush"
 	"github.com/galaco/bsp/primitives/brushside"
 	"github.com/galaco/bsp/primitives/dispinfo"
@@ -14,7 +18,7 @@ import (
 	"github.com/galaco/bsp/primitives/leaf"
 	"github.com/galaco/bsp/primitives/node"
 	"github.com/galaco/bsp/primitives/plane"
-	"github.com/galaco/studiomodel"
+	"github.com/galaco/bsp/primitives/texinfo"
 	"github.com/galaco/vpk2"
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/pkg/errors"
@@ -28,60 +32,148 @@ const (
 )
 
 // Map is a loaded BSP map.
+//
+// A Map is safe for concurrent use by multiple goroutines: traces and other queries only read from it.
+// The Set* methods (e.g. SetDynamicPropTransform) modify state that is shared by all copies of the Map,
+// they must not be called concurrently with any other method.
 type Map struct {
 	// loaded by bsp package
-	brushes     []brush.Brush
-	brushSides  []brushside.BrushSide
-	edges       [][2]uint16
-	leafBrushes []uint16
-	leafFaces   []uint16
-	leaves      []leaf.Leaf
-	nodes       []node.Node
-	planes      []plane.Plane
-	surfaces    []face.Face
-	surfEdges   []int32
-	vertices    []mgl32.Vec3
-	game        *lumps.Game         // TODO: may be needed for props + leaves? or maybe not ...
-	dispInfo    []dispinfo.DispInfo // TODO: trace against displacements
-	dispVerts   []dispvert.DispVert
-	dispTris    []disptris.DispTri
+	brushes        []brush.Brush
+	brushSides     []brushside.BrushSide
+	edges          [][2]uint16
+	leafBrushes    []uint16
+	leafFaces      []uint16
+	leaves         []leaf.Leaf
+	nodes          []node.Node
+	planes         []plane.Plane
+	surfaces       []face.Face
+	surfEdges      []int32
+	vertices       []mgl32.Vec3
+	game           *lumps.Game // TODO: may be needed for props + leaves? or maybe not ...
+	dispInfo       []dispinfo.DispInfo
+	dispVerts      []dispvert.DispVert
+	dispTris       []disptris.DispTri
+	texInfos       []texinfo.TexInfo
+	areas          []area.Area
+	areaPortalLump []areaportal.AreaPortal
 
 	// constructed by this package
-	entities          []map[string]string // TODO: not yet sure if we'll need this
-	polygons          []polygon
-	models            []*studiomodel.StudioModel // TODO: place props in the world and trace against them
-	staticPropsByLeaf map[uint16][]staticProp
+	entities            []Entity
+	polygons            []polygon
+	models              []*model
+	staticPropLump      staticPropLump
+	staticProps         []staticProp // solid static props
+	staticPropsByLeaf   map[uint16][]*staticProp
+	displacements       []displacement
+	displacementsByLeaf map[uint16][]*displacement
+	texDataNames        []string
+	texDataSurfaceProps []string
+	surfaceProps        map[string]SurfaceProperties
+	pvs, pas            clusterSets
+	areaPortals         []AreaPortal
+	brushEntities       []brushEntity
+	volumes             []brushEntity // non-solid brush entities, see Volumes()
+	dynamicProps        []dynamicProp
+	nodePlanes          nodePlanes // nodes and planes in the layout of packet traces
+}
+
+// PhysicsFallback defines how SolidVPhysics props collide if their model has no physics data (.phy).
+type PhysicsFallback int
+
+const (
+	// PhysicsFallbackNone makes such props non-solid, like in the engine.
+	PhysicsFallbackNone PhysicsFallback = iota
+	// PhysicsFallbackRenderMesh collides with the triangles of the model's LOD0 render mesh.
+	PhysicsFallbackRenderMesh
+	// PhysicsFallbackHull collides with the convex hull of the model's LOD0 render mesh,
+	// or with the hull box of the model (like SolidOBB) if the model has no render mesh.
+	PhysicsFallbackHull
+)
+
+// LoadOptions are optional settings for loading maps, the zero value is the default.
+type LoadOptions struct {
+	// PhysicsFallback is used for props without physics data, see StaticProp.CollisionFallback.
+	PhysicsFallback PhysicsFallback
 }
 
 // LoadMap loads a map from a BSP file and VPKs.
 // May return MissingModelsError if models can't be found - this is not fatal and the map can still be used.
+// Malformed entities in the entities lump are skipped.
 func LoadMap(bspfile *bsp.Bsp, vpks ...*vpk.VPK) (Map, error) {
-	models, missingModelsErr := loadModels(bspfile, vpks)
+	return LoadMapWithOptions(bspfile, LoadOptions{}, vpks...)
+}
+
+// LoadMapWithOptions is like LoadMap with non-default options.
+func LoadMapWithOptions(bspfile *bsp.Bsp, opts LoadOptions, vpks ...*vpk.VPK) (Map, error) {
+	sources := make([]ModelSource, len(vpks))
+
+	for i, v := range vpks {
+		sources[i] = NewVPKSource(v)
+	}
+
+	return LoadMapWithModelSources(bspfile, opts, sources...)
+}
+
+// LoadMapWithModelSources is like LoadMapWithOptions but loads models, materials and scripts from any sources,
+// e.g. VPKs, loose files (NewDirSource), an fs.FS (NewFSSource) or zip archives (NewZipSource).
+// Files are looked up in the map's embedded pakfile first and then in sources in order of priority.
+func LoadMapWithModelSources(bspfile *bsp.Bsp, opts LoadOptions, sources ...ModelSource) (Map, error) {
+	staticProps, err := readStaticPropLump(bspfile.Lump(bsp.LumpGame).(*lumps.Game).GetData())
+	if err != nil {
+		return Map{}, err
+	}
+
+	entities := parseEntities(bspfile)
+
+	fs := newVFS(bspfile.Lump(bsp.LumpPakfile).(*lumps.Pakfile).GetData(), sources)
+	models, missingModels := loadModels(staticProps.names, fs)
+	displacements := buildDisplacements(bspfile)
+	materials := texDataNames(bspfile)
+	pvs, pas := loadVisibility(bspfile)
+	dynamicProps := loadDynamicProps(fs, entities, modelsByName(staticProps.names, models), opts.PhysicsFallback)
 
 	m := Map{
-		brushes:           bspfile.Lump(bsp.LumpBrushes).(*lumps.Brush).GetData(),
-		brushSides:        bspfile.Lump(bsp.LumpBrushSides).(*lumps.BrushSide).GetData(),
-		edges:             bspfile.Lump(bsp.LumpEdges).(*lumps.Edge).GetData(),
-		leafBrushes:       bspfile.Lump(bsp.LumpLeafBrushes).(*lumps.LeafBrush).GetData(),
-		leafFaces:         bspfile.Lump(bsp.LumpLeafFaces).(*lumps.LeafFace).GetData(),
-		leaves:            bspfile.Lump(bsp.LumpLeafs).(*lumps.Leaf).GetData(),
-		nodes:             bspfile.Lump(bsp.LumpNodes).(*lumps.Node).GetData(),
-		planes:            bspfile.Lump(bsp.LumpPlanes).(*lumps.Planes).GetData(),
-		surfaces:          bspfile.Lump(bsp.LumpFaces).(*lumps.Face).GetData(),
-		surfEdges:         bspfile.Lump(bsp.LumpSurfEdges).(*lumps.Surfedge).GetData(),
-		vertices:          bspfile.Lump(bsp.LumpVertexes).(*lumps.Vertex).GetData(),
-		game:              bspfile.Lump(bsp.LumpGame).(*lumps.Game).GetData(),
-		dispInfo:          bspfile.Lump(bsp.LumpDispInfo).(*lumps.DispInfo).GetData(),
-		dispVerts:         bspfile.Lump(bsp.LumpDispVerts).(*lumps.DispVert).GetData(),
-		dispTris:          bspfile.Lump(bsp.LumpDispTris).(*lumps.DispTris).GetData(),
-		entities:          parseEntities(bspfile),
-		polygons:          buildPolygons(bspfile),
-		models:            models,
-		staticPropsByLeaf: staticPropsByLeaf(bspfile, models),
-	}
-
-	if missingModelsErr != nil {
-		return m, missingModelsErr
+		brushes:             bspfile.Lump(bsp.LumpBrushes).(*lumps.Brush).GetData(),
+		brushSides:          bspfile.Lump(bsp.LumpBrushSides).(*lumps.BrushSide).GetData(),
+		edges:               bspfile.Lump(bsp.LumpEdges).(*lumps.Edge).GetData(),
+		leafBrushes:         bspfile.Lump(bsp.LumpLeafBrushes).(*lumps.LeafBrush).GetData(),
+		leafFaces:           bspfile.Lump(bsp.LumpLeafFaces).(*lumps.LeafFace).GetData(),
+		leaves:              bspfile.Lump(bsp.LumpLeafs).(*lumps.Leaf).GetData(),
+		nodes:               bspfile.Lump(bsp.LumpNodes).(*lumps.Node).GetData(),
+		planes:              bspfile.Lump(bsp.LumpPlanes).(*lumps.Planes).GetData(),
+		surfaces:            bspfile.Lump(bsp.LumpFaces).(*lumps.Face).GetData(),
+		surfEdges:           bspfile.Lump(bsp.LumpSurfEdges).(*lumps.Surfedge).GetData(),
+		vertices:            bspfile.Lump(bsp.LumpVertexes).(*lumps.Vertex).GetData(),
+		game:                bspfile.Lump(bsp.LumpGame).(*lumps.Game).GetData(),
+		dispInfo:            bspfile.Lump(bsp.LumpDispInfo).(*lumps.DispInfo).GetData(),
+		dispVerts:           bspfile.Lump(bsp.LumpDispVerts).(*lumps.DispVert).GetData(),
+		dispTris:            bspfile.Lump(bsp.LumpDispTris).(*lumps.DispTris).GetData(),
+		texInfos:            bspfile.Lump(bsp.LumpTexInfo).(*lumps.TexInfo).GetData(),
+		areas:               bspfile.Lump(bsp.LumpAreas).(*lumps.Area).GetData(),
+		areaPortalLump:      bspfile.Lump(bsp.LumpAreaPortals).(*lumps.AreaPortal).GetData(),
+		entities:            entities,
+		polygons:            buildPolygons(bspfile),
+		models:              models,
+		staticPropLump:      staticProps,
+		displacements:       displacements,
+		texDataNames:        materials,
+		texDataSurfaceProps: materialSurfaceProps(fs, materials),
+		surfaceProps:        loadSurfaceProperties(fs),
+		pvs:                 pvs,
+		pas:                 pas,
+		areaPortals:         loadAreaPortals(bspfile, entities),
+		dynamicProps:        dynamicProps,
+	}
+
+	m.brushEntities, m.volumes = loadBrushEntities(bspfile, entities)
+	m.displacementsByLeaf = displacementsByLeaf(m.nodes, m.planes, m.displacements)
+	m.nodePlanes = newNodePlanes(m.nodes, m.planes)
+	m.staticProps, m.staticPropsByLeaf = loadStaticProps(staticProps, models, opts.PhysicsFallback)
+
+	if len(missingModels) > 0 {
+		return m, MissingModelsError{
+			missingModels: missingModels,
+		}
 	}
 
 	return m, nil
@@ -92,26 +184,42 @@ func LoadMap(bspfile *bsp.Bsp, vpks ...*vpk.VPK) (Map, error) {
 // for CS:GO, vpkPaths should be paths to ("SteamLibrary/steamapps/common/Counter-Strike Global Offensive/csgo/pak01", "SteamLibrary/steamapps/common/Counter-Strike Global Offensive/platform/platform_pak01")
 // See also LoadMap()
 func LoadMapFromFileSystem(mapPath string, vpkPaths ...string) (Map, error) {
+	return LoadMapFromFileSystemWithOptions(mapPath, LoadOptions{}, vpkPaths...)
+}
+
+// LoadMapFromFileSystemWithOptions is like LoadMapFromFileSystem with non-default options.
+func LoadMapFromFileSystemWithOptions(mapPath string, opts LoadOptions, vpkPaths ...string) (Map, error) {
 	bspfile, err := bsp.ReadFromFile(mapPath)
 	if err != nil {
 		return Map{}, err
 	}
 
-	vpks := make([]*vpk.VPK, len(vpkPaths))
+	sources := make([]ModelSource, len(vpkPaths))
 
 	for i, path := range vpkPaths {
-		var err error
-
-		vpks[i], err = vpk.Open(vpk.MultiVPK(path))
+		sources[i], err = OpenVPKSource(path)
 		if err != nil {
-			vpks[i], err = vpk.Open(vpk.SingleVPK(path))
-			if err != nil {
-				return Map{}, errors.Wrapf(err, "failed to open vpk %q", path)
-			}
+			return Map{}, err
 		}
 	}
 
-	return LoadMap(bspfile, vpks...)
+	return LoadMapWithModelSources(bspfile, opts, sources...)
+}
+
+// LoadMapFromReader loads a BSP map from r, e.g. a file from object storage.
+// See LoadMapWithModelSources for sources.
+func LoadMapFromReader(r io.Reader, sources ...ModelSource) (Map, error) {
+	return LoadMapFromReaderWithOptions(r, LoadOptions{}, sources...)
+}
+
+// LoadMapFromReaderWithOptions is like LoadMapFromReader with non-default options.
+func LoadMapFromReaderWithOptions(r io.Reader, opts LoadOptions, sources ...ModelSource) (Map, error) {
+	bspfile, err := bsp.ReadFromStream(r)
+	if err != nil {
+		return Map{}, errors.Wrap(err, "failed to read BSP")
+	}
+
+	return LoadMapWithModelSources(bspfile, opts, sources...)
 }
 
 // IsVisible returns true if destination is visible from origin, as computed by
@@ -120,7 +228,15 @@ func (m Map) IsVisible(origin, destination mgl32.Vec3) bool {
 	return m.TraceRay(origin, destination).Fraction >= 1
 }
 
+// IsVisibleWithMask is like IsVisible but only considers contents matching mask.
+// Use MaskVisible to see through glass and grates (fences).
+func (m Map) IsVisibleWithMask(origin, destination mgl32.Vec3, mask int32) bool {
+	return m.TraceRayWithMask(origin, destination, mask).Fraction >= 1
+}
+
 // Trace captures the result of a ray trace.
+// The hit details (HitKind and all following fields) are only set if something was entered along the trace,
+// not if the trace started inside of a solid.
 type Trace struct {
 	AllSolid          bool
 	StartSolid        bool
@@ -130,27 +246,118 @@ type Trace struct {
 	Contents          int32
 	Brush             *brush.Brush
 	NumBrushSides     int32
+
+	HitKind    HitKind
+	Plane      plane.Plane // the hit plane, the normal points away from the hit object
+	Surface    Surface     // texture of the hit surface, for HitStaticProp only SurfaceProp is set
+	BrushSide  int32       // index of the hit brush side (HitBrush)
+	Face       int32       // index of the hit face (HitFace and HitDisplacement)
+	DispFlags  uint16      // DispTri* tags of the hit displacement triangle (HitDisplacement)
+	StaticProp int32       // index of the hit static prop in the static prop game lump (HitStaticProp)
+	Model      string      // model name of the hit prop (HitStaticProp and HitDynamicProp)
+	Entity     int32       // index of the hit brush entity or dynamic prop in the entities lump, 0 (worldspawn) for the world
 }
 
 // TraceRay traces a ray from origin to destination and returns the result.
+// It collides with everything in MaskShotHull.
 func (m Map) TraceRay(origin, destination mgl32.Vec3) *Trace {
-	out := &Trace{
-		AllSolid:   true,
-		StartSolid: true,
-		Fraction:   1,
+	return m.TraceRayWithMask(origin, destination, MaskShotHull)
+}
+
+// TraceRayWithMask traces a ray from origin to destination and returns the result.
+// Only contents matching mask (e.g. MaskVisible, MaskPlayerSolid) are considered solid.
+func (m Map) TraceRayWithMask(origin, destination mgl32.Vec3, mask int32) *Trace {
+	return m.trace(newTraceInfo(origin, destination, mgl32.Vec3{}, mgl32.Vec3{}, mask))
+}
+
+// TraceHull sweeps an axis-aligned box with the bounds mins/maxs (relative to origin) from origin to destination
+// and returns the result, like the engine's UTIL_TraceHull.
+// For a standing CS:GO player mins and maxs are (-16, -16, 0) and (16, 16, 72), for a crouching player (16, 16, 54).
+// It collides with everything in MaskShotHull.
+func (m Map) TraceHull(origin, destination, mins, maxs mgl32.Vec3) *Trace {
+	return m.TraceHullWithMask(origin, destination, mins, maxs, MaskShotHull)
+}
+
+// TraceHullWithMask is like TraceHull but only considers contents matching mask solid.
+// Use MaskPlayerSolid for player movement checks.
+func (m Map) TraceHullWithMask(origin, destination, mins, maxs mgl32.Vec3, mask int32) *Trace {
+	return m.trace(newTraceInfo(origin, destination, mins, maxs, mask))
+}
+
+// traceInfo holds the parameters of a single trace, see TraceInfo_t in the engine.
+type traceInfo struct {
+	origin, destination mgl32.Vec3 // as passed by the caller
+	start, end          mgl32.Vec3 // center of the swept box
+	delta               mgl32.Vec3
+	extents             mgl32.Vec3 // half size of the swept box
+	isPoint             bool
+	mask                int32
+	headNode            int32 // root of the traced tree, 0 for the world or the head node of a brush entity
+
+	// if set, visitLeaf is called for every leaf along the trace (in order) instead of tracing against its contents
+	visitLeaf func(leafIndex int32)
+
+	mailbox *mailbox // shared with local traces (brush entities)
+}
+
+func newTraceInfo(origin, destination, mins, maxs mgl32.Vec3, mask int32) *traceInfo {
+	ti := &traceInfo{mailbox: &mailbox{}}
+	ti.init(origin, destination, mins, maxs, mask)
+
+	return ti
+}
+
+// init sets the parameters of the trace and clears its mailbox, so the traceInfo can be reused for another trace.
+func (ti *traceInfo) init(origin, destination, mins, maxs mgl32.Vec3, mask int32) {
+	offset := mins.Add(maxs).Mul(0.5)
+	start := origin.Add(offset)
+	end := destination.Add(offset)
+
+	*ti = traceInfo{
+		origin:      origin,
+		destination: destination,
+		start:       start,
+		end:         end,
+		delta:       end.Sub(start),
+		extents:     maxs.Sub(mins).Mul(0.5),
+		isPoint:     mins == maxs,
+		mask:        mask,
+		mailbox:     ti.mailbox,
 	}
 
-	m.rayCastNode(0, 0, 1, origin, destination, out)
+	ti.mailbox.reset()
+}
+
+func (m Map) trace(ti *traceInfo) *Trace {
+	out := new(Trace)
+	m.traceInto(ti, out)
+
+	return out
+}
+
+// traceInto is like trace but writes the result to out.
+func (m Map) traceInto(ti *traceInfo, out *Trace) {
+	// see CM_ClearTrace
+	*out = Trace{
+		Fraction: 1,
+	}
+
+	m.rayCastNode(ti, 0, 0, 1, ti.start, ti.end, out)
+	m.finishTrace(ti, out)
+}
+
+// finishTrace traces against entities after the world was traced and sets EndPos.
+func (m Map) finishTrace(ti *traceInfo, out *Trace) {
+	m.traceBrushEntities(ti, out)
+	m.traceDynamicProps(ti, out)
 
 	if out.Fraction < 1 {
 		for i := 0; i < 3; i++ {
-			out.EndPos[i] = origin[i] + out.Fraction*(destination[i]-origin[i])
+			out.EndPos[i] = ti.origin[i] + out.Fraction*(ti.destination[i]-ti.origin[i])
 		}
 	} else {
-		out.EndPos = destination
+		out.EndPos = ti.destination
 	}
-
-	return out
 }
 
 const (
@@ -163,7 +370,10 @@ const (
 	SolidVPhysics = 6
 )
 
-func (m Map) rayCastNode(nodeIndex int32, startFraction, endFraction float32,
+// rayCastNode is a port of CM_RecursiveHullCheck.
+// origin and destination are the part of the trace that is inside the node,
+// at startFraction and endFraction of the whole trace.
+func (m Map) rayCastNode(ti *traceInfo, nodeIndex int32, startFraction, endFraction float32,
 	origin, destination mgl32.Vec3, out *Trace,
 ) {
 	if out.Fraction <= startFraction {
@@ -171,197 +381,292 @@ func (m Map) rayCastNode(nodeIndex int32, startFraction, endFraction float32,
 	}
 
 	if nodeIndex < 0 {
-		leafIndex := -nodeIndex - 1
-		leaf := m.leaves[leafIndex]
+		if ti.visitLeaf != nil {
+			ti.visitLeaf(-nodeIndex - 1)
+		} else {
+			m.rayCastLeaf(ti, -nodeIndex-1, out)
+		}
 
-		for i := uint16(0); i < leaf.NumLeafBrushes; i++ {
-			brushIndex := m.leafBrushes[leaf.FirstLeafBrush+i]
-			brush := &m.brushes[brushIndex]
+		return
+	}
 
-			if brush.Contents&bsp.MASK_SHOT_HULL == 0 {
-				continue
-			}
+	node := m.nodes[nodeIndex]
+	plane := m.planes[node.PlaneNum]
 
-			m.rayCastBrush(brush, origin, destination, out)
+	var startDistance, endDistance, offset float32
 
-			if out.Fraction == 0 {
-				return
-			}
+	if plane.AxisType < 3 {
+		startDistance = origin[plane.AxisType] - plane.Distance
+		endDistance = destination[plane.AxisType] - plane.Distance
+		offset = ti.extents[plane.AxisType]
+	} else {
+		startDistance = origin.Dot(plane.Normal) - plane.Distance
+		endDistance = destination.Dot(plane.Normal) - plane.Distance
 
-			out.Brush = brush
+		if !ti.isPoint {
+			offset = dotAbs(ti.extents, plane.Normal)
 		}
+	}
+
+	if startDistance >= offset && endDistance >= offset {
+		m.rayCastNode(ti, node.Children[0], startFraction, endFraction, origin, destination, out)
+
+		return
+	}
 
-		for _, p := range m.staticPropsByLeaf[uint16(leafIndex)] {
-			r := collision.RayCastResult{}
+	if startDistance < -offset && endDistance < -offset {
+		m.rayCastNode(ti, node.Children[1], startFraction, endFraction, origin, destination, out)
 
-			switch p.prop.GetSolid() {
-			case SolidNone:
-				// nop
+		return
+	}
 
-			case SolidBSP:
-				// not implemented
+	// put the crosspoint distEpsilon units on the near side
+	var (
+		sideID                        uint
+		fractionFirst, fractionSecond float32
+	)
+
+	if startDistance < endDistance {
+		// back
+		sideID = 1
+		inversedDistance := 1 / (startDistance - endDistance)
+
+		fractionFirst = (startDistance - offset - distEpsilon) * inversedDistance
+		fractionSecond = (startDistance + offset + distEpsilon) * inversedDistance
+	} else if endDistance < startDistance {
+		// front
+		sideID = 0
+		inversedDistance := 1 / (startDistance - endDistance)
+
+		fractionFirst = (startDistance + offset + distEpsilon) * inversedDistance
+		fractionSecond = (startDistance - offset - distEpsilon) * inversedDistance
+	} else {
+		// front
+		sideID = 0
+		fractionFirst = 1
+		fractionSecond = 0
+	}
 
-			case SolidCustom:
-				// not implemented
+	fractionFirst = mgl32.Clamp(fractionFirst, 0, 1)
+	fractionMiddle := startFraction + (endFraction-startFraction)*fractionFirst
+	middle := origin.Add(destination.Sub(origin).Mul(fractionFirst))
 
-			case SolidOBB:
-				// not implemented
+	m.rayCastNode(ti, node.Children[sideID], startFraction, fractionMiddle, origin, middle, out)
 
-			case SolidOBBYaw:
-				// not implemented
+	fractionSecond = mgl32.Clamp(fractionSecond, 0, 1)
+	fractionMiddle = startFraction + (endFraction-startFraction)*fractionSecond
+	middle = origin.Add(destination.Sub(origin).Mul(fractionSecond))
 
-			case SolidVPhysics:
-				for _, t := range p.triangles {
-					r = collision.RayIntersectsTriangle(origin, destination, t)
-					if r.Hit {
-						break
-					}
-				}
+	m.rayCastNode(ti, node.Children[(^sideID)&1], fractionMiddle, endFraction, middle, destination, out)
+}
 
-			case SolidBBox:
-				r = collision.RayIntersectsAxisAlignedBoundingBox(origin, destination, p.min, p.max)
-			}
+// rayCastLeaf is a port of CM_TraceToLeaf, it traces against everything in the leaf.
+func (m Map) rayCastLeaf(ti *traceInfo, leafIndex int32, out *Trace) {
+	leaf := m.leaves[leafIndex]
 
-			if r.Hit {
-				out.Fraction = 0 // TODO: should not be 0, should be fraction of ray
-				return
-			}
+	for i := uint16(0); i < leaf.NumLeafBrushes; i++ {
+		brushIndex := m.leafBrushes[leaf.FirstLeafBrush+i]
+		brush := &m.brushes[brushIndex]
+
+		if !m.brushMatchesMask(brush, ti.mask) {
+			continue
 		}
 
-		// TODO: handle leaf displacements
+		m.rayCastBrush(ti, brush, out)
 
-		if out.StartSolid || out.Fraction < 1 {
+		if out.Fraction == 0 {
 			return
 		}
+	}
 
-		for i := uint16(0); i < leaf.NumLeafFaces; i++ {
-			m.rayCastSurface(int(m.leafFaces[leaf.FirstLeafFace+i]),
-				origin, destination, out)
+	for _, p := range m.staticPropsByLeaf[uint16(leafIndex)] {
+		if ti.mask&bsp.CONTENTS_SOLID == 0 {
+			break
 		}
 
-		return
-	}
+		if !testOnce(&ti.mailbox.props, len(m.staticPropLump.props), p.Index) || !p.touches(ti) {
+			continue
+		}
 
-	node := m.nodes[nodeIndex]
-	plane := m.planes[node.PlaneNum]
+		r := p.rayCast(ti)
 
-	var startDistance, endDistance float32
+		if r.Hit && float32(r.T) < out.Fraction {
+			out.Fraction = float32(r.T)
+			out.Contents = bsp.CONTENTS_SOLID
+			out.setHit(HitStaticProp)
+			out.Plane = ti.hitPlane(r)
+			out.StaticProp = int32(p.Index)
+			out.Model = p.Model
 
-	if plane.AxisType < 3 {
-		startDistance = origin[plane.AxisType] - plane.Distance
-		endDistance = destination[plane.AxisType] - plane.Distance
-	} else {
-		startDistance = origin.Dot(plane.Normal) - plane.Distance
-		endDistance = destination.Dot(plane.Normal) - plane.Distance
-	}
+			if p.model != nil {
+				out.Surface.SurfaceProp = p.model.surfaceProp
+			}
+		}
 
-	if startDistance >= 0 && endDistance >= 0 {
-		m.rayCastNode(node.Children[0], startFraction, endFraction, origin, destination, out)
-	} else if startDistance < 0 && endDistance < 0 {
-		m.rayCastNode(node.Children[1], startFraction, endFraction, origin, destination, out)
-	} else {
-		var (
-			sideID                        uint
-			fractionFirst, fractionSecond float32
-			middle                        mgl32.Vec3
-		)
-
-		if startDistance < endDistance {
-			// back
-			sideID = 1
-			inversedDistance := 1 / (startDistance - endDistance)
-
-			fractionFirst = (startDistance + mgl32.Epsilon) * inversedDistance
-			fractionSecond = fractionFirst
-		} else if endDistance < startDistance {
-			// front
-			sideID = 0
-			inversedDistance := 1 / (startDistance - endDistance)
-
-			fractionFirst = (startDistance + mgl32.Epsilon) * inversedDistance
-			fractionSecond = (startDistance - mgl32.Epsilon) * inversedDistance
-		} else {
-			// front
-			sideID = 0
-			fractionFirst = 1
-			fractionSecond = 0
+		if out.Fraction == 0 {
+			return
 		}
-		if fractionFirst < 0 {
-			fractionFirst = 0
-		} else if fractionFirst > 1 {
-			fractionFirst = 1
+	}
+
+	for _, d := range m.displacementsByLeaf[uint16(leafIndex)] {
+		if d.contents&ti.mask == 0 || !testOnce(&ti.mailbox.displacements, len(m.displacements), d.index) {
+			continue
 		}
-		if fractionSecond < 0 {
-			fractionSecond = 0
-		} else if fractionSecond > 1 {
-			fractionSecond = 1
+
+		if (ti.isPoint && d.flags&dispInfoFlagNoRay != 0) || (!ti.isPoint && d.flags&dispInfoFlagNoHull != 0) {
+			continue
 		}
 
-		fractionMiddle := startFraction + (endFraction-startFraction)*fractionFirst
-		for i := 0; i < 3; i++ {
-			middle[i] = origin[i] + fractionFirst*(destination[i]-origin[i])
+		m.rayCastDisplacement(ti, d, out)
+
+		if out.Fraction == 0 {
+			return
 		}
+	}
 
-		m.rayCastNode(node.Children[sideID],
-			startFraction, fractionMiddle, origin, middle, out)
-		for i := 0; i < 3; i++ {
-			middle[i] = origin[i] + fractionSecond*(destination[i]-origin[i])
+	if out.StartSolid || !ti.isPoint {
+		return
+	}
+
+	for i := uint16(0); i < leaf.NumLeafFaces; i++ {
+		m.rayCastSurface(ti, int(m.leafFaces[leaf.FirstLeafFace+i]), out)
+	}
+}
+
+// rayCast intersects the trace with the collision model of a prop.
+// T of the result is the fraction of the trace.
+func (p *propCollision) rayCast(ti *traceInfo) (r collision.RayCastResult) {
+	switch p.effectiveSolid() {
+	case SolidNone:
+		// nop
+
+	case SolidOBB, SolidOBBYaw:
+		r = collision.SweepOrientedBoundingBox(ti.start, ti.end, ti.extents, p.obb)
+
+	case SolidVPhysics:
+		// find the nearest hit
+		closest := func(hit collision.RayCastResult) float32 {
+			if hit.Hit && hit.T <= 1 && (!r.Hit || hit.T < r.T) {
+				r = hit
+			}
+
+			if r.Hit {
+				return float32(r.T)
+			}
+
+			return 1
 		}
 
-		m.rayCastNode(node.Children[(^sideID)&1],
-			fractionMiddle, endFraction, middle, destination, out)
+		p.triangleTree.Sweep(ti.start, ti.end, ti.extents, func(i int) float32 {
+			return closest(rayCastTriangle(ti, p.triangles[i]))
+		})
+
+		p.hullTree.Sweep(ti.start, ti.end, ti.extents, func(i int) float32 {
+			return closest(collision.SweepConvexHull(ti.start, ti.end, ti.extents, p.hulls[i]))
+		})
+
+	case SolidBBox:
+		r = collision.SweepAxisAlignedBoundingBox(ti.start, ti.end, ti.extents, p.min, p.max)
 	}
+
+	if r.T > 1 {
+		return collision.RayCastResult{}
+	}
+
+	return r
 }
 
-func (m Map) rayCastBrush(brush *brush.Brush, origin, destination mgl32.Vec3, out *Trace) {
-	if brush.NumSides != 0 {
-		fractionToEnter := float32(-99)
-		fractionToLeave := float32(1)
-		startsOut := false
-		endsOut := false
+// brushClip is the result of clipping a trace against the sides of a brush.
+type brushClip struct {
+	fractionToEnter, fractionToLeave float32
+	enterSide, leaveSide             int32 // indices into brushSides, -1 if not entered / left
+	startsOut, endsOut               bool
+}
+
+const fractionNeverUpdated = float32(-99)
+
+// clipBrush clips the trace against the sides of a brush, see CM_ClipBoxToBrush.
+// Returns false if the trace is completely in front of one of the sides.
+func (m Map) clipBrush(ti *traceInfo, brush *brush.Brush) (c brushClip, ok bool) {
+	c.fractionToEnter = fractionNeverUpdated
+	c.fractionToLeave = 1
+	c.enterSide = -1
+	c.leaveSide = -1
+
+	for i := int32(0); i < brush.NumSides; i++ {
+		brushSide := m.brushSides[brush.FirstSide+i]
+		plane := m.planes[brushSide.PlaneNum]
 
-		for i := int32(0); i < brush.NumSides; i++ {
-			brushSide := m.brushSides[brush.FirstSide+i]
+		var dist float32
+
+		if ti.isPoint {
+			// don't trace rays against bevel planes
 			if brushSide.Bevel&0xff != 0 {
 				continue
 			}
 
-			plane := m.planes[brushSide.PlaneNum]
+			dist = plane.Distance
+		} else {
+			// push the plane out appropriately for mins/maxs
+			dist = plane.Distance + dotAbs(ti.extents, plane.Normal)
+		}
 
-			startDistance := origin.Dot(plane.Normal) - plane.Distance
-			endDistance := destination.Dot(plane.Normal) - plane.Distance
+		startDistance := ti.start.Dot(plane.Normal) - dist
+		endDistance := ti.end.Dot(plane.Normal) - dist
 
-			if startDistance > 0 {
-				startsOut = true
+		if startDistance > 0 {
+			c.startsOut = true
 
-				if endDistance > 0 {
-					return
-				}
-			} else {
-				if endDistance <= 0 {
-					continue
-				}
-				endsOut = true
+			if endDistance > 0 {
+				return c, false
 			}
+		} else {
+			if endDistance <= 0 {
+				continue
+			}
+			c.endsOut = true
+		}
 
-			if startDistance > endDistance {
-				fraction := startDistance - distEpsilon
-				if fraction < 0 {
-					fraction = 0
-				}
+		if startDistance > endDistance {
+			fraction := startDistance - distEpsilon
+			if fraction < 0 {
+				fraction = 0
+			}
 
-				if fraction > fractionToEnter {
-					fractionToEnter = fraction
-				}
-			} else {
-				fraction := (startDistance + distEpsilon) / (startDistance - endDistance)
-				if fraction < fractionToLeave {
-					fractionToLeave = fraction
-				}
+			fraction /= startDistance - endDistance
+
+			if fraction > c.fractionToEnter {
+				c.fractionToEnter = fraction
+				c.enterSide = brush.FirstSide + i
 			}
+		} else {
+			fraction := (startDistance + distEpsilon) / (startDistance - endDistance)
+			if fraction < c.fractionToLeave {
+				c.fractionToLeave = fraction
+				c.leaveSide = brush.FirstSide + i
+			}
+		}
+	}
+
+	return c, true
+}
+
+// rayCastBrush is a port of CM_ClipBoxToBrush.
+func (m Map) rayCastBrush(ti *traceInfo, brush *brush.Brush, out *Trace) {
+	if brush.NumSides != 0 {
+		c, ok := m.clipBrush(ti, brush)
+		if !ok {
+			return
 		}
 
-		if startsOut && out.FractionLeftSolid-fractionToEnter > 0 {
+		fractionToEnter := c.fractionToEnter
+		fractionToLeave := c.fractionToLeave
+		leadSide := c.enterSide
+		startsOut := c.startsOut
+		endsOut := c.endsOut
+
+		// fractionLeftSolid can't be computed for box sweeps
+		if ti.isPoint && startsOut && out.FractionLeftSolid-fractionToEnter > 0 {
 			startsOut = false
 		}
 
@@ -380,6 +685,7 @@ func (m Map) rayCastBrush(brush *brush.Brush, origin, destination mgl32.Vec3, ou
 
 				if out.Fraction <= fractionToLeave {
 					out.Fraction = 1
+					out.setHit(HitNone)
 				}
 			}
 
@@ -387,59 +693,162 @@ func (m Map) rayCastBrush(brush *brush.Brush, origin, destination mgl32.Vec3, ou
 		}
 
 		if fractionToEnter < fractionToLeave {
-			if fractionToEnter > -99 && fractionToEnter < out.Fraction {
+			if fractionToEnter > fractionNeverUpdated && fractionToEnter < out.Fraction {
 				if fractionToEnter < 0 {
 					fractionToEnter = 0
 				}
 
+				side := m.brushSides[leadSide]
+
 				out.Fraction = fractionToEnter
-				out.Brush = brush
 				out.Contents = brush.Contents
+				out.setHit(HitBrush)
+				out.Brush = brush
+				out.BrushSide = leadSide
+				out.Plane = m.planes[side.PlaneNum]
+				out.Surface = m.surface(side.TexInfo)
 			}
 		}
 	}
 }
 
-func (m Map) rayCastSurface(index int, origin, destination mgl32.Vec3, out *Trace) {
-	if index >= len(m.polygons) {
-		return
+// rayCastDisplacement intersects the trace with the triangles of a displacement.
+func (m Map) rayCastDisplacement(ti *traceInfo, disp *displacement, out *Trace) {
+	for i := 0; i < 3; i++ {
+		if (ti.start[i]+ti.extents[i] < disp.min[i] && ti.end[i]+ti.extents[i] < disp.min[i]) ||
+			(ti.start[i]-ti.extents[i] > disp.max[i] && ti.end[i]-ti.extents[i] > disp.max[i]) {
+			return
+		}
 	}
 
-	polygon := m.polygons[index]
-	plane := polygon.plane
-	dot1 := plane.dist(origin)
-	dot2 := plane.dist(destination)
+	disp.tree.Sweep(ti.start, ti.end, ti.extents, func(i int) float32 {
+		r := rayCastTriangle(ti, disp.triangles[i])
 
-	if (dot1 > 0) != (dot2 > 0) {
-		if dot1-dot2 < distEpsilon {
-			return
+		if !r.Hit || r.T > 1 {
+			return out.Fraction
 		}
 
-		t := dot1 / (dot1 - dot2)
-		if t <= 0 {
-			return
+		if fraction := float32(r.T); fraction < out.Fraction {
+			out.Fraction = fraction
+			out.Contents = disp.contents
+			out.setHit(HitDisplacement)
+			out.Plane = ti.hitPlane(r)
+			out.Face = int32(disp.face)
+			out.DispFlags = disp.tags[i]
+			out.Surface = m.surface(m.surfaces[disp.face].TexInfo)
 		}
 
-		i := 0
-		intersection := origin.Add(destination.Sub(origin).Mul(t))
+		return out.Fraction
+	})
+}
 
-		for ; i < polygon.numVerts; i++ {
-			edgePlane := polygon.edgePlanes[i]
-			if edgePlane.origin.Len() == 0 {
-				edgePlane.origin = plane.origin.Sub(
-					polygon.verts[i].Sub(polygon.verts[(i+1)%polygon.numVerts]))
-				edgePlane.origin.Normalize()
-				edgePlane.distance = edgePlane.origin.Dot(polygon.verts[i])
-			}
+// rayCastTriangle intersects the trace (ray or swept box) with a triangle.
+func rayCastTriangle(ti *traceInfo, t [3]mgl32.Vec3) collision.RayCastResult {
+	if ti.isPoint {
+		return collision.RayIntersectsTriangle(ti.start, ti.delta, t)
+	}
 
-			if edgePlane.dist(intersection) < 0 {
-				break
-			}
+	return collision.SweepTriangle(ti.start, ti.end, ti.extents, t)
+}
+
+// hitPlane returns the plane of a collision result, moved from the center of the swept box to the hit surface.
+func (ti *traceInfo) hitPlane(r collision.RayCastResult) plane.Plane {
+	p := newPlane(r.Normal, r.Point)
+	p.Distance -= dotAbs(ti.extents, r.Normal)
+
+	return p
+}
+
+func dotAbs(a, b mgl32.Vec3) float32 {
+	var res float32
+
+	for i := 0; i < 3; i++ {
+		if f := a[i] * b[i]; f < 0 {
+			res -= f
+		} else {
+			res += f
+		}
+	}
+
+	return res
+}
+
+// faceCrossing returns the fraction at which the segment from origin to destination crosses a face
+// and the plane of the face, facing towards origin.
+func (m Map) faceCrossing(index int, origin, destination mgl32.Vec3) (float32, plane.Plane, bool) {
+	if index >= len(m.polygons) {
+		return 0, plane.Plane{}, false
+	}
+
+	polygon := m.polygons[index]
+	vp := polygon.plane
+	dot1 := vp.dist(origin)
+	dot2 := vp.dist(destination)
+
+	if (dot1 > 0) == (dot2 > 0) {
+		return 0, plane.Plane{}, false
+	}
+
+	if dot1-dot2 < distEpsilon && dot2-dot1 < distEpsilon {
+		return 0, plane.Plane{}, false
+	}
+
+	t := dot1 / (dot1 - dot2)
+	if t <= 0 {
+		return 0, plane.Plane{}, false
+	}
+
+	intersection := origin.Add(destination.Sub(origin).Mul(t))
+
+	// the intersection must be on the same side of all edges
+	var front, back bool
+
+	for i := 0; i < polygon.numVerts; i++ {
+		edge := polygon.verts[(i+1)%polygon.numVerts].Sub(polygon.verts[i])
+		edgeNormal := vp.origin.Cross(edge)
+
+		d := edgeNormal.Dot(intersection.Sub(polygon.verts[i]))
+		if d > 0 {
+			front = true
+		} else if d < 0 {
+			back = true
 		}
 
-		if i == polygon.numVerts {
-			out.Fraction = 0.2
-			out.EndPos = intersection
+		if front && back {
+			return 0, plane.Plane{}, false
 		}
 	}
+
+	p := newPlane(vp.origin, intersection)
+
+	if dot1 < 0 {
+		p.Normal = p.Normal.Mul(-1)
+		p.Distance = -p.Distance
+	}
+
+	return t, p, true
+}
+
+// rayCastSurface intersects the trace with a face.
+// Faces only block the trace if the leaf behind them is solid for the mask of the trace,
+// e.g. water surfaces don't block MaskShotHull and glass doesn't block MaskVisible.
+func (m Map) rayCastSurface(ti *traceInfo, index int, out *Trace) {
+	t, p, ok := m.faceCrossing(index, ti.start, ti.end)
+	if !ok || t >= out.Fraction {
+		return
+	}
+
+	behind := ti.start.Add(ti.delta.Mul(t)).Sub(p.Normal.Mul(distEpsilon))
+
+	contents := m.leaves[m.leafIndexFrom(ti.headNode, behind)].Contents
+	if contents&ti.mask == 0 {
+		return
+	}
+
+	out.Fraction = t
+	out.Contents = contents
+	out.setHit(HitFace)
+	out.Plane = p
+	out.Face = int32(index)
+	out.Surface = m.surface(m.surfaces[index].TexInfo)
 }
@@ -1,11 +1,15 @@
 package bsptracer_test
 
 import (
+	"bytes"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/galaco/bsp"
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/stretchr/testify/assert"
 
@@ -55,13 +59,36 @@ func TestMap_TraceRay_de_cache(t *testing.T) {
 	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
 	assert.NoError(t, err)
 
+	// doors block visibility through their (closed) area portals
+	doorsClosed := m.NewAreaPortalState()
+	for _, p := range m.AreaPortals() {
+		doorsClosed.SetOpen(p.Key, false)
+	}
+
+	// the doors that open and close the area portals between the areas of a and b
+	doorsBetween := func(a, b mgl32.Vec3) []bsptracer.Entity {
+		areas := [2]int16{m.LeafAt(a).Area, m.LeafAt(b).Area}
+
+		var doors []bsptracer.Entity
+
+		for _, p := range m.AreaPortals() {
+			if p.Door != "" && (p.Areas == areas || p.Areas == [2]int16{areas[1], areas[0]}) {
+				doors = append(doors, m.FindByTargetname(p.Door)...)
+			}
+		}
+
+		return doors
+	}
+
 	type args struct {
 		origin      mgl32.Vec3
 		destination mgl32.Vec3
+		portals     *bsptracer.AreaPortalState // if set visibility is checked with IsVisibleWithAreaPortals
 	}
 	type out struct {
 		visible bool
-		trace   bsptracer.Trace
+		trace   bsptracer.Trace                         // expected trace, if check is nil
+		check   func(t *testing.T, tr *bsptracer.Trace) // checks what was hit, the trace is blocked
 	}
 	tests := []struct {
 		name string
@@ -76,18 +103,20 @@ func TestMap_TraceRay_de_cache(t *testing.T) {
 			},
 			want: out{
 				visible: true,
-				trace:   bsptracer.Trace{AllSolid: true, StartSolid: true, Fraction: 1, EndPos: mgl32.Vec3{-233, 1343, 1751}},
+				trace:   bsptracer.Trace{Fraction: 1, EndPos: mgl32.Vec3{-233, 1343, 1751}},
 			},
 		},
 		{
+			// T spawn is in an empty leaf (see TestMap_PointContents_de_cache), the trace doesn't start in solid
 			name: "T spawn -> A site",
 			args: args{
 				origin:      mgl32.Vec3{3306, 431, 1723},
 				destination: mgl32.Vec3{-233, 1343, 1751},
 			},
 			want: out{
-				visible: false,
-				trace:   bsptracer.Trace{AllSolid: true, StartSolid: true, FractionLeftSolid: 1, EndPos: mgl32.Vec3{3306, 431, 1723}, Contents: 1, NumBrushSides: 7},
+				check: func(t *testing.T, tr *bsptracer.Trace) {
+					assert.NotEqual(t, bsptracer.HitNone, tr.HitKind)
+				},
 			},
 		},
 		{
@@ -98,7 +127,7 @@ func TestMap_TraceRay_de_cache(t *testing.T) {
 			},
 			want: out{
 				visible: true,
-				trace:   bsptracer.Trace{AllSolid: true, StartSolid: true, Fraction: 1, EndPos: mgl32.Vec3{3303, 431, 1723}},
+				trace:   bsptracer.Trace{Fraction: 1, EndPos: mgl32.Vec3{3303, 431, 1723}},
 			},
 		},
 		{
@@ -106,10 +135,33 @@ func TestMap_TraceRay_de_cache(t *testing.T) {
 			args: args{
 				origin:      mgl32.Vec3{207, 1948, 1751},
 				destination: mgl32.Vec3{259, 2251, 1752},
+				portals:     doorsClosed,
 			},
 			want: out{
-				visible: false,
-				trace:   bsptracer.Trace{AllSolid: true, StartSolid: true, Fraction: 1, EndPos: mgl32.Vec3{259, 2251, 1752}},
+				check: func(t *testing.T, tr *bsptracer.Trace) {
+					var door *bsptracer.Entity
+
+					for _, ent := range doorsBetween(mgl32.Vec3{207, 1948, 1751}, mgl32.Vec3{259, 2251, 1752}) {
+						if ent.Index == tr.Entity {
+							ent := ent
+							door = &ent
+						}
+					}
+
+					if !assert.NotNil(t, door, "hit entity %d is not a door between the areas", tr.Entity) {
+						return
+					}
+
+					// func_door / func_door_rotating or prop_door_rotating
+					if strings.HasPrefix(door.Model(), "*") {
+						assert.Equal(t, bsptracer.HitBrush, tr.HitKind)
+						assert.NotEmpty(t, tr.Surface.Name)
+					} else {
+						assert.Equal(t, bsptracer.HitDynamicProp, tr.HitKind)
+						assert.Equal(t, door.Model(), tr.Model)
+						assert.NotEmpty(t, tr.Surface.SurfaceProp)
+					}
+				},
 			},
 		},
 		{
@@ -119,8 +171,17 @@ func TestMap_TraceRay_de_cache(t *testing.T) {
 				destination: mgl32.Vec3{138, 396, 1677},
 			},
 			want: out{
-				visible: false,
-				trace:   bsptracer.Trace{AllSolid: true, StartSolid: true, Fraction: 1, EndPos: mgl32.Vec3{138, 396, 1677}},
+				check: func(t *testing.T, tr *bsptracer.Trace) {
+					assert.Equal(t, bsptracer.HitStaticProp, tr.HitKind)
+					assert.Zero(t, tr.Entity)
+
+					if assert.Less(t, int(tr.StaticProp), len(m.StaticProps())) {
+						assert.Equal(t, m.StaticProps()[tr.StaticProp].Model, tr.Model)
+					}
+
+					assert.True(t, strings.HasSuffix(tr.Model, ".mdl"), tr.Model)
+					assert.NotEmpty(t, tr.Surface.SurfaceProp)
+				},
 			},
 		},
 	}
@@ -130,16 +191,368 @@ func TestMap_TraceRay_de_cache(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
+			if tt.args.portals != nil {
+				assert.Equal(t, tt.want.visible, m.IsVisibleWithAreaPortals(tt.args.origin, tt.args.destination, tt.args.portals), "IsVisibleWithAreaPortals(%v, %v)", tt.args.origin, tt.args.destination)
+			}
+
 			assert.Equal(t, tt.want.visible, m.IsVisible(tt.args.origin, tt.args.destination), "IsVisible(%v, %v)", tt.args.origin, tt.args.destination)
 
 			actual := m.TraceRay(tt.args.origin, tt.args.destination)
-			actual.Brush = nil // skip comparing this
 
-			assert.Equalf(t, tt.want.trace, *actual, "TraceRay(%v, %v)", tt.args.origin, tt.args.destination)
+			if tt.want.check == nil {
+				actual.Brush = nil // skip comparing this
+
+				assert.Equalf(t, tt.want.trace, *actual, "TraceRay(%v, %v)", tt.args.origin, tt.args.destination)
+
+				return
+			}
+
+			// blocked, but not starting in solid (see CM_ClearTrace)
+			assert.False(t, actual.StartSolid)
+			assert.False(t, actual.AllSolid)
+			assert.Greater(t, actual.Fraction, float32(0))
+			assert.Less(t, actual.Fraction, float32(1))
+
+			delta := tt.args.destination.Sub(tt.args.origin)
+			assert.True(t, tt.args.origin.Add(delta.Mul(actual.Fraction)).ApproxEqualThreshold(actual.EndPos, 1e-3), "EndPos %v", actual.EndPos)
+			assert.InDelta(t, 1, actual.Plane.Normal.Len(), 1e-4)
+			assert.Less(t, actual.Plane.Normal.Dot(delta), float32(0), "the hit plane faces the trace")
+
+			tt.want.check(t, actual)
 		})
 	}
 }
 
+func TestMap_TraceHull_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	mins := mgl32.Vec3{-16, -16, 0}
+	maxs := mgl32.Vec3{16, 16, 72}
+
+	// a box can't pass where a ray can't
+	blocked := m.TraceHull(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751}, mins, maxs)
+	assert.Less(t, blocked.Fraction, float32(1))
+
+	// zero sized hull is a ray
+	assert.Equal(t, m.TraceRay(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}),
+		m.TraceHull(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}, mgl32.Vec3{}, mgl32.Vec3{}))
+}
+
+func TestMap_TraceRayWithMask_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	for _, mask := range []int32{bsptracer.MaskVisible, bsptracer.MaskShot, bsptracer.MaskSolid, bsptracer.MaskPlayerSolid} {
+		assert.True(t, m.IsVisibleWithMask(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}, mask), "A site -> A site, open")
+		assert.False(t, m.IsVisibleWithMask(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751}, mask), "T spawn -> A site")
+	}
+
+	// nothing is water along this line
+	assert.True(t, m.IsVisibleWithMask(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751}, bsptracer.MaskWater))
+}
+
+func TestMap_TraceAll_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	assert.Empty(t, m.TraceAll(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}), "A site -> A site, open")
+
+	all := m.TraceAll(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751})
+	assert.NotEmpty(t, all, "T spawn -> A site")
+
+	for i := 1; i < len(all); i++ {
+		assert.LessOrEqual(t, all[i-1].EnterFraction, all[i].EnterFraction)
+		assert.LessOrEqual(t, all[i].EnterFraction, all[i].ExitFraction)
+	}
+}
+
+func TestMap_TraceBatch_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	points := []mgl32.Vec3{
+		{-12, 1444, 1751},  // A site
+		{-233, 1343, 1751}, // A site
+		{3306, 431, 1723},  // T spawn
+		{3303, 431, 1723},  // T spawn
+		{-94, 452, 1677},   // mid
+		{138, 396, 1677},   // mid
+	}
+
+	var rays []bsptracer.Ray
+
+	for _, a := range points {
+		for _, b := range points {
+			rays = append(rays, bsptracer.Ray{Origin: a, Destination: b})
+			rays = append(rays, bsptracer.Ray{Origin: a, Destination: b, Mins: mgl32.Vec3{-16, -16, 0}, Maxs: mgl32.Vec3{16, 16, 72}})
+		}
+	}
+
+	for _, opts := range []bsptracer.BatchOptions{{}, {Workers: 1}, {Workers: 4}, {Packets: true}} {
+		traces := m.TraceBatch(rays, opts)
+		assert.Len(t, traces, len(rays))
+
+		for i, r := range rays {
+			assert.Equal(t, m.TraceHull(r.Origin, r.Destination, r.Mins, r.Maxs), &traces[i], "ray %d", i)
+		}
+	}
+
+	visible := m.VisibilityMatrix(points)
+
+	for i := range points {
+		for j := range points {
+			if i == j {
+				assert.True(t, visible[i][j])
+
+				continue
+			}
+
+			assert.Equal(t, m.IsVisible(points[i], points[j]), visible[i][j], "%v -> %v", points[i], points[j])
+		}
+	}
+
+	visible = m.VisibilityMatrixWithOptions(points, bsptracer.BatchOptions{Mask: bsptracer.MaskVisible, Workers: 2})
+	assert.Equal(t, m.IsVisibleWithMask(points[0], points[1], bsptracer.MaskVisible), visible[0][1])
+}
+
+func TestMap_WriteTo_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	_, err = m.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	cached, err := bsptracer.ReadMap(&buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, m.StaticProps(), cached.StaticProps())
+	assert.Equal(t, m.DynamicProps(), cached.DynamicProps())
+	assert.Equal(t, m.BrushEntities(), cached.BrushEntities())
+	assert.Equal(t, m.Entities(), cached.Entities())
+	assert.Equal(t, m.AreaPortals(), cached.AreaPortals())
+
+	points := []mgl32.Vec3{
+		{-12, 1444, 1751},  // A site
+		{-233, 1343, 1751}, // A site
+		{3306, 431, 1723},  // T spawn
+		{-94, 452, 1677},   // mid
+		{138, 396, 1677},   // mid
+	}
+
+	for _, a := range points {
+		for _, b := range points {
+			assert.Equal(t, m.TraceRay(a, b), cached.TraceRay(a, b))
+			assert.Equal(t, m.TraceHull(a, b, mgl32.Vec3{-16, -16, 0}, mgl32.Vec3{16, 16, 72}), cached.TraceHull(a, b, mgl32.Vec3{-16, -16, 0}, mgl32.Vec3{16, 16, 72}))
+			assert.Equal(t, m.IsVisibleWithAreaPortals(a, b, m.NewAreaPortalState()), cached.IsVisibleWithAreaPortals(a, b, cached.NewAreaPortalState()))
+		}
+	}
+}
+
+func TestMap_TracePenetration_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	open := m.TracePenetration(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}, bsptracer.WeaponAK47)
+	assert.Empty(t, open.Segments, "A site -> A site, open")
+	assert.InDelta(t, 35.6, open.Damage, 0.1)
+	assert.False(t, open.Wallbang())
+
+	// way too much map in between
+	blocked := m.TracePenetration(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751}, bsptracer.WeaponAWP)
+	assert.NotEmpty(t, blocked.Segments, "T spawn -> A site")
+	assert.Zero(t, blocked.Damage)
+	assert.False(t, blocked.Segments[len(blocked.Segments)-1].Penetrated)
+}
+
+func TestMap_PointContents_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	tSpawn := mgl32.Vec3{3306, 431, 1723}
+	assert.Zero(t, m.PointContents(tSpawn))
+
+	leaf := m.LeafAt(tSpawn)
+	assert.NotEqual(t, int16(-1), leaf.Cluster)
+	assert.Zero(t, leaf.Contents&bsp.CONTENTS_SOLID)
+
+	outside := m.LeafAt(mgl32.Vec3{0, 0, -100000})
+	assert.Equal(t, int16(-1), outside.Cluster)
+	assert.NotZero(t, outside.Contents&bsp.CONTENTS_SOLID)
+}
+
+func TestMap_PotentiallyVisible_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	assert.True(t, m.PotentiallyVisible(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}), "A site -> A site, open")
+	assert.True(t, m.PotentiallyAudible(mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}), "A site -> A site, open")
+	assert.False(t, m.PotentiallyVisible(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751}), "T spawn -> A site")
+
+	leaf := m.LeafAt(mgl32.Vec3{3306, 431, 1723})
+	assert.True(t, m.ClusterVisible(leaf.Cluster, leaf.Cluster))
+}
+
+func TestMap_IsVisibleWithAreaPortals_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	aSite1, aSite2 := mgl32.Vec3{-12, 1444, 1751}, mgl32.Vec3{-233, 1343, 1751}
+	assert.True(t, m.IsVisibleWithAreaPortals(aSite1, aSite2, nil))
+
+	closed := m.NewAreaPortalState()
+	for _, p := range m.AreaPortals() {
+		closed.SetOpen(p.Key, false)
+	}
+
+	// the door between these points separates two areas, they are only connected while its portal is open
+	origin, destination := mgl32.Vec3{207, 1948, 1751}, mgl32.Vec3{259, 2251, 1752}
+	originArea, destinationArea := m.LeafAt(origin).Area, m.LeafAt(destination).Area
+	assert.NotEqual(t, originArea, destinationArea)
+	assert.True(t, m.AreasConnected(originArea, destinationArea, nil), "all portals open")
+	assert.False(t, m.AreasConnected(originArea, destinationArea, closed), "through door")
+	assert.False(t, m.IsVisibleWithAreaPortals(origin, destination, closed), "through door")
+}
+
+func TestMap_BrushEntities_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	entities := m.BrushEntities()
+	assert.NotEmpty(t, entities)
+
+	for _, e := range entities {
+		assert.NotZero(t, e.Model)
+		assert.NotEmpty(t, e.ClassName)
+	}
+}
+
+func TestMap_DynamicProps_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	props := m.DynamicProps()
+	assert.NotEmpty(t, props)
+
+	for _, p := range props {
+		assert.NotEmpty(t, p.Model)
+		assert.NotZero(t, p.Scale)
+		assert.False(t, p.ModelMissing, p.Model)
+	}
+}
+
+func TestMap_StaticProps_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	props := m.StaticProps()
+	assert.NotEmpty(t, props)
+
+	for i, p := range props {
+		assert.Equal(t, i, p.Index)
+		assert.NotEmpty(t, p.Model)
+		assert.Greater(t, p.UniformScale, float32(0))
+	}
+}
+
+func TestMap_Entities_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	entities := m.Entities()
+	assert.Equal(t, "worldspawn", entities[0].ClassName())
+
+	for i, ent := range entities {
+		assert.Equal(t, int32(i), ent.Index)
+	}
+
+	assert.NotEmpty(t, m.FindByClassname("info_player_terrorist"))
+	assert.NotEmpty(t, m.FindByClassname("info_player_counterterrorist"))
+	assert.Len(t, m.FindByClassname("func_bomb_target"), 2)
+	assert.Len(t, m.FindByClassname("func_buyzone"), 2)
+
+	for _, p := range m.DynamicProps() {
+		assert.Equal(t, p.ClassName, entities[p.Entity].ClassName())
+		assert.Equal(t, p.Origin, entities[p.Entity].Origin())
+	}
+}
+
+func TestMap_Volumes_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	assert.Len(t, m.Volumes("func_bomb_target"), 2)
+	assert.Len(t, m.Volumes("func_buyzone"), 2)
+
+	for _, e := range m.BrushEntities() {
+		assert.NotEqual(t, "func_buyzone", e.ClassName)
+	}
+
+	tSpawn := mgl32.Vec3{3306, 431, 1723}
+
+	assert.True(t, m.PointInVolume(tSpawn, "func_buyzone"))
+	assert.False(t, m.PointInVolume(tSpawn, "func_bomb_target"))
+	assert.False(t, m.PointInVolume(mgl32.Vec3{-94, 452, 1677}, "func_buyzone")) // mid
+}
+
 func TestLoadMap_de_cache_with_models(t *testing.T) {
 	t.Parallel()
 
@@ -149,6 +562,34 @@ func TestLoadMap_de_cache_with_models(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoadMapFromReader_de_cache(t *testing.T) {
+	t.Parallel()
+
+	csgoDir := csgoDir(t)
+
+	expected, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	f, err := os.Open("../../testdata/de_cache.bsp")
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	csgoPak, err := bsptracer.OpenVPKSource(csgoDir + "/csgo/pak01")
+	assert.NoError(t, err)
+
+	platformPak, err := bsptracer.OpenVPKSource(csgoDir + "/platform/platform_pak01")
+	assert.NoError(t, err)
+
+	// loose files don't exist, the VPKs are used as fallback
+	m, err := bsptracer.LoadMapFromReader(f, bsptracer.NewDirSource(t.TempDir()), csgoPak, platformPak)
+	assert.NoError(t, err)
+
+	assert.Equal(t, expected.StaticProps(), m.StaticProps())
+	assert.Equal(t, expected.DynamicProps(), m.DynamicProps())
+	assert.False(t, m.IsVisible(mgl32.Vec3{-94, 452, 1677}, mgl32.Vec3{138, 396, 1677}))
+}
+
 func BenchmarkTraceBox(b *testing.B) {
 	csgoDir := csgoDir(b)
 
@@ -161,3 +602,129 @@ func BenchmarkTraceBox(b *testing.B) {
 		assert.False(b, m.IsVisible(mgl32.Vec3{-94, 452, 1677}, mgl32.Vec3{138, 396, 1677}))
 	}
 }
+
+// BenchmarkTraceRay_LongDistance traces across the map, through many leaves with static props and displacements.
+func BenchmarkTraceRay_LongDistance(b *testing.B) {
+	csgoDir := csgoDir(b)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(b, err)
+
+	for _, bm := range []struct {
+		name  string
+		trace func(origin, destination mgl32.Vec3) *bsptracer.Trace
+	}{
+		{"bvh", m.TraceRay},
+		{"brute force", m.TraceRayBruteForce}, // without BVHs and mailboxes
+	} {
+		bm := bm
+
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bm.trace(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751})
+			}
+		})
+	}
+}
+
+func BenchmarkTraceAll(b *testing.B) {
+	csgoDir := csgoDir(b)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(b, err)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.TraceAll(mgl32.Vec3{3306, 431, 1723}, mgl32.Vec3{-233, 1343, 1751})
+	}
+}
+
+func BenchmarkVisibilityMatrix(b *testing.B) {
+	csgoDir := csgoDir(b)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(b, err)
+
+	// 10 players with 3 points each
+	var points []mgl32.Vec3
+
+	for i := 0; i < 10; i++ {
+		origin := mgl32.Vec3{-233 + float32(i)*350, 1343 - float32(i)*90, 1700}
+		points = append(points, origin, origin.Add(mgl32.Vec3{0, 0, 40}), origin.Add(mgl32.Vec3{0, 0, 64}))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.VisibilityMatrix(points)
+	}
+}
+
+// BenchmarkTraceBatch_Viewshed compares packet and scalar traces of rays from one origin to a grid of points.
+func BenchmarkTraceBatch_Viewshed(b *testing.B) {
+	csgoDir := csgoDir(b)
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", csgoDir+"/csgo/pak01", csgoDir+"/platform/platform_pak01")
+	assert.NoError(b, err)
+
+	origin := mgl32.Vec3{-12, 1444, 1751} // A site
+
+	var rays []bsptracer.Ray
+
+	for x := float32(-1500); x < 1500; x += 25 {
+		for y := float32(-1500); y < 1500; y += 25 {
+			rays = append(rays, bsptracer.Ray{Origin: origin, Destination: origin.Add(mgl32.Vec3{x, y, -64})})
+		}
+	}
+
+	for _, bm := range []struct {
+		name string
+		opts bsptracer.BatchOptions
+	}{
+		{"scalar", bsptracer.BatchOptions{Workers: 1}},
+		{"packets", bsptracer.BatchOptions{Workers: 1, Packets: true}},
+	} {
+		bm := bm
+
+		b.Run(bm.name, func(b *testing.B) {
+			start := time.Now()
+
+			for i := 0; i < b.N; i++ {
+				m.TraceBatch(rays, bm.opts)
+			}
+
+			b.ReportMetric(float64(b.N*len(rays))/time.Since(start).Seconds(), "rays/s")
+		})
+	}
+}
+
+// BenchmarkReadMap compares loading a map from a cache with loading it from the BSP and VPKs.
+func BenchmarkReadMap(b *testing.B) {
+	csgoDir := csgoDir(b)
+	vpks := []string{csgoDir + "/csgo/pak01", csgoDir + "/platform/platform_pak01"}
+
+	m, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", vpks...)
+	assert.NoError(b, err)
+
+	var buf bytes.Buffer
+
+	_, err = m.WriteTo(&buf)
+	assert.NoError(b, err)
+
+	b.Run("LoadMap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := bsptracer.LoadMapFromFileSystem("../../testdata/de_cache.bsp", vpks...)
+			assert.NoError(b, err)
+		}
+	})
+
+	b.Run("ReadMap", func(b *testing.B) {
+		b.SetBytes(int64(buf.Len()))
+
+		for i := 0; i < b.N; i++ {
+			_, err := bsptracer.ReadMap(bytes.NewReader(buf.Bytes()))
+			assert.NoError(b, err)
+		}
+	})
+}
@@ -1,9 +1,37 @@
 package bsptracer
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/lumps"
+	"github.com/galaco/bsp/primitives/area"
+	"github.com/galaco/bsp/primitives/areaportal"
+	"github.com/galaco/bsp/primitives/brush"
+	"github.com/galaco/bsp/primitives/brushside"
+	"github.com/galaco/bsp/primitives/dispinfo"
+	"github.com/galaco/bsp/primitives/disptris"
+	"github.com/galaco/bsp/primitives/dispvert"
+	"github.com/galaco/bsp/primitives/face"
+	"github.com/galaco/bsp/primitives/leaf"
+	"github.com/galaco/bsp/primitives/node"
+	"github.com/galaco/bsp/primitives/plane"
+	"github.com/galaco/bsp/primitives/texinfo"
+	"github.com/go-gl/mathgl/mgl32"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
 )
 
 func TestLoadMap_de_cache(t *testing.T) {
@@ -24,5 +52,1271 @@ func TestLoadMap_de_cache(t *testing.T) {
 	assert.Equal(t, 23221, len(m.surfaces))
 	assert.Equal(t, 185200, len(m.surfEdges))
 	assert.Equal(t, 48496, len(m.vertices))
-	assert.Equal(t, 46442, len(m.polygons))
+	assert.Equal(t, 23221, len(m.polygons)) // indexed like the faces
+	assert.NotEmpty(t, m.texDataNames)
+}
+
+func TestDecompressVis(t *testing.T) {
+	t.Parallel()
+
+	// cluster 0: clusters 0 and 2 followed by a run of 3 empty bytes
+	// cluster 1: a run of 3 empty bytes followed by cluster 24
+	data := []byte{0x05, 0x00, 0x03, 0x00, 0x03, 0x01}
+
+	assert.Equal(t, []uint64{0x05}, decompressVis(data, 0, 32))
+	assert.Equal(t, []uint64{1 << 24}, decompressVis(data, 3, 32))
+
+	sets := clusterSets{decompressVis(data, 0, 32), decompressVis(data, 3, 32)}
+	assert.True(t, sets.contains(0, 0))
+	assert.False(t, sets.contains(0, 1))
+	assert.True(t, sets.contains(0, -1), "invalid clusters are always potentially visible")
+}
+
+func TestMap_AreasConnected(t *testing.T) {
+	t.Parallel()
+
+	// 0 <-(1)-> 1 <-(2)-> 2
+	m := Map{
+		areas: []area.Area{
+			{FirstAreaPortal: 0, NumAreaPortals: 1},
+			{FirstAreaPortal: 1, NumAreaPortals: 2},
+			{FirstAreaPortal: 3, NumAreaPortals: 1},
+		},
+		areaPortalLump: []areaportal.AreaPortal{
+			{PortalKey: 1, OtherArea: 1},
+			{PortalKey: 1, OtherArea: 0},
+			{PortalKey: 2, OtherArea: 2},
+			{PortalKey: 2, OtherArea: 1},
+		},
+		areaPortals: []AreaPortal{
+			{Key: 1, Areas: [2]int16{0, 1}, StartOpen: true},
+			{Key: 2, Areas: [2]int16{1, 2}, Door: "door1", StartOpen: false},
+		},
+	}
+
+	assert.True(t, m.AreasConnected(0, 2, nil))
+
+	state := m.NewAreaPortalState()
+	assert.True(t, m.AreasConnected(0, 1, state))
+	assert.False(t, m.AreasConnected(0, 2, state))
+
+	state.SetDoorOpen("door1", true)
+	assert.True(t, m.AreasConnected(2, 0, state))
+
+	state.SetOpen(1, false)
+	assert.False(t, m.AreasConnected(2, 0, state))
+	assert.True(t, m.AreasConnected(2, 1, state))
+}
+
+func TestPhySolidBones(t *testing.T) {
+	t.Parallel()
+
+	text := `solid {
+"index" "0"
+"name" "hinge"
+"mass" "20.0"
+}
+solid {
+"index" "1"
+"name" "door"
+}
+ragdollconstraint {
+"parent" "0"
+"child" "1"
+}`
+
+	assert.Equal(t, map[int]string{0: "hinge", 1: "door"}, phySolidBones(text))
+	assert.Empty(t, phySolidBones(`solid {`))
+}
+
+func TestParseStaticPropLump(t *testing.T) {
+	t.Parallel()
+
+	var name [128]byte
+	copy(name[:], "models/props/crate.mdl")
+
+	// CS:GO v11 layout
+	type propV11 struct {
+		Origin, Angles                 mgl32.Vec3
+		PropType, FirstLeaf, LeafCount uint16
+		Solid, Flags                   uint8
+		Skin                           int32
+		FadeMinDist, FadeMaxDist       float32
+		LightingOrigin                 mgl32.Vec3
+		ForcedFadeScale                float32
+		Levels                         [4]uint8
+		DiffuseModulation              [4]uint8
+		DisableX360                    bool
+		_                              [3]byte
+		FlagsEx                        uint32
+		UniformScale                   float32
+	}
+
+	buf := new(bytes.Buffer)
+	for _, v := range []any{
+		int32(1), name,
+		int32(3), []uint16{4, 5, 6},
+		int32(2),
+		propV11{Origin: mgl32.Vec3{1, 2, 3}, Angles: mgl32.Vec3{0, 90, 0}, LeafCount: 2, Solid: SolidVPhysics, Flags: StaticPropFlagNoShadow, FlagsEx: 2, UniformScale: 1.5},
+		propV11{FirstLeaf: 2, LeafCount: 1, Solid: SolidNone, DisableX360: true},
+	} {
+		assert.NoError(t, binary.Write(buf, binary.LittleEndian, v))
+	}
+
+	lump, err := parseStaticPropLump(buf.Bytes(), 11)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"models/props/crate.mdl"}, lump.names)
+	assert.Equal(t, []uint16{4, 5, 6}, lump.leaves)
+	assert.Len(t, lump.props, 2)
+
+	assert.Equal(t, StaticProp{
+		Index:        0,
+		Model:        "models/props/crate.mdl",
+		Origin:       mgl32.Vec3{1, 2, 3},
+		Angles:       mgl32.Vec3{0, 90, 0},
+		UniformScale: 1.5,
+		Solid:        SolidVPhysics,
+		Flags:        StaticPropFlagNoShadow,
+		FlagsEx:      2,
+	}, lump.props[0].StaticProp)
+	assert.Equal(t, uint16(2), lump.props[1].firstLeaf)
+	assert.True(t, lump.props[1].DisableX360)
+	assert.Equal(t, float32(1), lump.props[1].UniformScale) // 0 isn't a valid scale
+
+	// older versions have no scale, newer versions are read like v11
+	lump, err = parseStaticPropLump(buf.Bytes(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1), lump.props[0].UniformScale)
+
+	lump, err = parseStaticPropLump(buf.Bytes(), 12)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1.5), lump.props[0].UniformScale)
+
+	props, byLeaf := loadStaticProps(lump, []*model{nil}, PhysicsFallbackNone)
+	assert.Len(t, props, 1)
+	assert.Len(t, byLeaf[4], 1)
+	assert.Len(t, byLeaf[5], 1)
+	assert.Same(t, byLeaf[4][0], byLeaf[5][0])
+	assert.Empty(t, byLeaf[6]) // not solid
+
+	_, err = parseStaticPropLump(buf.Bytes()[:buf.Len()-10], 11)
+	assert.Error(t, err)
+
+	_, err = parseStaticPropLump(buf.Bytes(), 3)
+	assert.Error(t, err)
+}
+
+func TestNewPropCollision_PhysicsFallback(t *testing.T) {
+	t.Parallel()
+
+	// two parallel walls at x = 0 and x = 5
+	mdlWithoutPhy := &model{
+		hullMin:    mgl32.Vec3{-10, -10, 0},
+		hullMax:    mgl32.Vec3{10, 10, 20},
+		renderMesh: [][3]mgl32.Vec3{{{0, -10, 0}, {0, 10, 0}, {0, 0, 20}}, {{5, -10, 0}, {5, 10, 0}, {5, 0, 20}}},
+	}
+
+	origin := mgl32.Vec3{100, 0, 0}
+	ti := newTraceInfo(mgl32.Vec3{0, 0, 10}, mgl32.Vec3{200, 0, 10}, mgl32.Vec3{}, mgl32.Vec3{}, MaskShotHull)
+	between := newTraceInfo(mgl32.Vec3{102.5, -100, 10}, mgl32.Vec3{102.5, 100, 10}, mgl32.Vec3{}, mgl32.Vec3{}, MaskShotHull)
+
+	p := newPropCollision(SolidVPhysics, mdlWithoutPhy, origin, mgl32.Vec3{}, 1, PhysicsFallbackNone)
+	assert.True(t, p.fallback)
+	assert.False(t, p.rayCast(ti).Hit)
+
+	p = newPropCollision(SolidVPhysics, mdlWithoutPhy, origin, mgl32.Vec3{}, 1, PhysicsFallbackRenderMesh)
+	assert.True(t, p.fallback)
+	assert.True(t, p.touches(ti))
+	assert.InDelta(t, 0.5, p.rayCast(ti).T, 0.0001)
+	assert.False(t, p.rayCast(between).Hit)
+
+	// the convex hull of the render mesh fills the space between the walls
+	p = newPropCollision(SolidVPhysics, mdlWithoutPhy, origin, mgl32.Vec3{}, 2, PhysicsFallbackHull)
+	assert.True(t, p.fallback)
+	assert.Equal(t, SolidVPhysics, p.effectiveSolid())
+	assert.Len(t, p.hulls, 1)
+	assert.InDelta(t, 0.5, p.rayCast(ti).T, 0.0001)
+	assert.True(t, p.rayCast(between).Hit)
+
+	// a flat render mesh has no volume, the hull box of the model is used instead
+	flat := &model{hullMin: mdlWithoutPhy.hullMin, hullMax: mdlWithoutPhy.hullMax, renderMesh: mdlWithoutPhy.renderMesh[:1]}
+
+	p = newPropCollision(SolidVPhysics, flat, origin, mgl32.Vec3{}, 2, PhysicsFallbackHull)
+	assert.True(t, p.fallback)
+	assert.Equal(t, SolidOBB, p.effectiveSolid())
+	assert.InDelta(t, 0.4, p.rayCast(ti).T, 0.0001)
+
+	p = newPropCollision(SolidBBox, mdlWithoutPhy, origin, mgl32.Vec3{}, 1, PhysicsFallbackNone)
+	assert.False(t, p.fallback)
+}
+
+func TestLoadDynamicProps(t *testing.T) {
+	t.Parallel()
+
+	door := &model{hullMin: mgl32.Vec3{-2, -24, 0}, hullMax: mgl32.Vec3{2, 24, 96}}
+	entities := []Entity{
+		{Index: 0, KeyValues: []KeyValue{{"classname", "worldspawn"}}},
+		{Index: 1, KeyValues: []KeyValue{{"classname", "prop_door_rotating"}, {"model", "models/door.mdl"}, {"solid", "2"}}},
+		{Index: 2, KeyValues: []KeyValue{{"classname", "prop_dynamic"}, {"model", "models/door.mdl"}, {"StartDisabled", "1"}}},
+		{Index: 3, KeyValues: []KeyValue{{"classname", "prop_physics_multiplayer"}, {"model", "models/missing.mdl"}, {"solid", "0"}}},
+		{Index: 4, KeyValues: []KeyValue{{"classname", "prop_dynamic_override"}}},
+	}
+
+	props := loadDynamicProps(NewFSSource(fstest.MapFS{}), entities, map[string]*model{"models/door.mdl": door}, PhysicsFallbackNone)
+
+	if !assert.Len(t, props, 3) {
+		return
+	}
+
+	assert.Equal(t, int32(1), props[0].Entity)
+	assert.True(t, props[0].Enabled)
+	assert.False(t, props[0].ModelMissing)
+	assert.Same(t, door, props[0].model)
+
+	assert.False(t, props[1].Enabled, "StartDisabled")
+	assert.False(t, props[1].ModelMissing)
+
+	assert.False(t, props[2].Enabled, "not solid")
+	assert.True(t, props[2].ModelMissing)
+}
+
+func TestMap_TraceRay_RotatedProps(t *testing.T) {
+	t.Parallel()
+
+	angles := mgl32.Vec3{30, 60, 0}
+	forward := mgl32.Vec3{0.4330127, 0.75, -0.5}
+	assert.True(t, forward.ApproxEqualThreshold(angleMatrix(angles).Col(0), 1e-6))
+
+	// a pyramid pointing backwards, its base at x = 100 faces forward
+	pyramid := [][3]mgl32.Vec3{
+		{{0, 0, 0}, {100, -5, -5}, {100, 5, -5}},
+		{{0, 0, 0}, {100, 5, -5}, {100, 5, 5}},
+		{{0, 0, 0}, {100, 5, 5}, {100, -5, 5}},
+		{{0, 0, 0}, {100, -5, 5}, {100, -5, -5}},
+		{{100, -5, -5}, {100, 5, 5}, {100, 5, -5}},
+		{{100, -5, -5}, {100, -5, 5}, {100, 5, 5}},
+	}
+	withPhy := &model{hullMin: mgl32.Vec3{0, -5, -5}, hullMax: mgl32.Vec3{100, 5, 5}, phySolids: [][][3]mgl32.Vec3{pyramid}}
+	withoutPhy := &model{hullMin: mgl32.Vec3{0, -5, -5}, hullMax: mgl32.Vec3{100, 5, 5}, renderMesh: pyramid}
+
+	origin := mgl32.Vec3{10, 20, 30}
+	start := origin.Add(forward.Mul(200))
+
+	for _, tc := range []struct {
+		name     string
+		solid    int
+		mdl      *model
+		fallback PhysicsFallback
+	}{
+		{"physics model", SolidVPhysics, withPhy, PhysicsFallbackNone},
+		{"obb", SolidOBB, withPhy, PhysicsFallbackNone},
+		{"render mesh", SolidVPhysics, withoutPhy, PhysicsFallbackRenderMesh},
+	} {
+		m := boxesMap(nil)
+		m.staticPropLump = staticPropLump{
+			names:  []string{"models/pyramid.mdl"},
+			leaves: []uint16{0, 1, 2, 3, 4},
+			props: []staticPropEntry{
+				{StaticProp: StaticProp{Model: "models/pyramid.mdl", Origin: origin, Angles: angles, UniformScale: 1, Solid: tc.solid}, leafCount: 5},
+			},
+		}
+		m.staticProps, m.staticPropsByLeaf = loadStaticProps(m.staticPropLump, []*model{tc.mdl}, tc.fallback)
+
+		tr := m.TraceRay(start, origin)
+		assert.Equal(t, HitStaticProp, tr.HitKind, tc.name)
+		assert.InDelta(t, 0.5, tr.Fraction, 1e-4, tc.name)
+		assert.True(t, forward.ApproxEqualThreshold(tr.Plane.Normal, 1e-4), "%s: %v", tc.name, tr.Plane.Normal)
+	}
+
+	m := boxesMap(nil)
+	m.dynamicProps = []dynamicProp{{
+		DynamicProp: DynamicProp{Entity: 1, ClassName: "prop_dynamic", Model: "models/pyramid.mdl", Origin: origin, Angles: angles, Scale: 1, Solid: SolidVPhysics, Enabled: true},
+		model:       withPhy,
+	}}
+	m.dynamicProps[0].updateTransform()
+
+	tr := m.TraceRay(start, origin)
+	assert.Equal(t, HitDynamicProp, tr.HitKind)
+	assert.InDelta(t, 0.5, tr.Fraction, 1e-4)
+}
+
+// boxesMap returns a map with axis-aligned solid boxes, every box is in the leaves it touches.
+// The tree has axis-aligned and diagonal planes and leaves on both sides of nodes.
+func boxesMap(boxes [][2]mgl32.Vec3) Map {
+	m := Map{
+		leaves: make([]leaf.Leaf, 5),
+		nodes: []node.Node{
+			{PlaneNum: 0, Children: [2]int32{2, 1}},
+			{PlaneNum: 1, Children: [2]int32{-1, -2}},
+			{PlaneNum: 2, Children: [2]int32{3, -3}},
+			{PlaneNum: 3, Children: [2]int32{-4, -5}},
+		},
+		planes: []plane.Plane{
+			{Normal: mgl32.Vec3{1, 0, 0}, Distance: 0, AxisType: 0},
+			{Normal: mgl32.Vec3{0, 1, 0}, Distance: 10, AxisType: 1},
+			{Normal: mgl32.Vec3{1, 1, 0}.Normalize(), Distance: 20, AxisType: 3},
+			{Normal: mgl32.Vec3{0, 0, 1}, Distance: -5, AxisType: 2},
+		},
+	}
+
+	leafBoxes := make([][]uint16, len(m.leaves))
+
+	var insert func(nodeIndex int32, box [2]mgl32.Vec3, index uint16)
+
+	insert = func(nodeIndex int32, box [2]mgl32.Vec3, index uint16) {
+		if nodeIndex < 0 {
+			leafBoxes[-nodeIndex-1] = append(leafBoxes[-nodeIndex-1], index)
+
+			return
+		}
+
+		p := m.planes[m.nodes[nodeIndex].PlaneNum]
+		center := box[0].Add(box[1]).Mul(0.5)
+		dist := center.Dot(p.Normal) - p.Distance
+		radius := dotAbs(box[1].Sub(center), p.Normal)
+
+		if dist+radius >= 0 {
+			insert(m.nodes[nodeIndex].Children[0], box, index)
+		}
+
+		if dist-radius < 0 {
+			insert(m.nodes[nodeIndex].Children[1], box, index)
+		}
+	}
+
+	for i, b := range boxes {
+		m.brushes = append(m.brushes, brush.Brush{FirstSide: int32(len(m.brushSides)), NumSides: 6, Contents: bsp.CONTENTS_SOLID})
+
+		for axis := 0; axis < 3; axis++ {
+			var normal mgl32.Vec3
+
+			normal[axis] = 1
+
+			m.planes = append(m.planes,
+				plane.Plane{Normal: normal, Distance: b[1][axis], AxisType: int32(axis)},
+				plane.Plane{Normal: normal.Mul(-1), Distance: -b[0][axis], AxisType: int32(axis)})
+			m.brushSides = append(m.brushSides,
+				brushside.BrushSide{PlaneNum: uint16(len(m.planes) - 2), TexInfo: -1},
+				brushside.BrushSide{PlaneNum: uint16(len(m.planes) - 1), TexInfo: -1})
+		}
+
+		insert(0, b, uint16(i))
+	}
+
+	for i, indices := range leafBoxes {
+		m.leaves[i].FirstLeafBrush = uint16(len(m.leafBrushes))
+		m.leaves[i].NumLeafBrushes = uint16(len(indices))
+		m.leafBrushes = append(m.leafBrushes, indices...)
+	}
+
+	m.nodePlanes = newNodePlanes(m.nodes, m.planes)
+
+	return m
+}
+
+func TestMap_TraceBatch_Packets(t *testing.T) {
+	t.Parallel()
+
+	m := boxesMap([][2]mgl32.Vec3{
+		{{-50, -50, -50}, {-30, 60, 0}},
+		{{10, 5, -20}, {40, 15, 80}},
+		{{-5, -40, 30}, {25, -10, 40}},
+		{{30, 30, -60}, {60, 40, -10}},
+		{{-100, 20, 20}, {-60, 25, 100}},
+		{{50, -90, -90}, {55, -60, 90}},
+	})
+
+	r := rand.New(rand.NewSource(1))
+
+	random := func() mgl32.Vec3 {
+		return mgl32.Vec3{r.Float32()*240 - 120, r.Float32()*240 - 120, r.Float32()*240 - 120}
+	}
+
+	var rays []Ray
+
+	for i := 0; i < 20; i++ {
+		// coherent rays from one origin, some origins are inside of boxes
+		origin := random()
+
+		for j := 0; j < 50; j++ {
+			rays = append(rays, Ray{Origin: origin, Destination: random()})
+		}
+
+		rays = append(rays, Ray{Origin: origin, Destination: random(), Mins: mgl32.Vec3{-1, -2, 0}, Maxs: mgl32.Vec3{1, 2, 3}})
+	}
+
+	for _, workers := range []int{1, 3} {
+		traces := m.TraceBatch(rays, BatchOptions{Workers: workers, Packets: true})
+
+		for i, ray := range rays {
+			assert.Equal(t, *m.TraceHull(ray.Origin, ray.Destination, ray.Mins, ray.Maxs), traces[i], "ray %d", i)
+		}
+	}
+}
+
+func TestMap_ParallelTraces(t *testing.T) {
+	t.Parallel()
+
+	m := boxesMap([][2]mgl32.Vec3{{{-10, -10, -10}, {10, 10, 10}}})
+
+	for _, packets := range []bool{false, true} {
+		for _, workers := range []int{0, 1, 3, 100} {
+			for _, n := range []int{0, 1, PacketSize + 1, 1000} {
+				visits := make([]int32, n)
+
+				m.parallelTraces(n, BatchOptions{Workers: workers, Packets: packets}, func(ti *traceInfo, i int) {
+					ti.init(mgl32.Vec3{-100, float32(i), 0}, mgl32.Vec3{100, float32(i), 0}, mgl32.Vec3{}, mgl32.Vec3{}, MaskShotHull)
+				}, func(i int, out *Trace) {
+					assert.Equal(t, i <= 10, out.Fraction < 1, "index %d", i)
+
+					visits[i]++ // every index is only traced by one worker
+				})
+
+				for i, v := range visits {
+					assert.Equal(t, int32(1), v, "index %d, n %d, workers %d, packets %v", i, n, workers, packets)
+				}
+			}
+		}
+	}
+}
+
+func TestPairIndex(t *testing.T) {
+	t.Parallel()
+
+	const n = 5
+
+	k := 0
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			gotI, gotJ := pairIndex(n, k)
+			assert.Equal(t, [2]int{i, j}, [2]int{gotI, gotJ}, "pair %d", k)
+
+			k++
+		}
+	}
+
+	assert.Equal(t, n*(n-1)/2, k)
+}
+
+func TestMap_WriteTo_ReadMap(t *testing.T) {
+	t.Parallel()
+
+	m := boxesMap([][2]mgl32.Vec3{
+		{{-50, -50, -50}, {-30, 60, 0}},
+		{{10, 5, -20}, {40, 15, 80}},
+	})
+
+	// a tetrahedron, in model space
+	crate := &model{
+		surfaceProp: "wood_crate",
+		hullMin:     mgl32.Vec3{0, 0, 0},
+		hullMax:     mgl32.Vec3{20, 20, 20},
+		phySolids: [][][3]mgl32.Vec3{{
+			{{0, 0, 0}, {20, 0, 0}, {0, 20, 0}},
+			{{0, 0, 0}, {0, 20, 0}, {0, 0, 20}},
+			{{0, 0, 0}, {0, 0, 20}, {20, 0, 0}},
+			{{20, 0, 0}, {0, 20, 0}, {0, 0, 20}},
+		}},
+	}
+
+	m.entities = []Entity{
+		{Index: 0, KeyValues: []KeyValue{{"classname", "worldspawn"}}},
+		{Index: 1, KeyValues: []KeyValue{{"classname", "prop_dynamic"}, {"model", "models/crate.mdl"}, {"OnUser1", "a,b,,0,-1"}, {"OnUser1", "c,d,,0,-1"}}},
+	}
+	m.surfaces = []face.Face{{TexInfo: 0, DispInfo: 0}, {TexInfo: 0, DispInfo: -1}}
+	// face 1 is the floor of leaf 3 (z = -5), leaf 4 below it is solid
+	m.polygons = []polygon{{}, {
+		verts:    [maxSurfinfoVerts]mgl32.Vec3{{0, 30, -5}, {0, 120, -5}, {120, 120, -5}, {120, 30, -5}},
+		numVerts: 4,
+		plane:    vplane{origin: mgl32.Vec3{0, 0, 1}, distance: -5},
+	}}
+	m.leafFaces = []uint16{1}
+	m.leaves[3].NumLeafFaces = 1
+	m.leaves[4].Contents = bsp.CONTENTS_SOLID
+	m.texInfos = []texinfo.TexInfo{{TexData: 0}}
+	m.texDataNames = []string{"CONCRETE/WALL"}
+	m.texDataSurfaceProps = []string{"concrete"}
+	m.surfaceProps = map[string]SurfaceProperties{"concrete": defaultSurfaceProperties}
+	m.pvs = clusterSets{{0b11}, {0b11}}
+	m.areaPortals = []AreaPortal{{Key: 1, Areas: [2]int16{1, 2}, Door: "door", StartOpen: true}}
+	m.volumes = []brushEntity{{BrushEntity: BrushEntity{Entity: 1, Model: 1, ClassName: "func_buyzone", Angles: mgl32.Vec3{0, 30, 0}}}}
+	m.volumes[0].updateTransform(mgl32.Vec3{-50, -50, -50}, mgl32.Vec3{-30, 60, 0})
+	m.staticPropLump = staticPropLump{
+		names:  []string{"models/crate.mdl"},
+		leaves: []uint16{0, 1, 2, 3, 4},
+		props: []staticPropEntry{
+			{StaticProp: StaticProp{Model: "models/crate.mdl", Origin: mgl32.Vec3{-80, -80, 0}, UniformScale: 1, Solid: SolidVPhysics}, leafCount: 5},
+			{StaticProp: StaticProp{Index: 1, Model: "models/crate.mdl", Origin: mgl32.Vec3{80, 80, 0}, Angles: mgl32.Vec3{0, 45, 0}, UniformScale: 2, Solid: SolidOBB}, leafCount: 5},
+		},
+	}
+	m.staticProps, m.staticPropsByLeaf = loadStaticProps(m.staticPropLump, []*model{crate}, PhysicsFallbackNone)
+	m.dynamicProps = []dynamicProp{{
+		DynamicProp: DynamicProp{Entity: 1, ClassName: "prop_dynamic", Model: "models/crate.mdl", Origin: mgl32.Vec3{0, -80, 0}, Scale: 1, Solid: SolidVPhysics, Enabled: true},
+		model:       crate,
+	}}
+	m.dynamicProps[0].updateTransform()
+	m.displacements = []displacement{{
+		triangles: [][3]mgl32.Vec3{{{-100, -100, -90}, {100, -100, -90}, {100, 100, -90}}, {{-100, -100, -90}, {100, 100, -90}, {-100, 100, -90}}},
+		tags:      []uint16{DispTriTagSurface, DispTriTagSurface},
+		contents:  bsp.CONTENTS_SOLID,
+		min:       mgl32.Vec3{-100, -100, -90},
+		max:       mgl32.Vec3{100, 100, -90},
+	}}
+	m.displacements[0].tree = collision.NewTriangleBVH(m.displacements[0].triangles)
+	m.displacementsByLeaf = displacementsByLeaf(m.nodes, m.planes, m.displacements)
+
+	var buf bytes.Buffer
+
+	n, err := m.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	cached, err := ReadMap(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+
+	// everything that was written is read again
+	var rewritten bytes.Buffer
+
+	_, err = cached.WriteTo(&rewritten)
+	assert.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), rewritten.Bytes())
+
+	assert.Equal(t, m.StaticProps(), cached.StaticProps())
+	assert.Equal(t, m.DynamicProps(), cached.DynamicProps())
+	assert.Equal(t, m.entities, cached.entities)
+	assert.Equal(t, m.surfaceProps, cached.surfaceProps)
+	assert.Equal(t, m.areaPortals, cached.areaPortals)
+	assert.Equal(t, m.Volumes("*"), cached.Volumes("*"))
+
+	// BVHs and per-leaf lookups are read instead of rebuilt
+	assert.Equal(t, m.staticProps, cached.staticProps)
+	assert.Equal(t, m.displacements, cached.displacements)
+	assert.Equal(t, m.dynamicProps, cached.dynamicProps)
+	assert.Equal(t, m.staticPropsByLeaf, cached.staticPropsByLeaf)
+	assert.Equal(t, m.displacementsByLeaf, cached.displacementsByLeaf)
+
+	// files and readers of unknown size
+	path := filepath.Join(t.TempDir(), "map.cache")
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	for _, src := range []io.Reader{f, io.MultiReader(bytes.NewReader(buf.Bytes()))} {
+		fromReader, err := ReadMap(src)
+		assert.NoError(t, err)
+		assert.Equal(t, cached, fromReader)
+	}
+
+	r := rand.New(rand.NewSource(1))
+
+	random := func() mgl32.Vec3 {
+		return mgl32.Vec3{r.Float32()*240 - 120, r.Float32()*240 - 120, r.Float32()*240 - 120}
+	}
+
+	rays := make([]Ray, 500)
+	hits := make(map[HitKind]int)
+
+	for i := range rays {
+		rays[i] = Ray{Origin: random(), Destination: random()}
+	}
+
+	expected := m.TraceBatch(rays, BatchOptions{})
+
+	for _, tr := range expected {
+		hits[tr.HitKind]++
+	}
+
+	assert.Equal(t, expected, cached.TraceBatch(rays, BatchOptions{}))
+
+	// BVHs and mailboxes don't change the results
+	for i, r := range rays {
+		assert.Equal(t, expected[i], *m.TraceRayBruteForce(r.Origin, r.Destination))
+
+		mins, maxs := mgl32.Vec3{-3, -3, -3}, mgl32.Vec3{3, 3, 5}
+		assert.Equal(t, m.TraceHull(r.Origin, r.Destination, mins, maxs), m.TraceHullBruteForce(r.Origin, r.Destination, mins, maxs))
+	}
+
+	for _, kind := range []HitKind{HitBrush, HitFace, HitStaticProp, HitDynamicProp, HitDisplacement} {
+		assert.NotZero(t, hits[kind], "no rays hit %v", kind)
+	}
+
+	// dynamic props can still be moved
+	cached.SetDynamicPropTransform(0, mgl32.Vec3{0, 80, 0}, mgl32.Vec3{}, 1)
+	assert.Equal(t, HitDynamicProp, cached.TraceRay(mgl32.Vec3{5, 110, 5}, mgl32.Vec3{5, 50, 5}).HitKind)
+}
+
+func TestReadMap_Invalid(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	_, err := boxesMap(nil).WriteTo(&buf)
+	assert.NoError(t, err)
+
+	_, err = ReadMap(bytes.NewReader([]byte("not a cache")))
+	assert.Error(t, err)
+
+	data := buf.Bytes()
+
+	for i := 0; i < len(data); i++ {
+		_, err = ReadMap(bytes.NewReader(data[:i]))
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+
+	wrongVersion := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(wrongVersion[len(mapCacheMagic):], mapCacheVersion+1)
+
+	_, err = ReadMap(bytes.NewReader(wrongVersion))
+	assert.ErrorContains(t, err, "unsupported version")
+}
+
+func readSource(t *testing.T, src ModelSource, path string) string {
+	t.Helper()
+
+	f, err := src.Open(path)
+	if !assert.NoError(t, err, path) {
+		return ""
+	}
+
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+
+	return string(b)
+}
+
+func TestModelSources(t *testing.T) {
+	t.Parallel()
+
+	fixtures := fstest.MapFS{
+		"models/props/crate.mdl":  {Data: []byte("fs crate")},
+		"models/props/barrel.mdl": {Data: []byte("fs barrel")},
+	}
+
+	var zipData bytes.Buffer
+
+	zw := zip.NewWriter(&zipData)
+
+	for name, data := range map[string]string{
+		"models/props/Crate.mdl": "zip crate",
+		"models/props/empty.mdl": "",
+	} {
+		w, err := zw.Create(name)
+		assert.NoError(t, err)
+
+		_, err = w.Write([]byte(data))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, zw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "materials"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "materials", "wall.vmt"), []byte("dir wall"), 0o600))
+
+	fsSrc, zipSrc, dirSrc := NewFSSource(fixtures), NewZipSource(zr), NewDirSource(dir)
+
+	assert.Equal(t, "fs crate", readSource(t, fsSrc, "models/props/crate.mdl"))
+	assert.Equal(t, "fs crate", readSource(t, fsSrc, `MODELS\props\Crate.mdl`))
+	assert.Equal(t, "zip crate", readSource(t, zipSrc, "models/props/crate.mdl"))
+	assert.Equal(t, "zip crate", readSource(t, zipSrc, `/models\PROPS/crate.mdl`))
+	assert.Equal(t, "dir wall", readSource(t, dirSrc, "materials/WALL.vmt"))
+
+	_, err = zipSrc.Open("models/props/empty.mdl")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fsSrc.Open("models/props/missing.mdl")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = dirSrc.Open("../outside.vmt")
+	assert.Error(t, err)
+
+	// the first source that has a file wins
+	sources := newVFS(zr, []ModelSource{fsSrc, dirSrc})
+
+	assert.Equal(t, "zip crate", readSource(t, sources, "models/props/crate.mdl"))
+	assert.Equal(t, "fs barrel", readSource(t, sources, "models/props/barrel.mdl"))
+	assert.Equal(t, "dir wall", readSource(t, sources, "materials/wall.vmt"))
+
+	_, err = sources.Open("models/props/missing.mdl")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = sources.Open("models/props/empty.mdl")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// only missing files fall through to the next source
+	assert.Equal(t, "fs crate", readSource(t, modelSources{failingSource{fs.ErrNotExist}, fsSrc}, "models/props/crate.mdl"))
+
+	_, err = modelSources{failingSource{fs.ErrPermission}, fsSrc}.Open("models/props/crate.mdl")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.NotErrorIs(t, err, fs.ErrNotExist)
+}
+
+// failingSource fails to open any file with err.
+type failingSource struct {
+	err error
+}
+
+func (s failingSource) Open(string) (io.ReadCloser, error) {
+	return nil, s.err
+}
+
+func TestLoadMapFromReader_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadMapFromReader(strings.NewReader("not a bsp"), NewFSSource(fstest.MapFS{}))
+	assert.Error(t, err)
+}
+
+func TestParseEntityLump(t *testing.T) {
+	t.Parallel()
+
+	entities, err := parseEntityLump(`{
+"world_maxs" "2048 2048 512"
+"classname" "worldspawn"
+"message" "{braces} and // no comment"
+}
+{
+"origin" "-12 1444 1751"
+"angle" "90"
+"classname" "info_player_Terrorist"
+}
+// comment
+{
+"model" "*12"
+"targetname" "bombsite_a"
+"classname" "func_bomb_target"
+"spawnflags" "3"
+"OnBombExplode" "relay` + "\x1b" + `Trigger` + "\x1b" + `a,b` + "\x1b" + `1.5` + "\x1b" + `1"
+"OnBombExplode" "sound,PlaySound,,0,-1"
+"texture" "C:\maps\"
+"angles" "0 -90 0"
+"message" "say \"hi\" or \"{bye}\""
+"quote" "\""
+}
+` + "\x00")
+	assert.NoError(t, err)
+	assert.Len(t, entities, 3)
+
+	world, spawn, bombsite := entities[0], entities[1], entities[2]
+
+	assert.Equal(t, int32(0), world.Index)
+	assert.Equal(t, "worldspawn", world.ClassName())
+	assert.Equal(t, "{braces} and // no comment", world.Get("message"))
+	assert.Empty(t, world.Get("missing"))
+
+	assert.Equal(t, int32(1), spawn.Index)
+	assert.Equal(t, mgl32.Vec3{-12, 1444, 1751}, spawn.Origin())
+	assert.Equal(t, mgl32.Vec3{0, 90, 0}, spawn.Angles())
+	assert.Empty(t, spawn.Connections())
+
+	assert.Equal(t, "*12", bombsite.Model())
+	assert.Equal(t, "bombsite_a", bombsite.TargetName())
+	assert.Equal(t, 3, bombsite.SpawnFlags())
+	assert.True(t, bombsite.HasSpawnFlags(2))
+	assert.False(t, bombsite.HasSpawnFlags(4))
+	assert.Equal(t, `C:\maps\`, bombsite.Get("Texture"))
+	assert.Equal(t, `say "hi" or "{bye}"`, bombsite.Get("message"))
+	assert.Equal(t, `"`, bombsite.Get("quote"))
+	assert.Equal(t, mgl32.Vec3{0, -90, 0}, bombsite.Angles())
+	assert.Len(t, bombsite.GetAll("onbombexplode"), 2)
+	assert.Equal(t, []Connection{
+		{Output: "OnBombExplode", Target: "relay", Input: "Trigger", Parameter: "a,b", Delay: 1.5, TimesToFire: 1},
+		{Output: "OnBombExplode", Target: "sound", Input: "PlaySound", TimesToFire: -1},
+	}, bombsite.Connections())
+
+	m := Map{entities: entities}
+
+	assert.Equal(t, entities, m.Entities())
+	assert.Equal(t, []Entity{spawn}, m.FindByClassname("INFO_PLAYER_TERRORIST"))
+	assert.Equal(t, []Entity{spawn}, m.FindByClassname("info_player_*"))
+	assert.Equal(t, []Entity{bombsite}, m.FindByTargetname("bombsite_*"))
+	assert.Equal(t, entities, m.FindByClassname("*"))
+	assert.Empty(t, m.FindByTargetname("bombsite_b"))
+}
+
+func TestEntity_Angles(t *testing.T) {
+	t.Parallel()
+
+	ent := func(kvs ...KeyValue) Entity {
+		return Entity{KeyValues: kvs}
+	}
+
+	assert.Equal(t, mgl32.Vec3{}, ent().Angles())
+	assert.Equal(t, mgl32.Vec3{-90, 0, 0}, ent(KeyValue{"angle", "-1"}).Angles())
+	assert.Equal(t, mgl32.Vec3{90, 0, 0}, ent(KeyValue{"angle", "-2"}).Angles())
+	assert.Equal(t, mgl32.Vec3{10, 20, 30}, ent(KeyValue{"angle", "45"}, KeyValue{"angles", "10 20 30"}).Angles())
+}
+
+func TestParseEntityLump_Errors(t *testing.T) {
+	t.Parallel()
+
+	for _, data := range []string{
+		`"classname" "worldspawn"`,
+		`{ "classname" "worldspawn"`,
+		`{ "classname" }`,
+		`{ "classname" "worldspawn }`,
+		`{ { "classname" "worldspawn" } }`,
+		`{ "classname" "worldspawn" } }`,
+	} {
+		_, err := parseEntityLump(data)
+		assert.Error(t, err, data)
+	}
+
+	// malformed entities are skipped
+	entities, err := parseEntityLump(`{ "classname" "worldspawn" }
+{ "classname" }
+{ "targetname" "door" { "classname" "info_target" }
+"stray" { "classname" "light" }
+{ "classname" "func_brush" "model" { "classname" "prop_static" }
+{ "classname" "info_player_start" "origin" "0 0 0 }`)
+	assert.EqualError(t, err, `entity 1: key "classname" without value`)
+
+	var classNames []string
+
+	for i, ent := range entities {
+		assert.Equal(t, int32(i), ent.Index)
+
+		classNames = append(classNames, ent.ClassName())
+	}
+
+	assert.Equal(t, []string{"worldspawn", "info_target", "light", "prop_static"}, classNames)
+
+	entities, err = parseEntityLump("")
+	assert.NoError(t, err)
+	assert.Empty(t, entities)
+}
+
+func TestMap_Volumes(t *testing.T) {
+	t.Parallel()
+
+	// the boxes are in the local space of the model, which uses the tree of boxesMap
+	lo, hi := mgl32.Vec3{-10, -20, 0}, mgl32.Vec3{30, 20, 10}
+	m := boxesMap([][2]mgl32.Vec3{{lo, hi}})
+
+	bombsite := brushEntity{
+		BrushEntity: BrushEntity{Entity: 3, Model: 1, ClassName: "func_bomb_target", TargetName: "bombsite_a", Origin: mgl32.Vec3{1000, 0, 0}, Angles: mgl32.Vec3{0, 90, 0}, Enabled: true},
+		headNode:    0,
+	}
+	bombsite.updateTransform(lo, hi)
+
+	buyzone := brushEntity{
+		BrushEntity: BrushEntity{Entity: 4, Model: 1, ClassName: "func_buyzone", Origin: mgl32.Vec3{0, 500, 0}, Enabled: true},
+		headNode:    0,
+	}
+	buyzone.updateTransform(lo, hi)
+
+	m.volumes = []brushEntity{bombsite, buyzone}
+
+	volumes := m.Volumes("func_bomb_target")
+	assert.Len(t, volumes, 1)
+	assert.Equal(t, bombsite.BrushEntity, volumes[0].BrushEntity)
+	assert.InDelta(t, 1000-20, volumes[0].Min.X(), 1e-3)
+	assert.InDelta(t, -10, volumes[0].Min.Y(), 1e-3)
+	assert.InDelta(t, 1000+20, volumes[0].Max.X(), 1e-3)
+	assert.InDelta(t, 30, volumes[0].Max.Y(), 1e-3)
+	assert.Len(t, m.Volumes("func_*"), 2)
+	assert.Empty(t, m.Volumes("trigger_*"))
+
+	// rotated by 90° yaw: local x is world y
+	assert.True(t, m.PointInVolume(mgl32.Vec3{1000, 25, 5}, "func_bomb_target"))
+	assert.True(t, m.PointInVolume(mgl32.Vec3{1015, -5, 1}, "FUNC_BOMB_TARGET"))
+	assert.False(t, m.PointInVolume(mgl32.Vec3{1025, 0, 5}, "func_bomb_target"))
+	assert.False(t, m.PointInVolume(mgl32.Vec3{1000, 25, 11}, "func_bomb_target"))
+	assert.False(t, m.PointInVolume(mgl32.Vec3{1000, 25, 5}, "func_buyzone"))
+
+	assert.True(t, m.PointInVolume(mgl32.Vec3{25, 485, 5}, "func_buyzone"))
+	assert.False(t, m.PointInVolume(mgl32.Vec3{35, 485, 5}, "func_buyzone"))
+
+	assert.Equal(t, []Volume{volumes[0]}, m.VolumesAt(mgl32.Vec3{1000, 25, 5}, "*"))
+	assert.Empty(t, m.VolumesAt(mgl32.Vec3{0, 0, 5}, "*"))
+}
+
+// testLump is the content of a lump of testBsp.
+type testLump struct {
+	id   bsp.LumpId
+	lump lumps.ILump
+	data any // written in the binary format of the lump
+}
+
+// testBsp returns a BSP file that only contains the given lumps.
+func testBsp(t *testing.T, testLumps ...testLump) *bsp.Bsp {
+	t.Helper()
+
+	bspfile := new(bsp.Bsp)
+
+	for _, l := range testLumps {
+		var buf bytes.Buffer
+
+		assert.NoError(t, binary.Write(&buf, binary.LittleEndian, l.data))
+
+		raw := bspfile.RawLump(l.id)
+		raw.SetContents(l.lump)
+		raw.SetRawContents(buf.Bytes())
+	}
+
+	return bspfile
+}
+
+// dispBsp returns a BSP file with a single power 1 (3x3 vertices) displacement on the 100x100 face at z = 0.
+// The center vertex is raised by 50 units and the last triangle is removed.
+func dispBsp(t *testing.T, minTess int32) *bsp.Bsp {
+	t.Helper()
+
+	dispVerts := make([]dispvert.DispVert, 9)
+	for i := range dispVerts {
+		dispVerts[i].Vec = mgl32.Vec3{0, 0, 1}
+	}
+
+	dispVerts[4].Dist = 50
+
+	dispTris := make([]disptris.DispTri, 8)
+	for i := range dispTris {
+		dispTris[i].Tags = DispTriTagSurface
+	}
+
+	dispTris[7].Tags |= DispTriTagRemove
+
+	return testBsp(t,
+		testLump{bsp.LumpFaces, &lumps.Face{}, []face.Face{{FirstEdge: 0, NumEdges: 4, TexInfo: -1}}},
+		// clockwise when seen from above, like faces with an upwards normal
+		testLump{bsp.LumpVertexes, &lumps.Vertex{}, []mgl32.Vec3{{0, 0, 0}, {0, 100, 0}, {100, 100, 0}, {100, 0, 0}}},
+		testLump{bsp.LumpEdges, &lumps.Edge{}, [][2]uint16{{0, 0}, {0, 1}, {1, 2}, {2, 3}, {3, 0}}},
+		testLump{bsp.LumpSurfEdges, &lumps.Surfedge{}, []int32{1, 2, 3, 4}},
+		testLump{bsp.LumpDispInfo, &lumps.DispInfo{}, []dispinfo.DispInfo{{Power: 1, MinTess: minTess, Contents: bsp.CONTENTS_SOLID}}},
+		testLump{bsp.LumpDispVerts, &lumps.DispVert{}, dispVerts},
+		testLump{bsp.LumpDispTris, &lumps.DispTris{}, dispTris},
+	)
+}
+
+func TestBuildDisplacements(t *testing.T) {
+	t.Parallel()
+
+	disps := buildDisplacements(dispBsp(t, 0))
+	assert.Len(t, disps, 1)
+
+	// vertices are in rows from the start position along the first edge of the face
+	v := func(i int) mgl32.Vec3 {
+		if i == 4 {
+			return mgl32.Vec3{50, 50, 50}
+		}
+
+		return mgl32.Vec3{float32(i%3) * 50, float32(i/3) * 50, 0}
+	}
+
+	// the diagonal of the quads alternates, see CCoreDispInfo::GetTriIndices
+	expected := [][3]mgl32.Vec3{
+		{v(0), v(3), v(4)}, {v(0), v(4), v(1)},
+		{v(1), v(4), v(2)}, {v(2), v(4), v(5)},
+		{v(3), v(6), v(4)}, {v(4), v(6), v(7)},
+		{v(4), v(7), v(8)}, // the last triangle is removed
+	}
+
+	d := disps[0]
+	assert.Equal(t, expected, d.triangles)
+	assert.Equal(t, []uint16{1, 1, 1, 1, 1, 1, 1}, d.tags)
+	assert.Equal(t, mgl32.Vec3{0, 0, 0}, d.min)
+	assert.Equal(t, mgl32.Vec3{100, 100, 50}, d.max)
+	assert.Zero(t, d.flags)
+
+	// same winding as the base face, clockwise seen from the front
+	for i, tri := range d.triangles {
+		assert.Greater(t, tri[2].Sub(tri[0]).Cross(tri[1].Sub(tri[0])).Z(), float32(0), "triangle %d", i)
+	}
+}
+
+func TestMap_TraceRay_Displacement(t *testing.T) {
+	t.Parallel()
+
+	load := func(minTess int32) Map {
+		bspfile := dispBsp(t, minTess)
+
+		m := boxesMap(nil)
+		m.surfaces = bspfile.Lump(bsp.LumpFaces).(*lumps.Face).GetData()
+		m.displacements = buildDisplacements(bspfile)
+		m.displacementsByLeaf = displacementsByLeaf(m.nodes, m.planes, m.displacements)
+
+		return m
+	}
+
+	m := load(0)
+
+	// the triangle from (0, 0, 0) over (50, 50, 50) to (50, 0, 0) is the plane z = y
+	tr := m.TraceRay(mgl32.Vec3{30, 20, 100}, mgl32.Vec3{30, 20, -100})
+	assert.Equal(t, HitDisplacement, tr.HitKind)
+	assert.InDelta(t, 0.4, tr.Fraction, 1e-5)
+	assert.True(t, tr.EndPos.ApproxEqualThreshold(mgl32.Vec3{30, 20, 20}, 1e-3), "%v", tr.EndPos)
+	assert.True(t, tr.Plane.Normal.ApproxEqualThreshold(mgl32.Vec3{0, -1, 1}.Normalize(), 1e-5), "%v", tr.Plane.Normal)
+	assert.InDelta(t, 0, tr.Plane.Distance, 1e-3)
+	assert.Equal(t, int32(bsp.CONTENTS_SOLID), tr.Contents)
+	assert.Equal(t, int32(0), tr.Face)
+	assert.Equal(t, uint16(DispTriTagSurface), tr.DispFlags)
+
+	// from below
+	tr = m.TraceRay(mgl32.Vec3{30, 20, -100}, mgl32.Vec3{30, 20, 100})
+	assert.InDelta(t, 0.6, tr.Fraction, 1e-5)
+	assert.True(t, tr.Plane.Normal.ApproxEqualThreshold(mgl32.Vec3{0, 1, -1}.Normalize(), 1e-5), "%v", tr.Plane.Normal)
+
+	// the removed triangle
+	assert.True(t, m.IsVisible(mgl32.Vec3{90, 80, 100}, mgl32.Vec3{90, 80, -100}))
+
+	// DISPINFO_FLAG_NO_RAY_COLL, boxes still collide
+	m = load(math.MinInt32 | dispInfoFlagNoRay)
+	assert.Equal(t, uint32(dispInfoFlagMagic|dispInfoFlagNoRay), m.displacements[0].flags)
+	assert.True(t, m.IsVisible(mgl32.Vec3{30, 20, 100}, mgl32.Vec3{30, 20, -100}))
+	assert.Equal(t, HitDisplacement, m.TraceHull(mgl32.Vec3{30, 20, 100}, mgl32.Vec3{30, 20, -100}, mgl32.Vec3{-1, -1, -1}, mgl32.Vec3{1, 1, 1}).HitKind)
+}
+
+// faceMap returns a map that is solid behind a face at x = 50 and water behind a face at x = -50.
+// Face 0 has no polygon and there are no brushes, so traces only hit the faces.
+func faceMap(t *testing.T) Map {
+	t.Helper()
+
+	planes := []plane.Plane{
+		{Normal: mgl32.Vec3{1, 0, 0}, Distance: 50, AxisType: 0},
+		{Normal: mgl32.Vec3{1, 0, 0}, Distance: -50, AxisType: 0},
+	}
+
+	var (
+		vertices  []mgl32.Vec3
+		edges     = [][2]uint16{{0, 0}}
+		surfEdges []int32
+	)
+
+	// quad returns the first edge of a 100x100 quad at x
+	quad := func(x float32) int32 {
+		first := int32(len(surfEdges))
+		base := uint16(len(vertices))
+
+		vertices = append(vertices, mgl32.Vec3{x, -50, -50}, mgl32.Vec3{x, -50, 50}, mgl32.Vec3{x, 50, 50}, mgl32.Vec3{x, 50, -50})
+
+		for i := uint16(0); i < 4; i++ {
+			edges = append(edges, [2]uint16{base + i, base + (i+1)%4})
+			surfEdges = append(surfEdges, int32(len(edges)-1))
+		}
+
+		return first
+	}
+
+	faces := []face.Face{
+		{FirstEdge: quad(0), NumEdges: 4, TexInfo: 0, DispInfo: -1}, // texinfo 0 is skipped
+		{Planenum: 0, FirstEdge: quad(50), NumEdges: 4, TexInfo: 1, DispInfo: -1},
+		{Planenum: 1, FirstEdge: quad(-50), NumEdges: 4, TexInfo: 2, DispInfo: -1},
+	}
+
+	bspfile := testBsp(t,
+		testLump{bsp.LumpFaces, &lumps.Face{}, faces},
+		testLump{bsp.LumpPlanes, &lumps.Planes{}, planes},
+		testLump{bsp.LumpVertexes, &lumps.Vertex{}, vertices},
+		testLump{bsp.LumpEdges, &lumps.Edge{}, edges},
+		testLump{bsp.LumpSurfEdges, &lumps.Surfedge{}, surfEdges},
+	)
+
+	m := Map{
+		nodes: []node.Node{
+			{PlaneNum: 0, Children: [2]int32{-2, 1}},
+			{PlaneNum: 1, Children: [2]int32{-1, -3}},
+		},
+		planes: planes,
+		leaves: []leaf.Leaf{
+			{FirstLeafFace: 0, NumLeafFaces: 3},
+			{Contents: bsp.CONTENTS_SOLID},
+			{Contents: bsp.CONTENTS_WATER},
+		},
+		leafFaces:    []uint16{0, 1, 2},
+		surfaces:     faces,
+		polygons:     buildPolygons(bspfile),
+		texInfos:     []texinfo.TexInfo{{TexData: 0}, {TexData: 1}, {TexData: 2}},
+		texDataNames: []string{"TOOLS/TOOLSNODRAW", "CONCRETE/WALL", "WATER/WATER"},
+	}
+
+	m.nodePlanes = newNodePlanes(m.nodes, m.planes)
+
+	return m
+}
+
+func TestMap_TraceRay_Face(t *testing.T) {
+	t.Parallel()
+
+	m := faceMap(t)
+
+	tr := m.TraceRay(mgl32.Vec3{0, 10, 20}, mgl32.Vec3{100, 10, 20})
+	assert.False(t, tr.StartSolid)
+	assert.False(t, tr.AllSolid)
+	assert.Equal(t, float32(0.5), tr.Fraction)
+	assert.Equal(t, mgl32.Vec3{50, 10, 20}, tr.EndPos)
+	assert.False(t, m.IsVisible(mgl32.Vec3{0, 10, 20}, mgl32.Vec3{100, 10, 20}))
+
+	tr = m.TraceRay(mgl32.Vec3{-20, 0, 0}, mgl32.Vec3{80, 0, 0})
+	assert.InDelta(t, 0.7, tr.Fraction, 1e-6)
+
+	// nothing is hit, only crossing into solid counts
+	assert.Equal(t, &Trace{Fraction: 1, EndPos: mgl32.Vec3{40, 0, 0}}, m.TraceRay(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{40, 0, 0}))
+	assert.True(t, m.IsVisible(mgl32.Vec3{0, 60, 0}, mgl32.Vec3{100, 60, 0}), "beside the face")
+	assert.True(t, m.IsVisible(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{-100, 0, 0}), "water")
+	assert.InDelta(t, 0.5, m.TraceRayWithMask(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{-100, 0, 0}, MaskWater).Fraction, 1e-6)
+
+	// packets give the same results
+	rays := []Ray{
+		{Origin: mgl32.Vec3{0, 10, 20}, Destination: mgl32.Vec3{100, 10, 20}},
+		{Origin: mgl32.Vec3{-20, 0, 0}, Destination: mgl32.Vec3{80, 0, 0}},
+		{Origin: mgl32.Vec3{0, 0, 0}, Destination: mgl32.Vec3{40, 0, 0}},
+	}
+
+	for i, tr := range m.TraceBatch(rays, BatchOptions{Packets: true}) {
+		assert.Equal(t, *m.TraceRay(rays[i].Origin, rays[i].Destination), tr, "ray %d", i)
+	}
+}
+
+func TestMap_TraceRay_RotatedBrushEntityFace(t *testing.T) {
+	t.Parallel()
+
+	m := faceMap(t)
+
+	// the model uses the tree of faceMap, far away from the faces of the world; yaw 90 turns local x into world y
+	door := brushEntity{
+		BrushEntity: BrushEntity{Entity: 7, Model: 1, ClassName: "func_brush", Origin: mgl32.Vec3{1000, 0, 0}, Angles: mgl32.Vec3{0, 90, 0}, Enabled: true},
+		headNode:    0,
+	}
+	door.updateTransform(mgl32.Vec3{-50, -50, -50}, mgl32.Vec3{50, 50, 50})
+	m.brushEntities = []brushEntity{door}
+
+	tr := m.TraceRay(mgl32.Vec3{1010, 0, 20}, mgl32.Vec3{1010, 100, 20})
+	assert.Equal(t, HitFace, tr.HitKind)
+	assert.Equal(t, int32(7), tr.Entity)
+	assert.Equal(t, int32(1), tr.Face)
+	assert.InDelta(t, 0.5, tr.Fraction, 1e-6)
+	assert.InDelta(t, 0, tr.Plane.Normal.Sub(mgl32.Vec3{0, -1, 0}).Len(), 1e-5, "%v", tr.Plane.Normal)
+	assert.InDelta(t, -50, tr.Plane.Distance, 1e-4)
+	assert.InDelta(t, tr.EndPos.Dot(tr.Plane.Normal), tr.Plane.Distance, 1e-4, "the end position is on the plane")
+
+	m.SetBrushEntityEnabled(0, false)
+	assert.True(t, m.IsVisible(mgl32.Vec3{1010, 0, 20}, mgl32.Vec3{1010, 100, 20}))
+}
+
+func TestBuildPolygons(t *testing.T) {
+	t.Parallel()
+
+	polygons := faceMap(t).polygons
+
+	// polygons are indexed like the faces lump, even if faces are skipped
+	assert.Len(t, polygons, 3)
+	assert.Zero(t, polygons[0].numVerts)
+	assert.Equal(t, 4, polygons[1].numVerts)
+	assert.Equal(t, []mgl32.Vec3{{50, -50, -50}, {50, -50, 50}, {50, 50, 50}, {50, 50, -50}}, polygons[1].verts[:4])
+	assert.Equal(t, vplane{origin: mgl32.Vec3{1, 0, 0}, distance: 50}, polygons[1].plane)
+	assert.Equal(t, []mgl32.Vec3{{-50, -50, -50}, {-50, -50, 50}, {-50, 50, 50}, {-50, 50, -50}}, polygons[2].verts[:4])
+	assert.Equal(t, vplane{origin: mgl32.Vec3{1, 0, 0}, distance: -50}, polygons[2].plane)
+}
+
+func TestMap_TraceRay_HitDetails(t *testing.T) {
+	t.Parallel()
+
+	m := faceMap(t)
+
+	tr := m.TraceRay(mgl32.Vec3{0, 10, 20}, mgl32.Vec3{100, 10, 20})
+	assert.Equal(t, HitFace, tr.HitKind)
+	assert.Equal(t, int32(1), tr.Face)
+	assert.Equal(t, mgl32.Vec3{-1, 0, 0}, tr.Plane.Normal, "facing the origin of the trace")
+	assert.Equal(t, float32(-50), tr.Plane.Distance)
+	assert.Equal(t, int32(bsp.CONTENTS_SOLID), tr.Contents)
+	assert.Equal(t, Surface{Name: "CONCRETE/WALL", TexInfo: 1, TexData: 1}, tr.Surface)
+
+	tr = m.TraceRayWithMask(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{-100, 0, 0}, MaskWater)
+	assert.Equal(t, HitFace, tr.HitKind)
+	assert.Equal(t, int32(2), tr.Face)
+	assert.Equal(t, mgl32.Vec3{1, 0, 0}, tr.Plane.Normal)
+	assert.Equal(t, "WATER/WATER", tr.Surface.Name)
+
+	assert.Equal(t, HitNone, m.TraceRay(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{40, 0, 0}).HitKind)
+
+	// brushes, the sides are +x, -x, +y, -y, +z, -z
+	m = boxesMap([][2]mgl32.Vec3{{{10, 5, -20}, {40, 15, 80}}})
+	m.texInfos = []texinfo.TexInfo{{TexData: 0}, {TexData: 1}}
+	m.texDataNames = []string{"CONCRETE/WALL", "METAL/CRATE"}
+	m.brushSides[1].TexInfo = 1
+
+	tr = m.TraceRay(mgl32.Vec3{0, 10, 0}, mgl32.Vec3{100, 10, 0})
+	assert.Equal(t, HitBrush, tr.HitKind)
+	assert.Same(t, &m.brushes[0], tr.Brush)
+	assert.Equal(t, int32(1), tr.BrushSide)
+	assert.Equal(t, mgl32.Vec3{-1, 0, 0}, tr.Plane.Normal)
+	assert.Equal(t, float32(-10), tr.Plane.Distance)
+	assert.Equal(t, Surface{Name: "METAL/CRATE", TexInfo: 1, TexData: 1}, tr.Surface)
+	assert.InDelta(t, 0.1, tr.Fraction, 0.001)
+
+	tr = m.TraceRay(mgl32.Vec3{20, 10, 100}, mgl32.Vec3{20, 10, 0})
+	assert.Equal(t, int32(4), tr.BrushSide)
+	assert.Equal(t, mgl32.Vec3{0, 0, 1}, tr.Plane.Normal)
+	assert.Equal(t, Surface{TexInfo: -1, TexData: -1}, tr.Surface, "no texinfo")
+}
+
+func TestMap_TraceAll_Displacement(t *testing.T) {
+	t.Parallel()
+
+	bspfile := dispBsp(t, 0)
+
+	m := boxesMap(nil)
+	m.surfaces = bspfile.Lump(bsp.LumpFaces).(*lumps.Face).GetData()
+	m.displacements = buildDisplacements(bspfile)
+	m.displacementsByLeaf = displacementsByLeaf(m.nodes, m.planes, m.displacements)
+
+	fractions := func(all []Intersection) []float32 {
+		var res []float32
+
+		for _, is := range all {
+			assert.Equal(t, HitDisplacement, is.Kind)
+			assert.Equal(t, is.EnterFraction, is.ExitFraction)
+
+			res = append(res, is.EnterFraction)
+		}
+
+		return res
+	}
+
+	// through the bump, at x = 30 the surface rises from y = 0 to 30 and falls from y = 70 to 100
+	all := m.TraceAll(mgl32.Vec3{30, -10, 10}, mgl32.Vec3{30, 110, 10})
+	if assert.Len(t, all, 2) {
+		assert.InDeltaSlice(t, []float32{20.0 / 120, 100.0 / 120}, fractions(all), 1e-5)
+	}
+
+	// the top of the bump is a vertex of six triangles
+	all = m.TraceAll(mgl32.Vec3{50, 50, 100}, mgl32.Vec3{50, 50, -100})
+	if assert.Len(t, all, 1) {
+		assert.InDeltaSlice(t, []float32{0.25}, fractions(all), 1e-5)
+	}
+}
+
+func TestMap_TracePenetration_Grate(t *testing.T) {
+	t.Parallel()
+
+	m := boxesMap([][2]mgl32.Vec3{{{40, 0, 0}, {42, 10, 10}}})
+	noPenetration := WeaponParams{Damage: 30, RangeModifier: 1, Penetration: 0, Range: 4096}
+
+	res := m.TracePenetration(mgl32.Vec3{0, 5, 5}, mgl32.Vec3{100, 5, 5}, noPenetration)
+	if assert.Len(t, res.Segments, 1) {
+		assert.False(t, res.Segments[0].Penetrated)
+	}
+
+	assert.Zero(t, res.Damage)
+
+	// grates are penetrated without penetration power
+	m.brushes[0].Contents = bsp.CONTENTS_GRATE
+
+	res = m.TracePenetration(mgl32.Vec3{0, 5, 5}, mgl32.Vec3{100, 5, 5}, noPenetration)
+	if assert.Len(t, res.Segments, 1) {
+		assert.True(t, res.Segments[0].Penetrated)
+		assert.InDelta(t, 2, res.Segments[0].Thickness, 1e-3)
+	}
+
+	assert.True(t, res.Wallbang())
+	assert.InDelta(t, 30*(1-0.16)-4./24, res.Damage, 1e-3)
 }
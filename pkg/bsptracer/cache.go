@@ -0,0 +1,858 @@
+package bsptracer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+
+	"github.com/galaco/bsp/primitives/area"
+	"github.com/galaco/bsp/primitives/areaportal"
+	"github.com/galaco/bsp/primitives/brush"
+	"github.com/galaco/bsp/primitives/brushside"
+	"github.com/galaco/bsp/primitives/face"
+	"github.com/galaco/bsp/primitives/leaf"
+	"github.com/galaco/bsp/primitives/node"
+	"github.com/galaco/bsp/primitives/plane"
+	"github.com/galaco/bsp/primitives/texinfo"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// mapCacheMagic identifies map caches, see Map.WriteTo.
+const mapCacheMagic = "BSPTRACE"
+
+// mapCacheVersion is the version of the map cache format.
+// It must be incremented whenever the format or the meaning of the cached data changes,
+// ReadMap rejects caches of other versions.
+const mapCacheVersion = 1
+
+// WriteTo writes the data that is needed for traces and queries to w in a compact, versioned binary format.
+// Reading it with ReadMap is much faster than loading the map from the BSP and VPKs,
+// since no models need to be parsed and polygons, prop collision meshes, BVHs and per-leaf lookups are stored as they are.
+// Raw lumps that are only needed while loading (vertices, edges, displacement vertices) are not included.
+//
+// All values are little-endian. Arrays are stored as an element count followed by the elements,
+// arrays of BSP lumps are stored as fixed-size records like in the BSP file.
+// The current state of dynamic props and brush entities is stored, see SetDynamicPropTransform.
+func (m Map) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &cacheWriter{w: bw}
+
+	cw.write([]byte(mapCacheMagic))
+	cw.uint32(mapCacheVersion)
+
+	// BSP lumps
+	writeFixed(cw, m.brushes)
+	writeFixed(cw, m.brushSides)
+	writeFixed(cw, m.leafBrushes)
+	writeFixed(cw, m.leafFaces)
+	writeFixed(cw, m.leaves)
+	writeFixed(cw, m.nodes)
+	writeFixed(cw, m.planes)
+	writeFixed(cw, m.surfaces)
+	writeFixed(cw, m.texInfos)
+	writeFixed(cw, m.areas)
+	writeFixed(cw, m.areaPortalLump)
+
+	writeSlice(cw, m.entities, cw.entity)
+	writeSlice(cw, m.polygons, cw.polygon)
+	writeSlice(cw, m.texDataNames, cw.string)
+	writeSlice(cw, m.texDataSurfaceProps, cw.string)
+	cw.surfaceProps(m.surfaceProps)
+	writeSlice(cw, m.pvs, func(set []uint64) { writeFixed(cw, set) })
+	writeSlice(cw, m.pas, func(set []uint64) { writeFixed(cw, set) })
+	writeSlice(cw, m.areaPortals, cw.areaPortal)
+	writeSlice(cw, m.brushEntities, cw.brushEntity)
+	writeSlice(cw, m.volumes, cw.brushEntity)
+
+	// models are shared by props, they're stored once and referenced by index
+	models, modelIndices := m.propModels()
+
+	writeSlice(cw, models, cw.model)
+	cw.staticPropLump(m.staticPropLump)
+	writeSlice(cw, m.staticProps, func(p staticProp) {
+		cw.int32(int32(p.Index))
+		cw.int32(modelIndices[p.model])
+		cw.propCollision(&p.propCollision)
+	})
+	writeSlice(cw, m.displacements, cw.displacement)
+	writeSlice(cw, m.dynamicProps, func(p dynamicProp) {
+		cw.dynamicProp(p.DynamicProp)
+		cw.int32(modelIndices[p.model])
+		cw.uint8(uint8(p.physicsFallback))
+		cw.propCollision(&p.propCollision)
+	})
+
+	propIndices := make(map[*staticProp]int32, len(m.staticProps))
+
+	for i := range m.staticProps {
+		propIndices[&m.staticProps[i]] = int32(i)
+	}
+
+	writeByLeaf(cw, m.staticPropsByLeaf, func(p *staticProp) int32 { return propIndices[p] })
+	writeByLeaf(cw, m.displacementsByLeaf, func(d *displacement) int32 { return int32(d.index) })
+
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+
+	return cw.n, errors.Wrap(cw.err, "failed to write map cache")
+}
+
+// propModels returns the models of all props and their indices, nil (missing models) has index -1.
+func (m Map) propModels() ([]*model, map[*model]int32) {
+	var models []*model
+
+	indices := map[*model]int32{nil: -1}
+
+	add := func(mdl *model) {
+		if _, ok := indices[mdl]; !ok {
+			indices[mdl] = int32(len(models))
+			models = append(models, mdl)
+		}
+	}
+
+	for _, p := range m.staticProps {
+		add(p.model)
+	}
+
+	for _, p := range m.dynamicProps {
+		add(p.model)
+	}
+
+	return models, indices
+}
+
+// ReadMap reads a map that was written by Map.WriteTo.
+// Returns an error if the cache was written by an incompatible version of this package.
+func ReadMap(r io.Reader) (Map, error) {
+	b, err := readAll(r)
+	if err != nil {
+		return Map{}, errors.Wrap(err, "failed to read map cache")
+	}
+
+	m, err := readMapCache(&lumpReader{b: b})
+
+	return m, errors.Wrap(err, "failed to read map cache")
+}
+
+// readAll is like io.ReadAll, but reads files and in-memory readers into a single buffer of the right size.
+func readAll(r io.Reader) ([]byte, error) {
+	var size int64
+
+	switch r := r.(type) {
+	case interface{ Len() int }: // bytes.Buffer, bytes.Reader, strings.Reader
+		size = int64(r.Len())
+
+	case interface{ Stat() (fs.FileInfo, error) }: // os.File
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+	}
+
+	if size <= 0 || int64(int(size)) != size {
+		return io.ReadAll(r)
+	}
+
+	b := make([]byte, size)
+
+	n, err := io.ReadFull(r, b)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return b[:n], nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the reader has more data than its size said, e.g. a file that was appended to
+	rest, err := io.ReadAll(r)
+
+	return append(b, rest...), err
+}
+
+func readMapCache(r *lumpReader) (Map, error) {
+	if magic := string(r.next(len(mapCacheMagic))); magic != mapCacheMagic {
+		return Map{}, errors.New("not a map cache")
+	}
+
+	if version := r.uint32(); version != mapCacheVersion {
+		return Map{}, errors.Errorf("unsupported version %d, expected %d", version, mapCacheVersion)
+	}
+
+	m := Map{
+		brushes:        readFixed[brush.Brush](r),
+		brushSides:     readFixed[brushside.BrushSide](r),
+		leafBrushes:    readFixed[uint16](r),
+		leafFaces:      readFixed[uint16](r),
+		leaves:         readFixed[leaf.Leaf](r),
+		nodes:          readFixed[node.Node](r),
+		planes:         readFixed[plane.Plane](r),
+		surfaces:       readFixed[face.Face](r),
+		texInfos:       readFixed[texinfo.TexInfo](r),
+		areas:          readFixed[area.Area](r),
+		areaPortalLump: readFixed[areaportal.AreaPortal](r),
+	}
+
+	m.entities = readSlice(r, 4, r.entity)
+
+	for i := range m.entities {
+		m.entities[i].Index = int32(i)
+	}
+
+	m.polygons = readSlice(r, 17, r.polygon)
+	m.texDataNames = readSlice(r, 4, r.string)
+	m.texDataSurfaceProps = readSlice(r, 4, r.string)
+	m.surfaceProps = r.surfaceProps()
+	m.pvs = readSlice(r, 4, func() []uint64 { return readFixed[uint64](r) })
+	m.pas = readSlice(r, 4, func() []uint64 { return readFixed[uint64](r) })
+	m.areaPortals = readSlice(r, 11, r.areaPortal)
+	m.brushEntities = readSlice(r, 106, r.brushEntity)
+	m.volumes = readSlice(r, 106, r.brushEntity)
+
+	models := readSlice(r, 36, r.model)
+
+	modelAt := func() *model {
+		i := r.int32()
+		if i < -1 || int(i) >= len(models) {
+			r.fail(errors.Errorf("invalid model index %d", i))
+		}
+
+		if i < 0 || r.err != nil {
+			return nil
+		}
+
+		return models[i]
+	}
+
+	m.staticPropLump = r.staticPropLump()
+	m.staticProps = readSlice(r, 8, func() staticProp {
+		index := int(r.int32())
+		if index < 0 || index >= len(m.staticPropLump.props) {
+			r.fail(errors.Errorf("invalid static prop index %d", index))
+
+			return staticProp{}
+		}
+
+		return staticProp{
+			StaticProp:    m.staticPropLump.props[index].StaticProp,
+			model:         modelAt(),
+			propCollision: r.propCollision(),
+		}
+	})
+	m.displacements = readSlice(r, 42, r.displacement)
+	m.dynamicProps = readSlice(r, 39, func() dynamicProp {
+		p := dynamicProp{
+			DynamicProp:     r.dynamicProp(),
+			model:           modelAt(),
+			physicsFallback: PhysicsFallback(r.uint8()),
+			propCollision:   r.propCollision(),
+		}
+
+		p.CollisionFallback = p.fallback
+		p.ModelMissing = p.model == nil
+
+		return p
+	})
+	m.staticPropsByLeaf = readByLeaf(r, m.staticProps)
+	m.displacementsByLeaf = readByLeaf(r, m.displacements)
+
+	if r.err == nil && r.off != len(r.b) {
+		r.fail(errors.Errorf("unexpected data at offset %d", r.off))
+	}
+
+	if r.err != nil {
+		return Map{}, r.err
+	}
+
+	for i := range m.displacements {
+		m.displacements[i].index = i
+	}
+
+	m.nodePlanes = newNodePlanes(m.nodes, m.planes)
+
+	return m, nil
+}
+
+// cacheWriter writes little-endian values and remembers the first error, see lumpReader.
+type cacheWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [4]byte
+}
+
+func (w *cacheWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *cacheWriter) uint8(v uint8) {
+	w.buf[0] = v
+	w.write(w.buf[:1])
+}
+
+func (w *cacheWriter) bool(v bool) {
+	if v {
+		w.uint8(1)
+	} else {
+		w.uint8(0)
+	}
+}
+
+func (w *cacheWriter) uint16(v uint16) {
+	binary.LittleEndian.PutUint16(w.buf[:], v)
+	w.write(w.buf[:2])
+}
+
+func (w *cacheWriter) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:], v)
+	w.write(w.buf[:4])
+}
+
+func (w *cacheWriter) int32(v int32) {
+	w.uint32(uint32(v))
+}
+
+func (w *cacheWriter) float32(v float32) {
+	w.uint32(math.Float32bits(v))
+}
+
+func (w *cacheWriter) vec3(v mgl32.Vec3) {
+	for _, f := range v {
+		w.float32(f)
+	}
+}
+
+func (w *cacheWriter) triangle(t [3]mgl32.Vec3) {
+	for _, v := range t {
+		w.vec3(v)
+	}
+}
+
+func (w *cacheWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.write([]byte(s))
+}
+
+// fixed writes a fixed-size value or slice of fixed-size values with encoding/binary.
+func (w *cacheWriter) fixed(v any) {
+	if w.err != nil {
+		return
+	}
+
+	w.err = binary.Write(w.w, binary.LittleEndian, v)
+	w.n += int64(binary.Size(v))
+}
+
+// writeFixed writes the number of elements followed by the fixed-size elements.
+func writeFixed[T any](w *cacheWriter, s []T) {
+	w.uint32(uint32(len(s)))
+
+	if len(s) > 0 {
+		w.fixed(s)
+	}
+}
+
+// writeSlice writes the number of elements followed by every element.
+func writeSlice[T any](w *cacheWriter, s []T, write func(T)) {
+	w.uint32(uint32(len(s)))
+
+	for _, v := range s {
+		write(v)
+	}
+}
+
+// writeByLeaf writes a per-leaf lookup as the number of leaves followed by the leaves in ascending order,
+// each with the indices (see index) of its objects.
+func writeByLeaf[T any](w *cacheWriter, byLeaf map[uint16][]*T, index func(*T) int32) {
+	leaves := make([]int, 0, len(byLeaf))
+
+	for leaf := range byLeaf {
+		leaves = append(leaves, int(leaf))
+	}
+
+	sort.Ints(leaves)
+
+	writeSlice(w, leaves, func(leaf int) {
+		w.uint16(uint16(leaf))
+		writeSlice(w, byLeaf[uint16(leaf)], func(v *T) { w.int32(index(v)) })
+	})
+}
+
+// bvh writes a BVH as the size of its encoding followed by the encoding, see collision.BVH.MarshalBinary.
+func (w *cacheWriter) bvh(tree *collision.BVH) {
+	b, err := tree.MarshalBinary()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+
+	w.uint32(uint32(len(b)))
+	w.write(b)
+}
+
+func (w *cacheWriter) entity(ent Entity) {
+	writeSlice(w, ent.KeyValues, func(kv KeyValue) {
+		w.string(kv.Key)
+		w.string(kv.Value)
+	})
+}
+
+func (w *cacheWriter) polygon(p polygon) {
+	w.uint8(uint8(p.numVerts))
+
+	for _, v := range p.verts[:p.numVerts] {
+		w.vec3(v)
+	}
+
+	w.vec3(p.plane.origin)
+	w.float32(p.plane.distance)
+}
+
+func (w *cacheWriter) surfaceProps(props map[string]SurfaceProperties) {
+	names := make([]string, 0, len(props))
+
+	for name := range props {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	writeSlice(w, names, func(name string) {
+		p := props[name]
+
+		w.string(name)
+		w.string(p.Name)
+		w.uint8(p.GameMaterial)
+		w.float32(p.PenetrationModifier)
+		w.float32(p.DamageModifier)
+	})
+}
+
+func (w *cacheWriter) areaPortal(p AreaPortal) {
+	w.uint16(p.Key)
+	w.uint16(uint16(p.Areas[0]))
+	w.uint16(uint16(p.Areas[1]))
+	w.string(p.Door)
+	w.bool(p.StartOpen)
+}
+
+func (w *cacheWriter) brushEntity(e brushEntity) {
+	w.int32(e.Entity)
+	w.int32(e.Model)
+	w.string(e.ClassName)
+	w.string(e.TargetName)
+	w.vec3(e.Origin)
+	w.vec3(e.Angles)
+	w.bool(e.Enabled)
+	w.int32(e.headNode)
+
+	for _, f := range e.rotation {
+		w.float32(f)
+	}
+
+	w.bool(e.rotated)
+	w.vec3(e.min)
+	w.vec3(e.max)
+}
+
+func (w *cacheWriter) model(mdl *model) {
+	w.string(mdl.surfaceProp)
+	w.vec3(mdl.hullMin)
+	w.vec3(mdl.hullMax)
+	writeSlice(w, mdl.phySolids, func(solid [][3]mgl32.Vec3) {
+		writeSlice(w, solid, w.triangle)
+	})
+	writeSlice(w, mdl.renderMesh, w.triangle)
+}
+
+func (w *cacheWriter) staticPropLump(lump staticPropLump) {
+	writeSlice(w, lump.names, w.string)
+	writeFixed(w, lump.leaves)
+	writeSlice(w, lump.props, func(p staticPropEntry) {
+		w.uint16(p.propType)
+		w.uint16(p.firstLeaf)
+		w.uint16(p.leafCount)
+		w.vec3(p.Origin)
+		w.vec3(p.Angles)
+		w.float32(p.UniformScale)
+		w.int32(int32(p.Solid))
+		w.int32(p.Skin)
+		w.uint8(p.Flags)
+		w.uint32(p.FlagsEx)
+		w.float32(p.FadeMinDist)
+		w.float32(p.FadeMaxDist)
+		w.bool(p.DisableX360)
+		w.bool(p.CollisionFallback)
+	})
+}
+
+func (w *cacheWriter) propCollision(p *propCollision) {
+	w.int32(int32(p.solid))
+	writeSlice(w, p.hulls, func(h collision.ConvexHull) {
+		writeSlice(w, h.Vertices, w.vec3)
+		writeSlice(w, h.Normals, w.vec3)
+		writeSlice(w, h.Edges, w.vec3)
+		w.vec3(h.Min)
+		w.vec3(h.Max)
+	})
+	writeSlice(w, p.triangles, w.triangle)
+	w.vec3(p.obb.Center)
+
+	for _, axis := range p.obb.Axes {
+		w.vec3(axis)
+	}
+
+	w.vec3(p.obb.Extents)
+	w.vec3(p.min)
+	w.vec3(p.max)
+	w.bool(p.fallback)
+	w.bvh(&p.triangleTree)
+	w.bvh(&p.hullTree)
+}
+
+func (w *cacheWriter) displacement(d displacement) {
+	writeSlice(w, d.triangles, w.triangle)
+	writeFixed(w, d.tags)
+	w.int32(d.contents)
+	w.uint32(d.flags)
+	w.uint16(d.face)
+	w.vec3(d.min)
+	w.vec3(d.max)
+	w.bvh(&d.tree)
+}
+
+func (w *cacheWriter) dynamicProp(p DynamicProp) {
+	w.int32(p.Entity)
+	w.string(p.ClassName)
+	w.string(p.TargetName)
+	w.string(p.Model)
+	w.vec3(p.Origin)
+	w.vec3(p.Angles)
+	w.float32(p.Scale)
+	w.int32(int32(p.Solid))
+	w.bool(p.Enabled)
+}
+
+// fail sets the error of the reader unless there already is one.
+func (r *lumpReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// count reads the number of elements of an array, minSize is the minimum size of an element.
+// Returns 0 if the array can't fit in the rest of the data, so corrupt counts don't cause huge allocations.
+func (r *lumpReader) count(minSize int) int {
+	n := int(r.uint32())
+
+	if minSize > 0 && n > (len(r.b)-r.off)/minSize {
+		r.fail(errors.Errorf("invalid number of elements %d at offset %d", n, r.off))
+	}
+
+	if r.err != nil {
+		return 0
+	}
+
+	return n
+}
+
+func (r *lumpReader) bool() bool {
+	return r.uint8() != 0
+}
+
+func (r *lumpReader) vec3() mgl32.Vec3 {
+	return mgl32.Vec3{r.float32(), r.float32(), r.float32()}
+}
+
+func (r *lumpReader) triangle() [3]mgl32.Vec3 {
+	return [3]mgl32.Vec3{r.vec3(), r.vec3(), r.vec3()}
+}
+
+func (r *lumpReader) string() string {
+	return string(r.next(r.count(1)))
+}
+
+// fixed reads a fixed-size value or slice of fixed-size values with encoding/binary.
+func (r *lumpReader) fixed(v any) {
+	b := r.next(binary.Size(v))
+
+	if r.err == nil {
+		r.err = binary.Read(bytes.NewReader(b), binary.LittleEndian, v)
+	}
+}
+
+// readFixed reads an array that was written by writeFixed.
+func readFixed[T any](r *lumpReader) []T {
+	var zero T
+
+	n := r.count(binary.Size(zero))
+	if n == 0 {
+		return nil
+	}
+
+	s := make([]T, n)
+	r.fixed(s)
+
+	return s
+}
+
+// readSlice reads an array that was written by writeSlice, minSize is the minimum encoded size of an element.
+func readSlice[T any](r *lumpReader, minSize int, read func() T) []T {
+	n := r.count(minSize)
+	if n == 0 {
+		return nil
+	}
+
+	s := make([]T, n)
+
+	for i := range s {
+		s[i] = read()
+	}
+
+	return s
+}
+
+// readByLeaf reads a per-leaf lookup that was written by writeByLeaf, the indices are indices of objects.
+func readByLeaf[T any](r *lumpReader, objects []T) map[uint16][]*T {
+	n := r.count(6)
+	byLeaf := make(map[uint16][]*T, n)
+
+	for i := 0; i < n && r.err == nil; i++ {
+		leaf := r.uint16()
+		byLeaf[leaf] = readSlice(r, 4, func() *T {
+			index := r.int32()
+			if index < 0 || int(index) >= len(objects) {
+				r.fail(errors.Errorf("invalid index %d in leaf %d", index, leaf))
+
+				return nil
+			}
+
+			return &objects[index]
+		})
+	}
+
+	return byLeaf
+}
+
+// bvh reads a BVH that was written by cacheWriter.bvh, n is the number of boxes it must contain.
+func (r *lumpReader) bvh(n int) (tree collision.BVH) {
+	b := r.next(r.count(1))
+
+	if r.err != nil {
+		return tree
+	}
+
+	if err := tree.UnmarshalBinary(b); err != nil {
+		r.fail(err)
+	} else if tree.Len() != n {
+		r.fail(errors.Errorf("BVH with %d boxes for %d objects", tree.Len(), n))
+	}
+
+	return tree
+}
+
+func (r *lumpReader) entity() Entity {
+	return Entity{
+		KeyValues: readSlice(r, 8, func() KeyValue {
+			return KeyValue{Key: r.string(), Value: r.string()}
+		}),
+	}
+}
+
+func (r *lumpReader) polygon() (p polygon) {
+	p.numVerts = int(r.uint8())
+
+	if p.numVerts > maxSurfinfoVerts {
+		r.fail(errors.Errorf("invalid number of polygon vertices %d", p.numVerts))
+
+		return p
+	}
+
+	for i := range p.verts[:p.numVerts] {
+		p.verts[i] = r.vec3()
+	}
+
+	p.plane.origin = r.vec3()
+	p.plane.distance = r.float32()
+
+	return p
+}
+
+func (r *lumpReader) surfaceProps() map[string]SurfaceProperties {
+	n := r.count(14)
+	res := make(map[string]SurfaceProperties, n)
+
+	for i := 0; i < n; i++ {
+		key := r.string()
+		res[key] = SurfaceProperties{
+			Name:                r.string(),
+			GameMaterial:        r.uint8(),
+			PenetrationModifier: r.float32(),
+			DamageModifier:      r.float32(),
+		}
+	}
+
+	return res
+}
+
+func (r *lumpReader) areaPortal() AreaPortal {
+	return AreaPortal{
+		Key:       r.uint16(),
+		Areas:     [2]int16{int16(r.uint16()), int16(r.uint16())},
+		Door:      r.string(),
+		StartOpen: r.bool(),
+	}
+}
+
+func (r *lumpReader) brushEntity() brushEntity {
+	e := brushEntity{
+		BrushEntity: BrushEntity{
+			Entity:     r.int32(),
+			Model:      r.int32(),
+			ClassName:  r.string(),
+			TargetName: r.string(),
+			Origin:     r.vec3(),
+			Angles:     r.vec3(),
+			Enabled:    r.bool(),
+		},
+		headNode: r.int32(),
+	}
+
+	for i := range e.rotation {
+		e.rotation[i] = r.float32()
+	}
+
+	e.rotated = r.bool()
+	e.min = r.vec3()
+	e.max = r.vec3()
+
+	return e
+}
+
+func (r *lumpReader) model() *model {
+	return &model{
+		surfaceProp: r.string(),
+		hullMin:     r.vec3(),
+		hullMax:     r.vec3(),
+		phySolids: readSlice(r, 4, func() [][3]mgl32.Vec3 {
+			return readSlice(r, 36, r.triangle)
+		}),
+		renderMesh: readSlice(r, 36, r.triangle),
+	}
+}
+
+func (r *lumpReader) staticPropLump() staticPropLump {
+	lump := staticPropLump{
+		names:  readSlice(r, 4, r.string),
+		leaves: readFixed[uint16](r),
+	}
+
+	lump.props = readSlice(r, 60, func() staticPropEntry {
+		p := staticPropEntry{
+			propType:  r.uint16(),
+			firstLeaf: r.uint16(),
+			leafCount: r.uint16(),
+		}
+
+		p.Origin = r.vec3()
+		p.Angles = r.vec3()
+		p.UniformScale = r.float32()
+		p.Solid = int(r.int32())
+		p.Skin = r.int32()
+		p.Flags = r.uint8()
+		p.FlagsEx = r.uint32()
+		p.FadeMinDist = r.float32()
+		p.FadeMaxDist = r.float32()
+		p.DisableX360 = r.bool()
+		p.CollisionFallback = r.bool()
+
+		if int(p.propType) >= len(lump.names) || int(p.firstLeaf)+int(p.leafCount) > len(lump.leaves) {
+			r.fail(errors.Errorf("invalid static prop model %d or leaves %d+%d", p.propType, p.firstLeaf, p.leafCount))
+
+			return p
+		}
+
+		p.Model = lump.names[p.propType]
+
+		return p
+	})
+
+	for i := range lump.props {
+		lump.props[i].Index = i
+	}
+
+	return lump
+}
+
+func (r *lumpReader) propCollision() propCollision {
+	p := propCollision{
+		solid: int(r.int32()),
+		hulls: readSlice(r, 36, func() collision.ConvexHull {
+			return collision.ConvexHull{
+				Vertices: readSlice(r, 12, r.vec3),
+				Normals:  readSlice(r, 12, r.vec3),
+				Edges:    readSlice(r, 12, r.vec3),
+				Min:      r.vec3(),
+				Max:      r.vec3(),
+			}
+		}),
+		triangles: readSlice(r, 36, r.triangle),
+	}
+
+	p.obb.Center = r.vec3()
+
+	for i := range p.obb.Axes {
+		p.obb.Axes[i] = r.vec3()
+	}
+
+	p.obb.Extents = r.vec3()
+	p.min = r.vec3()
+	p.max = r.vec3()
+	p.fallback = r.bool()
+	p.triangleTree = r.bvh(len(p.triangles))
+	p.hullTree = r.bvh(len(p.hulls))
+
+	return p
+}
+
+func (r *lumpReader) displacement() displacement {
+	d := displacement{
+		triangles: readSlice(r, 36, r.triangle),
+		tags:      readFixed[uint16](r),
+		contents:  r.int32(),
+		flags:     r.uint32(),
+		face:      r.uint16(),
+		min:       r.vec3(),
+		max:       r.vec3(),
+	}
+
+	d.tree = r.bvh(len(d.triangles))
+
+	return d
+}
+
+func (r *lumpReader) dynamicProp() DynamicProp {
+	return DynamicProp{
+		Entity:     r.int32(),
+		ClassName:  r.string(),
+		TargetName: r.string(),
+		Model:      r.string(),
+		Origin:     r.vec3(),
+		Angles:     r.vec3(),
+		Scale:      r.float32(),
+		Solid:      int(r.int32()),
+		Enabled:    r.bool(),
+	}
+}
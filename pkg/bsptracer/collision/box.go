@@ -0,0 +1,196 @@
+package collision
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// SweepAxisAlignedBoundingBox sweeps an axis-aligned box with half-size extents from start to end
+// against the axis-aligned bounding box min/max.
+// T of the result is the fraction of the segment at which the box first touches the bounding box.
+func SweepAxisAlignedBoundingBox(start, end, extents, min, max mgl32.Vec3) (r RayCastResult) {
+	var normal mgl32.Vec3
+
+	enter := float32(-1)
+	leave := float32(1)
+	delta := end.Sub(start)
+
+	for i := 0; i < 3; i++ {
+		lo := min[i] - extents[i]
+		hi := max[i] + extents[i]
+
+		if delta[i] == 0 {
+			if start[i] < lo || start[i] > hi {
+				return r
+			}
+
+			continue
+		}
+
+		t1 := (lo - start[i]) / delta[i]
+		t2 := (hi - start[i]) / delta[i]
+		sign := float32(-1)
+
+		if t1 > t2 {
+			t1, t2 = t2, t1
+			sign = 1
+		}
+
+		if t1 > enter {
+			enter = t1
+			normal = mgl32.Vec3{}
+			normal[i] = sign
+		}
+
+		if t2 < leave {
+			leave = t2
+		}
+
+		if enter > leave {
+			return r
+		}
+	}
+
+	if leave < 0 {
+		return r
+	}
+
+	if enter < 0 {
+		// started inside
+		enter = 0
+		normal = mgl32.Vec3{}
+	}
+
+	r.Hit = true
+	r.T = float64(enter)
+	r.Point = start.Add(delta.Mul(enter))
+	r.Normal = normal
+
+	return r
+}
+
+// SweepTriangle sweeps an axis-aligned box with half-size extents from start to end against a triangle.
+// It uses the 13 separating axes of a box and a triangle (box faces, triangle normal and edge cross products).
+// T of the result is the fraction of the segment at which the box first touches the triangle.
+func SweepTriangle(start, end, extents mgl32.Vec3, tri [3]mgl32.Vec3) (r RayCastResult) {
+	edges := [3]mgl32.Vec3{tri[1].Sub(tri[0]), tri[2].Sub(tri[1]), tri[0].Sub(tri[2])}
+	boxAxes := [3]mgl32.Vec3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+	var (
+		axes    [13]mgl32.Vec3
+		numAxes int
+	)
+
+	axes[numAxes] = edges[0].Cross(edges[1])
+	numAxes++
+
+	for _, a := range boxAxes {
+		axes[numAxes] = a
+		numAxes++
+
+		for _, e := range edges {
+			axes[numAxes] = a.Cross(e)
+			numAxes++
+		}
+	}
+
+	return sweepSeparatingAxes(start, end, extents, axes[:numAxes], func(axis mgl32.Vec3) (lo, hi float32) {
+		lo, hi = axis.Dot(tri[0]), axis.Dot(tri[0])
+
+		for _, v := range tri[1:] {
+			d := axis.Dot(v)
+			if d < lo {
+				lo = d
+			}
+
+			if d > hi {
+				hi = d
+			}
+		}
+
+		return lo, hi
+	})
+}
+
+// sweepSeparatingAxes sweeps an axis-aligned box with half-size extents from start to end against a convex shape.
+// project returns the interval of the shape on an axis, axes must contain all potential separating axes.
+func sweepSeparatingAxes(start, end, extents mgl32.Vec3, axes []mgl32.Vec3,
+	project func(axis mgl32.Vec3) (lo, hi float32),
+) (r RayCastResult) {
+	var normal mgl32.Vec3
+
+	enter := float32(-1)
+	leave := float32(1)
+	delta := end.Sub(start)
+
+	for _, axis := range axes {
+		if axis.LenSqr() < mollerTrumboreEpsilon {
+			continue // degenerate axis (e.g. edge parallel to box axis)
+		}
+
+		axis = axis.Normalize()
+
+		lo, hi := project(axis)
+
+		radius := abs(extents[0]*axis[0]) + abs(extents[1]*axis[1]) + abs(extents[2]*axis[2])
+		lo -= radius
+		hi += radius
+
+		c := axis.Dot(start)
+		v := axis.Dot(delta)
+
+		if v == 0 {
+			if c < lo || c > hi {
+				return r
+			}
+
+			continue
+		}
+
+		t1 := (lo - c) / v
+		t2 := (hi - c) / v
+		n := axis.Mul(-1)
+
+		if t1 > t2 {
+			t1, t2 = t2, t1
+			n = axis
+		}
+
+		if t1 > enter {
+			enter = t1
+			normal = n
+		}
+
+		if t2 < leave {
+			leave = t2
+		}
+
+		if enter > leave {
+			return r
+		}
+	}
+
+	if leave < 0 {
+		return r
+	}
+
+	if enter < 0 {
+		// started inside
+		enter = 0
+		normal = mgl32.Vec3{}
+	}
+
+	r.Hit = true
+	r.T = float64(enter)
+	r.Point = start.Add(delta.Mul(enter))
+	r.Normal = normal
+
+	return r
+}
+
+func abs(f float32) float32 {
+	if f < 0 {
+		return -f
+	}
+
+	return f
+}
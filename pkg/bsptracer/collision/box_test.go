@@ -0,0 +1,64 @@
+package collision_test
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+func TestSweepAxisAlignedBoundingBox(t *testing.T) {
+	t.Parallel()
+
+	min := mgl32.Vec3{-10, -10, -10}
+	max := mgl32.Vec3{10, 10, 10}
+
+	r := collision.SweepAxisAlignedBoundingBox(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{}, min, max)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.4, r.T, 0.0001)
+
+	r = collision.SweepAxisAlignedBoundingBox(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{5, 5, 5}, min, max)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.35, r.T, 0.0001)
+
+	r = collision.SweepAxisAlignedBoundingBox(mgl32.Vec3{-50, 14, 0}, mgl32.Vec3{50, 14, 0}, mgl32.Vec3{}, min, max)
+	assert.False(t, r.Hit)
+
+	r = collision.SweepAxisAlignedBoundingBox(mgl32.Vec3{-50, 14, 0}, mgl32.Vec3{50, 14, 0}, mgl32.Vec3{5, 5, 5}, min, max)
+	assert.True(t, r.Hit)
+
+	r = collision.SweepAxisAlignedBoundingBox(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{}, min, max)
+	assert.True(t, r.Hit)
+	assert.Zero(t, r.T)
+}
+
+func TestSweepTriangle(t *testing.T) {
+	t.Parallel()
+
+	tri := [3]mgl32.Vec3{{0, -10, -10}, {0, 10, -10}, {0, 0, 10}}
+
+	r := collision.SweepTriangle(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{}, tri)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.5, r.T, 0.0001)
+
+	r = collision.SweepTriangle(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{10, 10, 10}, tri)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.4, r.T, 0.0001)
+
+	r = collision.SweepTriangle(mgl32.Vec3{-50, 0, 20}, mgl32.Vec3{50, 0, 20}, mgl32.Vec3{5, 5, 5}, tri)
+	assert.False(t, r.Hit)
+
+	r = collision.SweepTriangle(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{-20, 0, 0}, mgl32.Vec3{10, 10, 10}, tri)
+	assert.False(t, r.Hit)
+}
+
+func TestSweepAxisAlignedBoundingBox_Normal(t *testing.T) {
+	t.Parallel()
+
+	r := collision.SweepAxisAlignedBoundingBox(mgl32.Vec3{0, 50, 0}, mgl32.Vec3{0, -50, 0}, mgl32.Vec3{}, mgl32.Vec3{-10, -10, -10}, mgl32.Vec3{10, 10, 10})
+	assert.True(t, r.Hit)
+	assert.Equal(t, mgl32.Vec3{0, 1, 0}, r.Normal)
+	assert.Equal(t, mgl32.Vec3{0, 10, 0}, r.Point)
+}
@@ -0,0 +1,418 @@
+package collision
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
+)
+
+// bvhLeafSize is the maximum number of boxes in a leaf of a BVH.
+const bvhLeafSize = 4
+
+// bvhMaxDepth is the maximum depth of a BVH that Sweep can traverse, see the stack in Sweep.
+const bvhMaxDepth = 62
+
+// BVH is a bounding volume hierarchy over axis-aligned boxes, e.g. the bounds of triangles or convex hulls.
+// The zero value is an empty hierarchy.
+type BVH struct {
+	nodes   []bvhNode
+	indices []int32         // box indices, leaves reference ranges of it
+	bounds  [][2]mgl32.Vec3 // min / max of the boxes, in the same order as indices
+}
+
+type bvhNode struct {
+	min, max mgl32.Vec3
+	// inner nodes have count == 0, their first child is the next node and the second child is at second
+	second       int32
+	first, count int32 // range in indices for leaves
+}
+
+// NewBVH builds a hierarchy over the boxes mins[i] / maxs[i].
+func NewBVH(mins, maxs []mgl32.Vec3) BVH {
+	if len(mins) == 0 {
+		return BVH{}
+	}
+
+	b := BVH{
+		nodes:   make([]bvhNode, 0, 2*len(mins)/bvhLeafSize+1),
+		indices: make([]int32, len(mins)),
+	}
+
+	centers := make([]mgl32.Vec3, len(mins))
+
+	for i := range mins {
+		b.indices[i] = int32(i)
+		centers[i] = mins[i].Add(maxs[i]).Mul(0.5)
+	}
+
+	b.build(mins, maxs, centers, 0, int32(len(mins)))
+
+	b.bounds = make([][2]mgl32.Vec3, len(b.indices))
+
+	for i, index := range b.indices {
+		b.bounds[i] = [2]mgl32.Vec3{mins[index], maxs[index]}
+	}
+
+	return b
+}
+
+// NewTriangleBVH builds a hierarchy over the bounds of triangles.
+func NewTriangleBVH(tris [][3]mgl32.Vec3) BVH {
+	mins := make([]mgl32.Vec3, len(tris))
+	maxs := make([]mgl32.Vec3, len(tris))
+
+	for i, t := range tris {
+		mins[i], maxs[i] = t[0], t[0]
+
+		for _, v := range t[1:] {
+			for j := 0; j < 3; j++ {
+				if v[j] < mins[i][j] {
+					mins[i][j] = v[j]
+				}
+
+				if v[j] > maxs[i][j] {
+					maxs[i][j] = v[j]
+				}
+			}
+		}
+	}
+
+	return NewBVH(mins, maxs)
+}
+
+// build adds the node for indices[first:end] and its children, returns the node's index.
+func (b *BVH) build(mins, maxs, centers []mgl32.Vec3, first, end int32) int32 {
+	nodeIndex := int32(len(b.nodes))
+	b.nodes = append(b.nodes, bvhNode{})
+
+	node := bvhNode{
+		min: mins[b.indices[first]],
+		max: maxs[b.indices[first]],
+	}
+
+	cMin, cMax := centers[b.indices[first]], centers[b.indices[first]]
+
+	for _, i := range b.indices[first+1 : end] {
+		for j := 0; j < 3; j++ {
+			node.min[j] = minf(node.min[j], mins[i][j])
+			node.max[j] = maxf(node.max[j], maxs[i][j])
+			cMin[j] = minf(cMin[j], centers[i][j])
+			cMax[j] = maxf(cMax[j], centers[i][j])
+		}
+	}
+
+	if end-first <= bvhLeafSize {
+		node.first = first
+		node.count = end - first
+		b.nodes[nodeIndex] = node
+
+		return nodeIndex
+	}
+
+	// split at the median of the longest axis of the centers
+	axis := 0
+	size := cMax.Sub(cMin)
+
+	if size[1] > size[axis] {
+		axis = 1
+	}
+
+	if size[2] > size[axis] {
+		axis = 2
+	}
+
+	part := b.indices[first:end]
+	sort.Slice(part, func(i, j int) bool {
+		return centers[part[i]][axis] < centers[part[j]][axis]
+	})
+
+	mid := first + (end-first)/2
+
+	b.build(mins, maxs, centers, first, mid)
+	node.second = b.build(mins, maxs, centers, mid, end)
+	b.nodes[nodeIndex] = node
+
+	return nodeIndex
+}
+
+// Sweep calls visit for every box that a box with half-size extents touches while moving from start to end,
+// closer boxes first. Every box is visited at most once.
+// visit returns the fraction of the segment after which boxes don't need to be visited anymore,
+// e.g. the fraction of the closest hit so far. Return 1 to visit all boxes along the segment.
+func (b *BVH) Sweep(start, end, extents mgl32.Vec3, visit func(index int) (maxFraction float32)) {
+	if len(b.nodes) == 0 {
+		return
+	}
+
+	var (
+		delta       = end.Sub(start)
+		maxFraction = float32(1)
+		stack       [bvhMaxDepth + 2]int32
+		n           = 1
+	)
+
+	for n > 0 {
+		n--
+		node := &b.nodes[stack[n]]
+
+		if t, ok := sweepBounds(start, delta, extents, node.min, node.max); !ok || t > maxFraction {
+			continue
+		}
+
+		if node.count > 0 {
+			for i := node.first; i < node.first+node.count; i++ {
+				if t, ok := sweepBounds(start, delta, extents, b.bounds[i][0], b.bounds[i][1]); !ok || t > maxFraction {
+					continue
+				}
+
+				if f := visit(int(b.indices[i])); f < maxFraction {
+					maxFraction = f
+				}
+			}
+
+			continue
+		}
+
+		// push the farther child first, so the closer one is visited first
+		first, second := stack[n]+1, node.second
+		t1, _ := sweepBounds(start, delta, extents, b.nodes[first].min, b.nodes[first].max)
+		t2, _ := sweepBounds(start, delta, extents, b.nodes[second].min, b.nodes[second].max)
+
+		if t1 < t2 {
+			first, second = second, first
+		}
+
+		stack[n] = first
+		stack[n+1] = second
+		n += 2
+	}
+}
+
+// Len returns the number of boxes in the hierarchy.
+func (b *BVH) Len() int {
+	return len(b.indices)
+}
+
+const (
+	bvhNodeSize = 9 * 4 // min, max, second, first, count
+	bvhBoxSize  = 7 * 4 // index, min, max
+)
+
+// MarshalBinary encodes the hierarchy, so it doesn't need to be rebuilt, see UnmarshalBinary.
+// All values are little-endian: the number of nodes, the nodes, the number of boxes and the boxes in leaf order.
+func (b BVH) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 8+len(b.nodes)*bvhNodeSize+len(b.indices)*bvhBoxSize)
+
+	var word [4]byte
+
+	putUint32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(word[:], v)
+		buf = append(buf, word[:]...)
+	}
+
+	putVec3 := func(v mgl32.Vec3) {
+		for _, f := range v {
+			putUint32(math.Float32bits(f))
+		}
+	}
+
+	putUint32(uint32(len(b.nodes)))
+
+	for _, n := range b.nodes {
+		putVec3(n.min)
+		putVec3(n.max)
+		putUint32(uint32(n.second))
+		putUint32(uint32(n.first))
+		putUint32(uint32(n.count))
+	}
+
+	putUint32(uint32(len(b.indices)))
+
+	for i, index := range b.indices {
+		putUint32(uint32(index))
+		putVec3(b.bounds[i][0])
+		putVec3(b.bounds[i][1])
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a hierarchy that was encoded by MarshalBinary.
+// Returns an error if the data is invalid, e.g. if nodes reference boxes that don't exist.
+func (b *BVH) UnmarshalBinary(data []byte) error {
+	off := 0
+
+	next := func(size int) []byte {
+		if off+size > len(data) {
+			return nil
+		}
+
+		off += size
+
+		return data[off-size : off]
+	}
+
+	count := func(elemSize int) (int, bool) {
+		w := next(4)
+		if w == nil {
+			return 0, false
+		}
+
+		n := int(binary.LittleEndian.Uint32(w))
+
+		return n, n <= (len(data)-off)/elemSize
+	}
+
+	getUint32 := func(w []byte, i int) uint32 {
+		return binary.LittleEndian.Uint32(w[i*4:])
+	}
+
+	getVec3 := func(w []byte, i int) mgl32.Vec3 {
+		return mgl32.Vec3{
+			math.Float32frombits(getUint32(w, i)),
+			math.Float32frombits(getUint32(w, i+1)),
+			math.Float32frombits(getUint32(w, i+2)),
+		}
+	}
+
+	numNodes, ok := count(bvhNodeSize)
+	if !ok {
+		return errors.New("invalid number of BVH nodes")
+	}
+
+	res := BVH{}
+
+	if numNodes > 0 {
+		res.nodes = make([]bvhNode, numNodes)
+	}
+
+	for i := range res.nodes {
+		w := next(bvhNodeSize)
+		res.nodes[i] = bvhNode{
+			min:    getVec3(w, 0),
+			max:    getVec3(w, 3),
+			second: int32(getUint32(w, 6)),
+			first:  int32(getUint32(w, 7)),
+			count:  int32(getUint32(w, 8)),
+		}
+	}
+
+	numBoxes, ok := count(bvhBoxSize)
+	if !ok {
+		return errors.New("invalid number of BVH boxes")
+	}
+
+	if numBoxes > 0 {
+		res.indices = make([]int32, numBoxes)
+		res.bounds = make([][2]mgl32.Vec3, numBoxes)
+	}
+
+	for i := range res.indices {
+		w := next(bvhBoxSize)
+
+		res.indices[i] = int32(getUint32(w, 0))
+		res.bounds[i] = [2]mgl32.Vec3{getVec3(w, 1), getVec3(w, 4)}
+
+		if res.indices[i] < 0 || int(res.indices[i]) >= numBoxes {
+			return errors.Errorf("invalid BVH box index %d", res.indices[i])
+		}
+	}
+
+	if off != len(data) {
+		return errors.Errorf("unexpected BVH data at offset %d", off)
+	}
+
+	if len(res.nodes) > 0 {
+		if end, ok := res.validate(0, 0); !ok || int(end) != len(res.nodes) {
+			return errors.New("invalid BVH nodes")
+		}
+	} else if len(res.indices) > 0 {
+		return errors.New("BVH boxes without nodes")
+	}
+
+	*b = res
+
+	return nil
+}
+
+// validate checks that the subtree at nodeIndex is laid out like build does it, so Sweep can't go out of bounds.
+// Returns the index after the last node of the subtree.
+func (b *BVH) validate(nodeIndex int32, depth int) (int32, bool) {
+	if nodeIndex < 0 || int(nodeIndex) >= len(b.nodes) || depth > bvhMaxDepth {
+		return 0, false
+	}
+
+	node := b.nodes[nodeIndex]
+
+	if node.count > 0 {
+		ok := node.first >= 0 && int(node.first)+int(node.count) <= len(b.indices)
+
+		return nodeIndex + 1, ok
+	}
+
+	if node.count < 0 {
+		return 0, false
+	}
+
+	end, ok := b.validate(nodeIndex+1, depth+1)
+	if !ok || end != node.second {
+		return 0, false
+	}
+
+	return b.validate(node.second, depth+1)
+}
+
+// sweepBounds returns the fraction at which a box with half-size extents moving from start by delta enters min / max,
+// 0 if it starts inside.
+func sweepBounds(start, delta, extents, min, max mgl32.Vec3) (float32, bool) {
+	enter := float32(0)
+	leave := float32(1)
+
+	for i := 0; i < 3; i++ {
+		lo := min[i] - extents[i]
+		hi := max[i] + extents[i]
+
+		if delta[i] == 0 {
+			if start[i] < lo || start[i] > hi {
+				return 0, false
+			}
+
+			continue
+		}
+
+		t1 := (lo - start[i]) / delta[i]
+		t2 := (hi - start[i]) / delta[i]
+
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+
+		enter = maxf(enter, t1)
+		leave = minf(leave, t2)
+
+		if enter > leave {
+			return 0, false
+		}
+	}
+
+	return enter, true
+}
+
+func minf(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxf(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,190 @@
+package collision_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// terrain returns a grid of n*n quads (2 triangles each) with random heights.
+func terrain(n int) [][3]mgl32.Vec3 {
+	rng := rand.New(rand.NewSource(1))
+	height := make([][]float32, n+1)
+
+	for i := range height {
+		height[i] = make([]float32, n+1)
+
+		for j := range height[i] {
+			height[i][j] = rng.Float32() * 8
+		}
+	}
+
+	var tris [][3]mgl32.Vec3
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			a := mgl32.Vec3{float32(i) * 16, float32(j) * 16, height[i][j]}
+			b := mgl32.Vec3{float32(i+1) * 16, float32(j) * 16, height[i+1][j]}
+			c := mgl32.Vec3{float32(i+1) * 16, float32(j+1) * 16, height[i+1][j+1]}
+			d := mgl32.Vec3{float32(i) * 16, float32(j+1) * 16, height[i][j+1]}
+
+			tris = append(tris, [3]mgl32.Vec3{a, b, c}, [3]mgl32.Vec3{a, c, d})
+		}
+	}
+
+	return tris
+}
+
+func closestLinear(tris [][3]mgl32.Vec3, start, end mgl32.Vec3) (r collision.RayCastResult) {
+	for _, t := range tris {
+		tr := collision.RayIntersectsTriangle(start, end.Sub(start), t)
+		if tr.Hit && tr.T <= 1 && (!r.Hit || tr.T < r.T) {
+			r = tr
+		}
+	}
+
+	return r
+}
+
+func closestBVH(bvh *collision.BVH, tris [][3]mgl32.Vec3, start, end mgl32.Vec3) (r collision.RayCastResult) {
+	bvh.Sweep(start, end, mgl32.Vec3{}, func(i int) float32 {
+		tr := collision.RayIntersectsTriangle(start, end.Sub(start), tris[i])
+		if tr.Hit && tr.T <= 1 && (!r.Hit || tr.T < r.T) {
+			r = tr
+		}
+
+		if r.Hit {
+			return float32(r.T)
+		}
+
+		return 1
+	})
+
+	return r
+}
+
+func TestBVH_Sweep(t *testing.T) {
+	t.Parallel()
+
+	tris := terrain(16)
+	bvh := collision.NewTriangleBVH(tris)
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 200; i++ {
+		start := mgl32.Vec3{rng.Float32() * 256, rng.Float32() * 256, 20}
+		end := mgl32.Vec3{rng.Float32() * 256, rng.Float32() * 256, -10}
+
+		want := closestLinear(tris, start, end)
+		got := closestBVH(&bvh, tris, start, end)
+
+		assert.Equal(t, want.Hit, got.Hit)
+		assert.InDelta(t, want.T, got.T, 0.00001)
+	}
+
+	// every box is visited once, and only the ones along the segment
+	var (
+		start, end = mgl32.Vec3{-10, 8, 4}, mgl32.Vec3{300, 8, 4}
+		extents    = mgl32.Vec3{1, 1, 1}
+		visited    = make(map[int]int)
+		expected   = make(map[int]int)
+	)
+
+	bvh.Sweep(start, end, extents, func(i int) float32 {
+		visited[i]++
+
+		return 1
+	})
+
+	for i, tri := range tris {
+		min, max := tri[0], tri[0]
+
+		for _, v := range tri {
+			for j := 0; j < 3; j++ {
+				if v[j] < min[j] {
+					min[j] = v[j]
+				}
+
+				if v[j] > max[j] {
+					max[j] = v[j]
+				}
+			}
+		}
+
+		if collision.SweepAxisAlignedBoundingBox(start, end, extents, min, max).Hit {
+			expected[i] = 1
+		}
+	}
+
+	assert.NotEmpty(t, expected)
+	assert.Equal(t, expected, visited)
+
+	var empty collision.BVH
+
+	empty.Sweep(mgl32.Vec3{}, mgl32.Vec3{1, 1, 1}, mgl32.Vec3{}, func(int) float32 {
+		t.Fail()
+
+		return 1
+	})
+}
+
+func BenchmarkClosestTriangle(b *testing.B) {
+	tris := terrain(32)
+	bvh := collision.NewTriangleBVH(tris)
+	start, end := mgl32.Vec3{1, 2, 50}, mgl32.Vec3{500, 480, -10}
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			closestLinear(tris, start, end)
+		}
+	})
+
+	b.Run("bvh", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			closestBVH(&bvh, tris, start, end)
+		}
+	})
+}
+
+func TestBVH_MarshalBinary(t *testing.T) {
+	t.Parallel()
+
+	tris := terrain(8)
+	bvh := collision.NewTriangleBVH(tris)
+
+	data, err := bvh.MarshalBinary()
+	assert.NoError(t, err)
+
+	var decoded collision.BVH
+
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, bvh, decoded)
+	assert.Equal(t, len(tris), decoded.Len())
+
+	start, end := mgl32.Vec3{1, 2, 50}, mgl32.Vec3{120, 110, -10}
+	assert.Equal(t, closestBVH(&bvh, tris, start, end), closestBVH(&decoded, tris, start, end))
+
+	// empty hierarchies
+	data, err = collision.BVH{}.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Zero(t, decoded.Len())
+
+	// truncated, trailing and corrupt data
+	data, err = bvh.MarshalBinary()
+	assert.NoError(t, err)
+
+	assert.Error(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+	assert.Error(t, decoded.UnmarshalBinary(append(append([]byte(nil), data...), 0)))
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[4+6*4] = 0xff // second child of the root
+	assert.Error(t, decoded.UnmarshalBinary(corrupt))
+
+	corrupt = append([]byte(nil), data...)
+	corrupt[len(data)-7*4] = 0xff // index of the last box
+	assert.Error(t, decoded.UnmarshalBinary(corrupt))
+}
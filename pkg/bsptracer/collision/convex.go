@@ -0,0 +1,282 @@
+package collision
+
+import (
+	"math"
+	"sort"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+// parallelEpsilon is the tolerance for treating two normalized directions as parallel.
+const parallelEpsilon = float32(0.00001)
+
+// ConvexHull is a convex polyhedron, e.g. a single solid of a physics model.
+type ConvexHull struct {
+	Vertices []mgl32.Vec3
+	Normals  []mgl32.Vec3 // unique face normals (either orientation), normalized
+	Edges    []mgl32.Vec3 // unique edge directions (either orientation), normalized
+	Min, Max mgl32.Vec3   // axis-aligned bounding box
+}
+
+// NewConvexHull creates a convex hull from the triangles of its surface.
+// The winding of the triangles doesn't matter.
+func NewConvexHull(triangles [][3]mgl32.Vec3) ConvexHull {
+	h := ConvexHull{
+		Min: mgl32.Vec3{mgl32.MaxValue, mgl32.MaxValue, mgl32.MaxValue},
+		Max: mgl32.Vec3{-mgl32.MaxValue, -mgl32.MaxValue, -mgl32.MaxValue},
+	}
+
+	for _, t := range triangles {
+		for i, v := range t {
+			h.Vertices = appendUnique(h.Vertices, v, func(a, b mgl32.Vec3) bool { return a == b })
+			h.Edges = appendDirection(h.Edges, t[(i+1)%3].Sub(v))
+
+			for j := 0; j < 3; j++ {
+				if v[j] < h.Min[j] {
+					h.Min[j] = v[j]
+				}
+
+				if v[j] > h.Max[j] {
+					h.Max[j] = v[j]
+				}
+			}
+		}
+
+		h.Normals = appendDirection(h.Normals, t[1].Sub(t[0]).Cross(t[2].Sub(t[0])))
+	}
+
+	return h
+}
+
+// NewConvexHullFromPoints creates the convex hull of a point cloud, e.g. the vertices of a render mesh.
+// It returns false if the points don't enclose a volume (fewer than 4 points or all of them on a plane).
+func NewConvexHullFromPoints(points []mgl32.Vec3) (ConvexHull, bool) {
+	tris := convexHullTriangles(points)
+	if tris == nil {
+		return ConvexHull{}, false
+	}
+
+	return NewConvexHull(tris), true
+}
+
+type hullFace struct {
+	v      [3]int // counter-clockwise seen from the outside
+	normal mgl64.Vec3
+	dist   float64
+}
+
+// convexHullTriangles returns the surface of the convex hull of points, built incrementally from a tetrahedron.
+// It returns nil if the points are coplanar.
+func convexHullTriangles(points []mgl32.Vec3) [][3]mgl32.Vec3 {
+	if len(points) < 4 {
+		return nil
+	}
+
+	pts := make([]mgl64.Vec3, len(points))
+	size := 1.0
+
+	for i, p := range points {
+		pts[i] = mgl64.Vec3{float64(p[0]), float64(p[1]), float64(p[2])}
+		size = math.Max(size, math.Max(math.Abs(pts[i][0]), math.Max(math.Abs(pts[i][1]), math.Abs(pts[i][2]))))
+	}
+
+	// points closer to a face than this are on the hull
+	eps := 1e-6 * size
+
+	farthest := func(dist func(p mgl64.Vec3) float64) (int, float64) {
+		best, bestDist := 0, -1.0
+
+		for i, p := range pts {
+			if d := dist(p); d > bestDist {
+				best, bestDist = i, d
+			}
+		}
+
+		return best, bestDist
+	}
+
+	a := 0
+	b, ab := farthest(func(p mgl64.Vec3) float64 { return p.Sub(pts[a]).Len() })
+	dirAB := pts[b].Sub(pts[a]).Normalize()
+	c, abc := farthest(func(p mgl64.Vec3) float64 { return dirAB.Cross(p.Sub(pts[a])).Len() })
+
+	if ab <= eps || abc <= eps {
+		return nil
+	}
+
+	n := dirAB.Cross(pts[c].Sub(pts[a])).Normalize()
+
+	d, abcd := farthest(func(p mgl64.Vec3) float64 { return math.Abs(n.Dot(p.Sub(pts[a]))) })
+	if abcd <= eps {
+		return nil
+	}
+
+	newFace := func(i, j, k int) hullFace {
+		n := pts[j].Sub(pts[i]).Cross(pts[k].Sub(pts[i])).Normalize()
+
+		return hullFace{v: [3]int{i, j, k}, normal: n, dist: n.Dot(pts[i])}
+	}
+
+	tetrahedron := [4]int{a, b, c, d}
+	faces := make([]hullFace, 0, 4)
+
+	for i, opposite := range tetrahedron {
+		f := newFace(tetrahedron[(i+1)%4], tetrahedron[(i+2)%4], tetrahedron[(i+3)%4])
+		if f.normal.Dot(pts[opposite]) > f.dist {
+			f = newFace(f.v[0], f.v[2], f.v[1])
+		}
+
+		faces = append(faces, f)
+	}
+
+	// add the farthest points first, points on the faces of the final hull are skipped then
+	center := pts[a].Add(pts[b]).Add(pts[c]).Add(pts[d]).Mul(0.25)
+	order := make([]int, len(pts))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return pts[order[i]].Sub(center).LenSqr() > pts[order[j]].Sub(center).LenSqr()
+	})
+
+	type edge [2]int
+
+	for _, i := range order {
+		p := pts[i]
+
+		var (
+			visible []hullFace
+			kept    []hullFace
+		)
+
+		for _, f := range faces {
+			if f.normal.Dot(p)-f.dist > eps {
+				visible = append(visible, f)
+			} else {
+				kept = append(kept, f)
+			}
+		}
+
+		if len(visible) == 0 {
+			continue // inside
+		}
+
+		edges := make(map[edge]bool, 3*len(visible))
+
+		for _, f := range visible {
+			for k := 0; k < 3; k++ {
+				edges[edge{f.v[k], f.v[(k+1)%3]}] = true
+			}
+		}
+
+		// the horizon consists of the edges between visible and hidden faces, connect them to the new point
+		for _, f := range visible {
+			for k := 0; k < 3; k++ {
+				if e := (edge{f.v[k], f.v[(k+1)%3]}); !edges[edge{e[1], e[0]}] {
+					kept = append(kept, newFace(e[0], e[1], i))
+				}
+			}
+		}
+
+		faces = kept
+	}
+
+	res := make([][3]mgl32.Vec3, len(faces))
+
+	for i, f := range faces {
+		for j, v := range f.v {
+			res[i][j] = points[v]
+		}
+	}
+
+	return res
+}
+
+func appendUnique(s []mgl32.Vec3, v mgl32.Vec3, equal func(a, b mgl32.Vec3) bool) []mgl32.Vec3 {
+	for _, x := range s {
+		if equal(x, v) {
+			return s
+		}
+	}
+
+	return append(s, v)
+}
+
+// appendDirection appends the normalized direction d unless it (or its opposite) is already in s.
+func appendDirection(s []mgl32.Vec3, d mgl32.Vec3) []mgl32.Vec3 {
+	if d.LenSqr() < mollerTrumboreEpsilon {
+		return s // degenerate
+	}
+
+	return appendUnique(s, d.Normalize(), func(a, b mgl32.Vec3) bool {
+		return abs(a.Dot(b)) > 1-parallelEpsilon
+	})
+}
+
+// project returns the interval of the hull on axis.
+func (h ConvexHull) project(axis mgl32.Vec3) (lo, hi float32) {
+	lo, hi = mgl32.MaxValue, -mgl32.MaxValue
+
+	for _, v := range h.Vertices {
+		d := axis.Dot(v)
+
+		if d < lo {
+			lo = d
+		}
+
+		if d > hi {
+			hi = d
+		}
+	}
+
+	return lo, hi
+}
+
+// Contains returns true if the point is inside of the hull.
+func (h ConvexHull) Contains(p mgl32.Vec3) bool {
+	if len(h.Vertices) == 0 {
+		return false
+	}
+
+	for _, n := range h.Normals {
+		lo, hi := h.project(n)
+
+		if d := n.Dot(p); d < lo || d > hi {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SweepConvexHull sweeps an axis-aligned box with half-size extents from start to end against a convex hull.
+// For rays extents is zero, then only the face normals of the hull need to be tested.
+// T of the result is the fraction of the segment at which the box first touches the hull,
+// it is 0 if the segment starts inside of the hull.
+// The exit fraction can be found by sweeping from end to start.
+func SweepConvexHull(start, end, extents mgl32.Vec3, hull ConvexHull) RayCastResult {
+	if len(hull.Vertices) == 0 {
+		return RayCastResult{}
+	}
+
+	axes := hull.Normals
+
+	if extents != (mgl32.Vec3{}) {
+		boxAxes := [3]mgl32.Vec3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+		axes = make([]mgl32.Vec3, 0, len(hull.Normals)+3+3*len(hull.Edges))
+		axes = append(axes, hull.Normals...)
+		axes = append(axes, boxAxes[:]...)
+
+		for _, a := range boxAxes {
+			for _, e := range hull.Edges {
+				axes = append(axes, a.Cross(e))
+			}
+		}
+	}
+
+	return sweepSeparatingAxes(start, end, extents, axes, hull.project)
+}
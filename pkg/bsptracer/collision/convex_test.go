@@ -0,0 +1,138 @@
+package collision_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// octahedron returns the triangles of |x| + |y| + |z| <= r, with mixed winding.
+func octahedron(r float32) [][3]mgl32.Vec3 {
+	var tris [][3]mgl32.Vec3
+
+	for _, x := range []float32{-r, r} {
+		for _, y := range []float32{-r, r} {
+			for _, z := range []float32{-r, r} {
+				tris = append(tris, [3]mgl32.Vec3{{x, 0, 0}, {0, y, 0}, {0, 0, z}})
+			}
+		}
+	}
+
+	return tris
+}
+
+func TestSweepConvexHull(t *testing.T) {
+	t.Parallel()
+
+	hull := collision.NewConvexHull(octahedron(10))
+
+	assert.Len(t, hull.Vertices, 6)
+	assert.Len(t, hull.Normals, 4)
+	assert.Equal(t, mgl32.Vec3{-10, -10, -10}, hull.Min)
+	assert.Equal(t, mgl32.Vec3{10, 10, 10}, hull.Max)
+
+	r := collision.SweepConvexHull(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{}, hull)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.4, r.T, 0.0001)
+
+	// exit by sweeping backwards
+	r = collision.SweepConvexHull(mgl32.Vec3{50, 8, 0}, mgl32.Vec3{-50, 8, 0}, mgl32.Vec3{}, hull)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.48, r.T, 0.0001)
+	assert.Greater(t, r.Normal[0], float32(0))
+
+	// inside of the bounding box, but outside of the hull
+	r = collision.SweepConvexHull(mgl32.Vec3{-50, 8, 8}, mgl32.Vec3{50, 8, 8}, mgl32.Vec3{}, hull)
+	assert.False(t, r.Hit)
+
+	r = collision.SweepConvexHull(mgl32.Vec3{-50, 8, 8}, mgl32.Vec3{50, 8, 8}, mgl32.Vec3{5, 5, 5}, hull)
+	assert.True(t, r.Hit)
+
+	// starts inside
+	r = collision.SweepConvexHull(mgl32.Vec3{1, 1, 1}, mgl32.Vec3{50, 0, 0}, mgl32.Vec3{}, hull)
+	assert.True(t, r.Hit)
+	assert.Zero(t, r.T)
+
+	// ends before the hull
+	r = collision.SweepConvexHull(mgl32.Vec3{-50, 0, 0}, mgl32.Vec3{-20, 0, 0}, mgl32.Vec3{}, hull)
+	assert.False(t, r.Hit)
+}
+
+func TestConvexHull_Contains(t *testing.T) {
+	t.Parallel()
+
+	hull := collision.NewConvexHull(octahedron(10))
+
+	assert.True(t, hull.Contains(mgl32.Vec3{1, 1, 1}))
+	assert.True(t, hull.Contains(mgl32.Vec3{0, 0, 10}))
+	assert.False(t, hull.Contains(mgl32.Vec3{6, 6, 0}))
+	assert.False(t, collision.ConvexHull{}.Contains(mgl32.Vec3{}))
+}
+
+func TestNewConvexHullFromPoints(t *testing.T) {
+	t.Parallel()
+
+	// corners of a cube, points inside and on the surface
+	points := []mgl32.Vec3{{0, 0, 0}, {5, 5, 5}, {10, 5, 5}, {5, 5, 10}, {3, 10, 7}}
+	for _, x := range []float32{0, 10} {
+		for _, y := range []float32{0, 10} {
+			for _, z := range []float32{0, 10} {
+				points = append(points, mgl32.Vec3{x, y, z})
+			}
+		}
+	}
+
+	hull, ok := collision.NewConvexHullFromPoints(points)
+	assert.True(t, ok)
+	assert.Len(t, hull.Vertices, 8)
+	assert.Len(t, hull.Normals, 3)
+	assert.Equal(t, mgl32.Vec3{0, 0, 0}, hull.Min)
+	assert.Equal(t, mgl32.Vec3{10, 10, 10}, hull.Max)
+
+	for _, p := range points {
+		assert.True(t, hull.Contains(p), "%v", p)
+	}
+
+	r := collision.SweepConvexHull(mgl32.Vec3{-10, 5, 5}, mgl32.Vec3{10, 5, 5}, mgl32.Vec3{}, hull)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, 0.5, r.T, 1e-5)
+
+	// a non-convex mesh, a ray through the gap between its spikes hits the hull only
+	octa := octahedron(10)
+	spikes := []mgl32.Vec3{{-20, 0, 0}, {20, 0, 0}}
+	for _, tri := range octa {
+		spikes = append(spikes, tri[:]...)
+	}
+
+	hull, ok = collision.NewConvexHullFromPoints(spikes)
+	assert.True(t, ok)
+	assert.Len(t, hull.Vertices, 6)
+	assert.True(t, hull.Contains(mgl32.Vec3{15, 2, 0}))
+	assert.False(t, hull.Contains(mgl32.Vec3{15, 4, 0}))
+
+	// random points are all inside of their hull
+	rng := rand.New(rand.NewSource(1))
+	cloud := make([]mgl32.Vec3, 500)
+
+	for i := range cloud {
+		cloud[i] = mgl32.Vec3{rng.Float32()*100 - 50, rng.Float32()*20 - 10, rng.Float32() * 5}
+	}
+
+	hull, ok = collision.NewConvexHullFromPoints(cloud)
+	assert.True(t, ok)
+	assert.Less(t, len(hull.Vertices), len(cloud))
+
+	for _, p := range cloud {
+		assert.True(t, hull.Contains(p), "%v", p)
+	}
+
+	_, ok = collision.NewConvexHullFromPoints([]mgl32.Vec3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {1, 1, 0}, {2, 3, 0}})
+	assert.False(t, ok, "coplanar")
+
+	_, ok = collision.NewConvexHullFromPoints([]mgl32.Vec3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}})
+	assert.False(t, ok, "too few points")
+}
@@ -0,0 +1,87 @@
+package collision
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// OrientedBoundingBox is a box that is rotated arbitrarily.
+type OrientedBoundingBox struct {
+	Center  mgl32.Vec3
+	Axes    [3]mgl32.Vec3 // local x, y and z axes in world space, must be normalized
+	Extents mgl32.Vec3    // half size along Axes
+}
+
+// NewOrientedBoundingBox creates an oriented bounding box from a box in local space (min / max)
+// that is rotated by rotation (local to world) and moved to origin.
+func NewOrientedBoundingBox(min, max, origin mgl32.Vec3, rotation mgl32.Mat3) OrientedBoundingBox {
+	center := min.Add(max).Mul(0.5)
+
+	return OrientedBoundingBox{
+		Center:  rotation.Mul3x1(center).Add(origin),
+		Axes:    [3]mgl32.Vec3{rotation.Col(0), rotation.Col(1), rotation.Col(2)},
+		Extents: max.Sub(min).Mul(0.5),
+	}
+}
+
+// Bounds returns the axis-aligned bounding box of the oriented box.
+func (b OrientedBoundingBox) Bounds() (min, max mgl32.Vec3) {
+	var extents mgl32.Vec3
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			extents[i] += abs(b.Axes[j][i] * b.Extents[j])
+		}
+	}
+
+	return b.Center.Sub(extents), b.Center.Add(extents)
+}
+
+// Contains returns true if the point is inside of the box.
+func (b OrientedBoundingBox) Contains(p mgl32.Vec3) bool {
+	d := p.Sub(b.Center)
+
+	for i, axis := range b.Axes {
+		if abs(axis.Dot(d)) > b.Extents[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SweepOrientedBoundingBox sweeps an axis-aligned box with half-size extents from start to end
+// against an oriented bounding box. For rays extents is zero.
+// It uses the 15 separating axes of two boxes (the faces of both boxes and their edge cross products).
+// T of the result is the fraction of the segment at which the box first touches the oriented box.
+func SweepOrientedBoundingBox(start, end, extents mgl32.Vec3, obb OrientedBoundingBox) RayCastResult {
+	boxAxes := [3]mgl32.Vec3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+	var (
+		axes    [15]mgl32.Vec3
+		numAxes int
+	)
+
+	for _, a := range obb.Axes {
+		axes[numAxes] = a
+		numAxes++
+	}
+
+	for _, a := range boxAxes {
+		axes[numAxes] = a
+		numAxes++
+
+		for _, b := range obb.Axes {
+			axes[numAxes] = a.Cross(b)
+			numAxes++
+		}
+	}
+
+	return sweepSeparatingAxes(start, end, extents, axes[:numAxes], func(axis mgl32.Vec3) (lo, hi float32) {
+		c := axis.Dot(obb.Center)
+		radius := abs(axis.Dot(obb.Axes[0]))*obb.Extents[0] +
+			abs(axis.Dot(obb.Axes[1]))*obb.Extents[1] +
+			abs(axis.Dot(obb.Axes[2]))*obb.Extents[2]
+
+		return c - radius, c + radius
+	})
+}
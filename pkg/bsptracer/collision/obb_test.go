@@ -0,0 +1,64 @@
+package collision_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+const sqrt2 = float32(math.Sqrt2)
+
+func TestSweepOrientedBoundingBox(t *testing.T) {
+	t.Parallel()
+
+	// 40x10x10 box rotated by 45° around z
+	rotation := mgl32.Rotate3DZ(mgl32.DegToRad(45))
+	obb := collision.NewOrientedBoundingBox(mgl32.Vec3{-20, -5, -5}, mgl32.Vec3{20, 5, 5}, mgl32.Vec3{100, 0, 0}, rotation)
+
+	// straight through the center, the box is 10 / sin(45°) wide along x
+	r := collision.SweepOrientedBoundingBox(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{200, 0, 0}, mgl32.Vec3{}, obb)
+	assert.True(t, r.Hit)
+	assert.InDelta(t, (100-5*sqrt2)/200, r.T, 0.0001)
+	assert.InDelta(t, -sqrt2/2, r.Normal[0], 0.0001)
+
+	// would hit the axis-aligned bounds, but not the rotated box
+	min, max := obb.Bounds()
+	assert.InDelta(t, 100-25/sqrt2, min[0], 0.0001)
+	assert.InDelta(t, 100+25/sqrt2, max[0], 0.0001)
+
+	// parallel to the long side, ~7 units away
+	start, end := mgl32.Vec3{80, -30, 0}, mgl32.Vec3{130, 20, 0}
+
+	r = collision.SweepOrientedBoundingBox(start, end, mgl32.Vec3{}, obb)
+	assert.False(t, r.Hit)
+
+	aabb := collision.SweepAxisAlignedBoundingBox(start, end, mgl32.Vec3{}, min, max)
+	assert.True(t, aabb.Hit)
+
+	// a swept box is big enough to touch it
+	r = collision.SweepOrientedBoundingBox(start, end, mgl32.Vec3{5, 5, 5}, obb)
+	assert.True(t, r.Hit)
+
+	// starts inside
+	r = collision.SweepOrientedBoundingBox(mgl32.Vec3{100, 0, 0}, mgl32.Vec3{200, 0, 0}, mgl32.Vec3{}, obb)
+	assert.True(t, r.Hit)
+	assert.Zero(t, r.T)
+
+	// misses along z
+	r = collision.SweepOrientedBoundingBox(mgl32.Vec3{0, 0, 6}, mgl32.Vec3{200, 0, 6}, mgl32.Vec3{}, obb)
+	assert.False(t, r.Hit)
+}
+
+func TestOrientedBoundingBox_Contains(t *testing.T) {
+	t.Parallel()
+
+	// yaw only, 90° turns the long side to y
+	obb := collision.NewOrientedBoundingBox(mgl32.Vec3{-20, -5, -5}, mgl32.Vec3{20, 5, 5}, mgl32.Vec3{}, mgl32.Rotate3DZ(mgl32.DegToRad(90)))
+
+	assert.True(t, obb.Contains(mgl32.Vec3{0, 15, 0}))
+	assert.False(t, obb.Contains(mgl32.Vec3{15, 0, 0}))
+}
@@ -9,9 +9,10 @@ import (
 const mollerTrumboreEpsilon = float32(0.0000001)
 
 type RayCastResult struct {
-	T     float64
-	Hit   bool
-	Point mgl32.Vec3
+	T      float64
+	Hit    bool
+	Point  mgl32.Vec3
+	Normal mgl32.Vec3 // surface normal at Point, facing against the ray
 }
 
 // RayIntersectsAxisAlignedBoundingBox determines whether ray intersects an axis-aligned bounding box.
@@ -106,7 +107,13 @@ func RayIntersectsTriangle(rayOrigin mgl32.Vec3, rayVector mgl32.Vec3, inTriangl
 
 	if t > mollerTrumboreEpsilon { // ray intersection
 		r.Hit = true
+		r.T = float64(t)
 		r.Point = rayOrigin.Add(rayVector.Mul(t))
+		r.Normal = edge1.Cross(edge2).Normalize()
+
+		if r.Normal.Dot(rayVector) > 0 {
+			r.Normal = r.Normal.Mul(-1)
+		}
 
 		return r
 	}
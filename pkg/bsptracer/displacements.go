@@ -0,0 +1,218 @@
+package bsptracer
+
+import (
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/lumps"
+	"github.com/galaco/bsp/primitives/node"
+	"github.com/galaco/bsp/primitives/plane"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// displacement triangle tags, see DISPTRI_* in the Source SDK's bspfile.h
+const (
+	DispTriTagSurface    = 1 << 0
+	DispTriTagWalkable   = 1 << 1
+	DispTriTagBuildable  = 1 << 2
+	DispTriFlagSurfProp1 = 1 << 3
+	DispTriFlagSurfProp2 = 1 << 4
+	DispTriTagRemove     = 1 << 5
+)
+
+// displacement flags, stored in DispInfo.MinTess if dispInfoFlagMagic is set
+const (
+	dispInfoFlagNoHull = 1 << 2
+	dispInfoFlagNoRay  = 1 << 3
+	dispInfoFlagMagic  = 1 << 31
+)
+
+type displacement struct {
+	index     int // index in Map.displacements
+	triangles [][3]mgl32.Vec3
+	tree      collision.BVH // over triangles
+	tags      []uint16
+	contents  int32
+	flags     uint32
+	face      uint16
+	min, max  mgl32.Vec3 // AABB extents
+}
+
+// dispCorners returns the four corners of the displacement's base face,
+// rotated so that the corner closest to start comes first.
+func dispCorners(bspfile *bsp.Bsp, faceIndex uint16, start mgl32.Vec3) (corners [4]mgl32.Vec3, ok bool) {
+	surfaces := bspfile.Lump(bsp.LumpFaces).(*lumps.Face).GetData()
+	surfEdges := bspfile.Lump(bsp.LumpSurfEdges).(*lumps.Surfedge).GetData()
+	vertices := bspfile.Lump(bsp.LumpVertexes).(*lumps.Vertex).GetData()
+	edges := bspfile.Lump(bsp.LumpEdges).(*lumps.Edge).GetData()
+
+	if int(faceIndex) >= len(surfaces) {
+		return corners, false
+	}
+
+	surface := surfaces[faceIndex]
+	if surface.NumEdges != 4 {
+		return corners, false
+	}
+
+	var verts [4]mgl32.Vec3
+
+	for i := 0; i < 4; i++ {
+		edgeIndex := surfEdges[int(surface.FirstEdge)+i]
+		if edgeIndex >= 0 {
+			verts[i] = vertices[edges[edgeIndex][0]]
+		} else {
+			verts[i] = vertices[edges[-edgeIndex][1]]
+		}
+	}
+
+	first := 0
+	minDist := float32(mgl32.MaxValue)
+
+	for i, v := range verts {
+		d := v.Sub(start).LenSqr()
+		if d < minDist {
+			minDist = d
+			first = i
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		corners[i] = verts[(first+i)%4]
+	}
+
+	return corners, true
+}
+
+func buildDisplacements(bspfile *bsp.Bsp) []displacement {
+	dispInfos := bspfile.Lump(bsp.LumpDispInfo).(*lumps.DispInfo).GetData()
+	dispVerts := bspfile.Lump(bsp.LumpDispVerts).(*lumps.DispVert).GetData()
+	dispTris := bspfile.Lump(bsp.LumpDispTris).(*lumps.DispTris).GetData()
+
+	disps := make([]displacement, 0, len(dispInfos))
+
+	for _, info := range dispInfos {
+		corners, ok := dispCorners(bspfile, info.MapFace, info.StartPosition)
+		if !ok {
+			continue
+		}
+
+		size := (1 << info.Power) + 1
+		verts := make([]mgl32.Vec3, size*size)
+
+		// same layout as CCoreDispInfo::GenerateDispSurf
+		for row := 0; row < size; row++ {
+			rowFraction := float32(row) / float32(size-1)
+			rowStart := corners[0].Add(corners[1].Sub(corners[0]).Mul(rowFraction))
+			rowEnd := corners[3].Add(corners[2].Sub(corners[3]).Mul(rowFraction))
+
+			for col := 0; col < size; col++ {
+				index := row*size + col
+				colFraction := float32(col) / float32(size-1)
+				dv := dispVerts[int(info.DispVertStart)+index]
+
+				verts[index] = rowStart.Add(rowEnd.Sub(rowStart).Mul(colFraction)).Add(dv.Vec.Mul(dv.Dist))
+			}
+		}
+
+		disp := displacement{
+			index:     len(disps),
+			triangles: make([][3]mgl32.Vec3, 0, 2*(size-1)*(size-1)),
+			tags:      make([]uint16, 0, 2*(size-1)*(size-1)),
+			contents:  info.Contents,
+			face:      info.MapFace,
+		}
+
+		if uint32(info.MinTess)&dispInfoFlagMagic != 0 {
+			disp.flags = uint32(info.MinTess)
+		}
+
+		// same winding as CCoreDispInfo::GetTriIndices
+		for row := 0; row < size-1; row++ {
+			for col := 0; col < size-1; col++ {
+				index := row*size + col
+
+				var quad [2][3]int
+				if index%2 == 1 {
+					quad = [2][3]int{{index, index + size, index + 1}, {index + 1, index + size, index + size + 1}}
+				} else {
+					quad = [2][3]int{{index, index + size, index + size + 1}, {index, index + size + 1, index + 1}}
+				}
+
+				for i, tri := range quad {
+					tag := dispTris[int(info.DispTriStart)+2*(row*(size-1)+col)+i].Tags
+					if tag&DispTriTagRemove != 0 {
+						continue
+					}
+
+					disp.triangles = append(disp.triangles, [3]mgl32.Vec3{verts[tri[0]], verts[tri[1]], verts[tri[2]]})
+					disp.tags = append(disp.tags, tag)
+				}
+			}
+		}
+
+		disp.min, disp.max = extents(disp.triangles)
+		disp.tree = collision.NewTriangleBVH(disp.triangles)
+
+		disps = append(disps, disp)
+	}
+
+	return disps
+}
+
+func displacementsByLeaf(nodes []node.Node, planes []plane.Plane, disps []displacement) map[uint16][]*displacement {
+	res := make(map[uint16][]*displacement)
+
+	for i := range disps {
+		disp := &disps[i]
+
+		for _, leafIndex := range leavesInBox(nodes, planes, disp.min, disp.max) {
+			res[leafIndex] = append(res[leafIndex], disp)
+		}
+	}
+
+	return res
+}
+
+// leavesInBox returns the indices of all leaves touched by the given AABB.
+func leavesInBox(nodes []node.Node, planes []plane.Plane, min, max mgl32.Vec3) []uint16 {
+	var (
+		res   []uint16
+		stack = []int32{0}
+	)
+
+	for len(stack) > 0 {
+		nodeIndex := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if nodeIndex < 0 {
+			res = append(res, uint16(-nodeIndex-1))
+
+			continue
+		}
+
+		n := nodes[nodeIndex]
+		p := planes[n.PlaneNum]
+
+		var near, far float32
+
+		for i := 0; i < 3; i++ {
+			if p.Normal[i] >= 0 {
+				near += p.Normal[i] * min[i]
+				far += p.Normal[i] * max[i]
+			} else {
+				near += p.Normal[i] * max[i]
+				far += p.Normal[i] * min[i]
+			}
+		}
+
+		if far >= p.Distance {
+			stack = append(stack, n.Children[0])
+		}
+
+		if near < p.Distance {
+			stack = append(stack, n.Children[1])
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,223 @@
+package bsptracer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/galaco/bsp"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// DynamicProp is a prop entity (prop_dynamic*, prop_physics* or prop_door_rotating).
+type DynamicProp struct {
+	Entity     int32      // index in the entities lump
+	ClassName  string     // e.g. "prop_door_rotating"
+	TargetName string     // name of the entity, may be empty
+	Model      string     // e.g. "models/props/de_nuke/hr_nuke/nuke_door/nuke_door.mdl"
+	Origin     mgl32.Vec3 // position of the prop
+	Angles     mgl32.Vec3 // orientation of the prop (pitch, yaw, roll in degrees)
+	Scale      float32    // modelscale of the prop
+	Solid      int        // Solid*
+	Enabled    bool       // disabled (removed) props are ignored by traces
+
+	// ModelMissing is true if the model couldn't be loaded, the prop doesn't collide then.
+	// Unlike missing static prop models, these aren't part of MissingModelsError.
+	ModelMissing bool
+
+	// CollisionFallback is true if the prop is SolidVPhysics but its model has no physics data,
+	// its collision is defined by LoadOptions.PhysicsFallback then.
+	CollisionFallback bool
+}
+
+type dynamicProp struct {
+	DynamicProp
+	propCollision
+
+	model           *model
+	physicsFallback PhysicsFallback
+}
+
+func isDynamicPropClass(className string) bool {
+	return strings.HasPrefix(className, "prop_dynamic") ||
+		strings.HasPrefix(className, "prop_physics") ||
+		className == "prop_door_rotating"
+}
+
+// loadDynamicProps loads the models of all prop entities.
+// models are the already loaded (static prop) models by name, they are reused and new models are added.
+// Props with models that couldn't be loaded have ModelMissing set.
+func loadDynamicProps(fs ModelSource, entities []Entity, models map[string]*model, fallback PhysicsFallback) []dynamicProp {
+	var res []dynamicProp
+
+	for _, ent := range entities {
+		className := ent.ClassName()
+		if !isDynamicPropClass(className) || ent.Model() == "" {
+			continue
+		}
+
+		name := ent.Model()
+
+		mdl, ok := models[name]
+		if !ok {
+			mdl, _ = loadModel(fs, name) // nil if the model is missing
+			models[name] = mdl
+		}
+
+		solid := SolidVPhysics
+		if s, err := strconv.Atoi(ent.Get("solid")); err == nil {
+			solid = s
+		}
+
+		p := dynamicProp{
+			DynamicProp: DynamicProp{
+				Entity:     ent.Index,
+				ClassName:  className,
+				TargetName: ent.TargetName(),
+				Model:      name,
+				Origin:     ent.Origin(),
+				Angles:     ent.Angles(),
+				Scale:      parseFloat32(ent.Get("modelscale"), 1),
+				Solid:      solid,
+				Enabled:    solid != SolidNone && ent.Get("StartDisabled") != "1",
+
+				ModelMissing: mdl == nil,
+			},
+			model:           mdl,
+			physicsFallback: fallback,
+		}
+
+		p.updateTransform()
+
+		res = append(res, p)
+	}
+
+	return res
+}
+
+// updateTransform places the collision model after Origin, Angles or Scale changed.
+func (p *dynamicProp) updateTransform() {
+	p.propCollision = newPropCollision(p.Solid, p.model, p.Origin, p.Angles, p.Scale, p.physicsFallback)
+	p.CollisionFallback = p.fallback
+}
+
+// touches returns true if the swept box of the trace may touch the prop.
+func (p *propCollision) touches(ti *traceInfo) bool {
+	switch p.effectiveSolid() {
+	case SolidNone:
+		return false
+
+	case SolidVPhysics:
+		if len(p.hulls) == 0 && len(p.triangles) == 0 {
+			return false
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		lo, hi := ti.start[i], ti.end[i]
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+
+		if hi+ti.extents[i] < p.min[i] || lo-ti.extents[i] > p.max[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// traceDynamicProps traces against all enabled dynamic props.
+func (m Map) traceDynamicProps(ti *traceInfo, out *Trace) {
+	if ti.mask&bsp.CONTENTS_SOLID == 0 {
+		return
+	}
+
+	for i := range m.dynamicProps {
+		p := &m.dynamicProps[i]
+
+		if !p.Enabled || !p.touches(ti) {
+			continue
+		}
+
+		r := p.rayCast(ti)
+
+		if r.Hit && float32(r.T) < out.Fraction {
+			out.Fraction = float32(r.T)
+			out.Contents = bsp.CONTENTS_SOLID
+			out.setHit(HitDynamicProp)
+			out.Plane = ti.hitPlane(r)
+			out.Model = p.Model
+			out.Entity = p.Entity
+
+			if p.model != nil {
+				out.Surface.SurfaceProp = p.model.surfaceProp
+			}
+		}
+
+		if out.Fraction == 0 {
+			return
+		}
+	}
+}
+
+// intersectDynamicProps returns the intersections of the trace with all enabled dynamic props.
+func (m Map) intersectDynamicProps(ti *traceInfo) []Intersection {
+	if ti.mask&bsp.CONTENTS_SOLID == 0 {
+		return nil
+	}
+
+	var res []Intersection
+
+	for i := range m.dynamicProps {
+		p := &m.dynamicProps[i]
+
+		if !p.Enabled || !p.touches(ti) {
+			continue
+		}
+
+		base := Intersection{
+			Kind:     HitDynamicProp,
+			Contents: bsp.CONTENTS_SOLID,
+			Model:    p.Model,
+			Entity:   p.Entity,
+		}
+
+		if p.model != nil {
+			base.EnterSurface.SurfaceProp = p.model.surfaceProp
+			base.ExitSurface.SurfaceProp = p.model.surfaceProp
+		}
+
+		res = append(res, p.intersect(ti, base)...)
+	}
+
+	return res
+}
+
+// DynamicProps returns all prop entities of the map, indices match SetDynamicPropTransform and SetDynamicPropEnabled.
+func (m Map) DynamicProps() []DynamicProp {
+	res := make([]DynamicProp, len(m.dynamicProps))
+
+	for i, p := range m.dynamicProps {
+		res[i] = p.DynamicProp
+	}
+
+	return res
+}
+
+// SetDynamicPropTransform moves the prop at index (see DynamicProps), e.g. to the state of a door at a given demo tick.
+// This affects all copies of the Map and must not be called concurrently with traces.
+func (m Map) SetDynamicPropTransform(index int, origin, angles mgl32.Vec3, scale float32) {
+	p := &m.dynamicProps[index]
+	p.Origin = origin
+	p.Angles = angles
+	p.Scale = scale
+
+	p.updateTransform()
+}
+
+// SetDynamicPropEnabled adds or removes the prop at index (see DynamicProps) to / from traces,
+// e.g. when a prop_physics_multiplayer was destroyed.
+// This affects all copies of the Map and must not be called concurrently with traces.
+func (m Map) SetDynamicPropEnabled(index int, enabled bool) {
+	m.dynamicProps[index].Enabled = enabled
+}
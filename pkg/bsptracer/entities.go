@@ -1,38 +1,412 @@
 package bsptracer
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/galaco/bsp"
 	"github.com/galaco/bsp/lumps"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
 )
 
-func parseEntities(bspfile *bsp.Bsp) []map[string]string {
-	str := bspfile.Lump(bsp.LumpEntities).(*lumps.EntData).GetData()
+// KeyValue is a single key-value pair of an entity.
+type KeyValue struct {
+	Key   string
+	Value string
+}
 
-	blocks := strings.Split(str, "}")
-	entities := make([]map[string]string, 0, len(blocks))
+// Entity is an entity of the entities lump, e.g. info_player_terrorist or func_bomb_target.
+type Entity struct {
+	Index     int32      // index in the entities lump, see Trace.Entity, DynamicProp.Entity and BrushEntity.Entity
+	KeyValues []KeyValue // in the order of the lump, keys can occur multiple times (e.g. outputs)
+}
 
-	for _, block := range blocks {
-		block = strings.TrimPrefix(strings.TrimSpace(block), "{")
-		kvEntry := strings.Split(block, "\n")
+// Get returns the value of the first key-value with the given key (case-insensitive) or "".
+func (e Entity) Get(key string) string {
+	v, _ := e.Lookup(key)
 
-		data := make(map[string]string)
+	return v
+}
 
-		for _, entry := range kvEntry {
-			kv := strings.Split(entry, "\"")
-			if len(kv) != 4 {
-				continue
-			}
+// Lookup is like Get but also returns whether the key exists.
+func (e Entity) Lookup(key string) (string, bool) {
+	for _, kv := range e.KeyValues {
+		if strings.EqualFold(kv.Key, key) {
+			return kv.Value, true
+		}
+	}
+
+	return "", false
+}
 
-			k := kv[1]
-			v := kv[3]
+// GetAll returns the values of all key-values with the given key (case-insensitive).
+func (e Entity) GetAll(key string) []string {
+	var res []string
 
-			data[k] = v
+	for _, kv := range e.KeyValues {
+		if strings.EqualFold(kv.Key, key) {
+			res = append(res, kv.Value)
 		}
+	}
+
+	return res
+}
+
+// ClassName returns the classname, e.g. "info_player_counterterrorist".
+func (e Entity) ClassName() string {
+	return e.Get("classname")
+}
+
+// TargetName returns the name of the entity that is used to reference it in connections, may be empty.
+func (e Entity) TargetName() string {
+	return e.Get("targetname")
+}
+
+// Model returns the model, either a studio model (e.g. "models/props/crate.mdl") or a brush model ("*12").
+func (e Entity) Model() string {
+	return e.Get("model")
+}
+
+// Origin returns the position of the entity.
+func (e Entity) Origin() mgl32.Vec3 {
+	return parseVec3(e.Get("origin"))
+}
 
-		entities = append(entities, data)
+// Angles returns the orientation (pitch, yaw, roll) of the entity.
+// Like in the engine, the "angle" key (yaw only, -1 for up and -2 for down) is used if "angles" isn't set.
+func (e Entity) Angles() mgl32.Vec3 {
+	if angles, ok := e.Lookup("angles"); ok {
+		return parseVec3(angles)
 	}
 
+	angle, ok := e.Lookup("angle")
+	if !ok {
+		return mgl32.Vec3{}
+	}
+
+	switch yaw := parseFloat32(angle, 0); yaw {
+	case -1:
+		return mgl32.Vec3{-90, 0, 0}
+	case -2:
+		return mgl32.Vec3{90, 0, 0}
+	default:
+		return mgl32.Vec3{0, yaw, 0}
+	}
+}
+
+// SpawnFlags returns the spawnflags bit field, the meaning of the bits depends on the class.
+func (e Entity) SpawnFlags() int {
+	flags, _ := strconv.Atoi(strings.TrimSpace(e.Get("spawnflags")))
+
+	return flags
+}
+
+// HasSpawnFlags returns true if all bits of flags are set in SpawnFlags.
+func (e Entity) HasSpawnFlags(flags int) bool {
+	return e.SpawnFlags()&flags == flags
+}
+
+// Connection is an output of an entity that fires an input of other entities,
+// e.g. "OnTrigger" "door,Open,,0,-1".
+type Connection struct {
+	Output      string  // e.g. "OnTrigger"
+	Target      string  // targetname or classname of the receiving entities, may contain wildcards (e.g. "door*")
+	Input       string  // e.g. "Open"
+	Parameter   string  // may be empty
+	Delay       float32 // in seconds
+	TimesToFire int     // -1 for unlimited
+}
+
+// Connections returns all outputs of the entity in the order of the lump.
+// Values are separated by ESC (0x1b) or, in older maps, by commas.
+func (e Entity) Connections() []Connection {
+	var res []Connection
+
+	for _, kv := range e.KeyValues {
+		if c, ok := parseConnection(kv); ok {
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+func parseConnection(kv KeyValue) (Connection, bool) {
+	sep := ","
+	if strings.Contains(kv.Value, "\x1b") {
+		sep = "\x1b"
+	}
+
+	fields := strings.Split(kv.Value, sep)
+	if len(fields) != 5 {
+		return Connection{}, false
+	}
+
+	delay, err := strconv.ParseFloat(strings.TrimSpace(fields[3]), 32)
+	if err != nil {
+		return Connection{}, false
+	}
+
+	timesToFire, err := strconv.Atoi(strings.TrimSpace(fields[4]))
+	if err != nil {
+		return Connection{}, false
+	}
+
+	return Connection{
+		Output:      kv.Key,
+		Target:      fields[0],
+		Input:       fields[1],
+		Parameter:   fields[2],
+		Delay:       float32(delay),
+		TimesToFire: timesToFire,
+	}, true
+}
+
+// Entities returns all entities of the map, Entities()[i].Index == i.
+// The entities share their key-values with the map, they must not be modified.
+func (m Map) Entities() []Entity {
+	return append([]Entity(nil), m.entities...)
+}
+
+// FindByClassname returns all entities with the given classname (case-insensitive).
+// Like in the engine, a trailing '*' matches any suffix, e.g. "info_player_*".
+func (m Map) FindByClassname(className string) []Entity {
+	return m.findEntities("classname", className)
+}
+
+// FindByTargetname returns all entities with the given targetname (case-insensitive), see FindByClassname for wildcards.
+func (m Map) FindByTargetname(targetName string) []Entity {
+	return m.findEntities("targetname", targetName)
+}
+
+func (m Map) findEntities(key, pattern string) []Entity {
+	var res []Entity
+
+	for _, ent := range m.entities {
+		if name, ok := ent.Lookup(key); ok && matchEntityName(pattern, name) {
+			res = append(res, ent)
+		}
+	}
+
+	return res
+}
+
+// matchEntityName is a port of Matcher_NamesMatch, pattern may end with a '*' wildcard.
+func matchEntityName(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		prefix := pattern[:len(pattern)-1]
+
+		return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+	}
+
+	return strings.EqualFold(pattern, name)
+}
+
+// parseEntities parses the entities lump, malformed entities are skipped (see parseEntityLump).
+func parseEntities(bspfile *bsp.Bsp) []Entity {
+	entities, _ := parseEntityLump(bspfile.Lump(bsp.LumpEntities).(*lumps.EntData).GetData())
+
 	return entities
 }
+
+// parseEntityLump parses the entities lump, which is a list of blocks of key-value pairs:
+//
+//	{
+//	"classname" "worldspawn"
+//	}
+//
+// Malformed entities are skipped, all other entities are returned together with the error of the first malformed one.
+// Indices of the returned entities are consecutive, so entities after a skipped one are shifted by one.
+func parseEntityLump(data string) ([]Entity, error) {
+	t := entityTokenizer{data: data}
+
+	var (
+		entities []Entity
+		firstErr error
+	)
+
+	for {
+		tok, ok, err := t.next()
+		if err != nil {
+			// the rest of the lump can't be tokenized
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "entity %d", len(entities))
+			}
+
+			return entities, firstErr
+		}
+
+		if !ok {
+			return entities, firstErr
+		}
+
+		if tok != (entityToken{value: "{"}) {
+			// skip everything until the next entity
+			if firstErr == nil {
+				firstErr = errors.Errorf("entity %d: expected '{', got %q", len(entities), tok.value)
+			}
+
+			continue
+		}
+
+		ent, err := t.entity(int32(len(entities)))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		entities = append(entities, ent)
+	}
+}
+
+// entity parses the key-values of an entity after its '{'.
+// On errors, the tokenizer is left at the end of the malformed entity or at the '{' of the next one.
+func (t *entityTokenizer) entity(index int32) (Entity, error) {
+	ent := Entity{Index: index}
+
+	for {
+		pos := t.pos
+
+		key, ok, err := t.next()
+		if err != nil {
+			return Entity{}, errors.Wrapf(err, "entity %d", index)
+		}
+
+		if !ok {
+			return Entity{}, errors.Errorf("entity %d: unexpected end of lump, missing '}'", index)
+		}
+
+		if key == (entityToken{value: "}"}) {
+			return ent, nil
+		}
+
+		if key.isBrace() {
+			t.pos = pos // the '{' of the next entity
+
+			return Entity{}, errors.Errorf("entity %d: unexpected %q", index, key.value)
+		}
+
+		pos = t.pos
+
+		value, ok, err := t.next()
+		if err != nil {
+			return Entity{}, errors.Wrapf(err, "entity %d", index)
+		}
+
+		if !ok || value.isBrace() {
+			if value == (entityToken{value: "{"}) {
+				t.pos = pos
+			}
+
+			return Entity{}, errors.Errorf("entity %d: key %q without value", index, key.value)
+		}
+
+		ent.KeyValues = append(ent.KeyValues, KeyValue{Key: key.value, Value: value.value})
+	}
+}
+
+type entityToken struct {
+	value  string
+	quoted bool
+}
+
+func (t entityToken) isBrace() bool {
+	return !t.quoted && (t.value == "{" || t.value == "}")
+}
+
+// entityTokenizer is a port of MapEntity_ParseToken.
+// Unlike KeyValues files, quoted strings have no escape sequences except for \" (a quote that is part of the string),
+// they may contain braces and any other character, so values like file paths with backslashes are read as they are.
+// A \" that is followed by the next token (or the end of the lump) ends the string, e.g. in "C:\maps\" "angles".
+type entityTokenizer struct {
+	data string
+	pos  int
+}
+
+// next returns the next token, ok is false at the end of the data.
+func (t *entityTokenizer) next() (tok entityToken, ok bool, err error) {
+	for t.pos < len(t.data) {
+		c := t.data[t.pos]
+
+		switch {
+		// whitespace, control characters and the null terminator of the lump
+		case c <= ' ':
+			t.pos++
+
+		case strings.HasPrefix(t.data[t.pos:], "//"):
+			if end := strings.IndexByte(t.data[t.pos:], '\n'); end >= 0 {
+				t.pos += end
+			} else {
+				t.pos = len(t.data)
+			}
+
+		case c == '"':
+			return t.quoted()
+
+		case c == '{' || c == '}':
+			t.pos++
+
+			return entityToken{value: string(c)}, true, nil
+
+		default:
+			start := t.pos
+
+			for t.pos < len(t.data) && t.data[t.pos] > ' ' && !strings.ContainsRune(`{}"`, rune(t.data[t.pos])) {
+				t.pos++
+			}
+
+			return entityToken{value: t.data[start:t.pos]}, true, nil
+		}
+	}
+
+	return entityToken{}, false, nil
+}
+
+// quoted reads a quoted string, t.pos is at the opening quote.
+func (t *entityTokenizer) quoted() (entityToken, bool, error) {
+	var value strings.Builder
+
+	start := t.pos + 1
+
+	for i := start; i < len(t.data); i++ {
+		if t.data[i] != '"' {
+			continue
+		}
+
+		if t.data[i-1] == '\\' && !t.endsQuoted(i+1) {
+			// escaped quote
+			value.WriteString(t.data[start : i-1])
+			value.WriteByte('"')
+
+			start = i + 1
+
+			continue
+		}
+
+		value.WriteString(t.data[start:i])
+		t.pos = i + 1
+
+		return entityToken{value: value.String(), quoted: true}, true, nil
+	}
+
+	return entityToken{}, false, errors.Errorf("unterminated quoted string at offset %d", t.pos)
+}
+
+// endsQuoted returns true if a quote before pos, that follows a backslash, ends the quoted string,
+// i.e. it's followed by whitespace and the next quoted string or brace, or by the end of the lump.
+func (t *entityTokenizer) endsQuoted(pos int) bool {
+	i := pos
+	for i < len(t.data) && t.data[i] <= ' ' {
+		i++
+	}
+
+	if i == len(t.data) {
+		return true
+	}
+
+	return i > pos && strings.IndexByte(`"{}`, t.data[i]) >= 0
+}
@@ -0,0 +1,13 @@
+package bsptracer
+
+import "github.com/go-gl/mathgl/mgl32"
+
+// TraceRayBruteForce is TraceRay without BVHs and mailboxes, the baseline for benchmarks.
+func (m Map) TraceRayBruteForce(origin, destination mgl32.Vec3) *Trace {
+	return m.traceBruteForce(newTraceInfo(origin, destination, mgl32.Vec3{}, mgl32.Vec3{}, MaskShotHull))
+}
+
+// TraceHullBruteForce is TraceHull without BVHs and mailboxes.
+func (m Map) TraceHullBruteForce(origin, destination, mins, maxs mgl32.Vec3) *Trace {
+	return m.traceBruteForce(newTraceInfo(origin, destination, mins, maxs, MaskShotHull))
+}
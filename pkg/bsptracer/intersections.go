@@ -0,0 +1,452 @@
+package bsptracer
+
+import (
+	"sort"
+
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/primitives/brush"
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// Intersection is a part of a trace that is inside of a single object, see Map.TraceAll().
+// Faces and displacements have no volume, for them the enter and exit values are the same.
+type Intersection struct {
+	Kind                        HitKind
+	EnterFraction, ExitFraction float32    // fractions of the trace, ExitFraction is 1 if the trace ends inside of the object
+	Enter, Exit                 mgl32.Vec3 // positions at EnterFraction and ExitFraction
+	Contents                    int32
+	EnterSurface, ExitSurface   Surface      // empty if the trace starts / ends inside of the object, for static props only SurfaceProp is set
+	Brush                       *brush.Brush // HitBrush
+	Face                        int32        // index of the face (HitFace and HitDisplacement)
+	StaticProp                  int32        // index in the static prop game lump (HitStaticProp)
+	Model                       string       // model name of the prop (HitStaticProp and HitDynamicProp)
+	Entity                      int32        // index of the brush entity or dynamic prop in the entities lump, 0 (worldspawn) for the world
+}
+
+// TraceAll traces a ray from origin to destination and returns everything along it, sorted by EnterFraction.
+// Unlike TraceRay it doesn't stop at the first hit, objects the ray starts or ends in are included too.
+// Brushes and static props are reported once per object, faces and displacements once per crossing
+// (e.g. twice if the ray goes through a hill).
+// It collides with everything in MaskShotHull.
+func (m Map) TraceAll(origin, destination mgl32.Vec3) []Intersection {
+	return m.TraceAllWithMask(origin, destination, MaskShotHull)
+}
+
+// TraceAllWithMask is like TraceAll but only considers contents matching mask solid.
+// Faces are only reported if mask contains CONTENTS_SOLID.
+func (m Map) TraceAllWithMask(origin, destination mgl32.Vec3, mask int32) []Intersection {
+	return m.intersections(newTraceInfo(origin, destination, mgl32.Vec3{}, mgl32.Vec3{}, mask), true)
+}
+
+// intersections returns all objects along the trace, sorted by enter fraction.
+// Unlike trace() it doesn't stop at the first hit.
+// Faces are only included if withFaces is set, they are usually duplicates of the brush sides.
+func (m Map) intersections(ti *traceInfo, withFaces bool) []Intersection {
+	var (
+		res           []Intersection
+		seenBrushes   = make(map[*brush.Brush]struct{})
+		seenFaces     = make(map[uint16]struct{})
+		doesNotFinish = &Trace{Fraction: 1}
+	)
+
+	visit := func(ti *traceInfo, leafIndex int32) {
+		leaf := m.leaves[leafIndex]
+
+		for i := uint16(0); i < leaf.NumLeafBrushes; i++ {
+			b := &m.brushes[m.leafBrushes[leaf.FirstLeafBrush+i]]
+
+			if _, ok := seenBrushes[b]; ok || !m.brushMatchesMask(b, ti.mask) {
+				continue
+			}
+
+			seenBrushes[b] = struct{}{}
+
+			if is, ok := m.intersectBrush(ti, b); ok {
+				res = append(res, is)
+			}
+		}
+
+		if ti.mask&bsp.CONTENTS_SOLID != 0 {
+			for _, p := range m.staticPropsByLeaf[uint16(leafIndex)] {
+				if !testOnce(&ti.mailbox.props, len(m.staticPropLump.props), p.Index) || !p.touches(ti) {
+					continue
+				}
+
+				res = append(res, m.intersectStaticProp(ti, p)...)
+			}
+		}
+
+		for _, d := range m.displacementsByLeaf[uint16(leafIndex)] {
+			if d.contents&ti.mask == 0 || (ti.isPoint && d.flags&dispInfoFlagNoRay != 0) ||
+				!testOnce(&ti.mailbox.displacements, len(m.displacements), d.index) {
+				continue
+			}
+
+			res = append(res, m.intersectDisplacement(ti, d)...)
+		}
+
+		if !withFaces || !ti.isPoint || ti.mask&bsp.CONTENTS_SOLID == 0 {
+			return
+		}
+
+		for i := uint16(0); i < leaf.NumLeafFaces; i++ {
+			faceIndex := m.leafFaces[leaf.FirstLeafFace+i]
+
+			if _, ok := seenFaces[faceIndex]; ok {
+				continue
+			}
+
+			seenFaces[faceIndex] = struct{}{}
+
+			if t, _, ok := m.faceCrossing(int(faceIndex), ti.start, ti.end); ok && t <= 1 {
+				surface := m.surface(m.surfaces[faceIndex].TexInfo)
+
+				res = append(res, Intersection{
+					Kind:          HitFace,
+					EnterFraction: t,
+					ExitFraction:  t,
+					EnterSurface:  surface,
+					ExitSurface:   surface,
+					Face:          int32(faceIndex),
+				})
+			}
+		}
+	}
+
+	ti.visitLeaf = func(leafIndex int32) {
+		visit(ti, leafIndex)
+	}
+
+	m.rayCastNode(ti, 0, 0, 1, ti.start, ti.end, doesNotFinish)
+
+	for i := range m.brushEntities {
+		e := &m.brushEntities[i]
+
+		if !e.Enabled || !e.touches(ti) {
+			continue
+		}
+
+		first := len(res)
+		local := e.localTrace(ti)
+		local.visitLeaf = func(leafIndex int32) {
+			visit(local, leafIndex)
+		}
+
+		m.rayCastNode(local, e.headNode, 0, 1, local.start, local.end, doesNotFinish)
+
+		for j := first; j < len(res); j++ {
+			res[j].Entity = e.Entity
+		}
+	}
+
+	res = append(res, m.intersectDynamicProps(ti)...)
+
+	for i := range res {
+		res[i].Enter = ti.origin.Add(ti.destination.Sub(ti.origin).Mul(res[i].EnterFraction))
+		res[i].Exit = ti.origin.Add(ti.destination.Sub(ti.origin).Mul(res[i].ExitFraction))
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].EnterFraction < res[j].EnterFraction
+	})
+
+	return res
+}
+
+func (m Map) brushSideSurface(side int32) Surface {
+	if side < 0 {
+		return Surface{}
+	}
+
+	return m.surface(m.brushSides[side].TexInfo)
+}
+
+func (m Map) intersectBrush(ti *traceInfo, b *brush.Brush) (Intersection, bool) {
+	if b.NumSides == 0 {
+		return Intersection{}, false
+	}
+
+	c, ok := m.clipBrush(ti, b)
+	if !ok {
+		return Intersection{}, false
+	}
+
+	is := Intersection{
+		Kind:          HitBrush,
+		EnterFraction: mgl32.Clamp(c.fractionToEnter, 0, 1),
+		ExitFraction:  1,
+		Contents:      b.Contents,
+		Brush:         b,
+	}
+
+	if c.startsOut {
+		if c.fractionToEnter >= c.fractionToLeave {
+			return Intersection{}, false // missed
+		}
+
+		is.EnterSurface = m.brushSideSurface(c.enterSide)
+	}
+
+	if c.endsOut {
+		is.ExitFraction = mgl32.Clamp(c.fractionToLeave, 0, 1)
+		is.ExitSurface = m.brushSideSurface(c.leaveSide)
+	}
+
+	return is, true
+}
+
+func (m Map) intersectStaticProp(ti *traceInfo, p *staticProp) []Intersection {
+	base := Intersection{
+		Kind:       HitStaticProp,
+		Contents:   bsp.CONTENTS_SOLID,
+		StaticProp: int32(p.Index),
+		Model:      p.Model,
+	}
+
+	if p.model != nil {
+		base.EnterSurface.SurfaceProp = p.model.surfaceProp
+		base.ExitSurface.SurfaceProp = p.model.surfaceProp
+	}
+
+	return p.intersect(ti, base)
+}
+
+// intersect returns the parts of the trace that are inside of the prop, all other values are copied from base.
+func (p *propCollision) intersect(ti *traceInfo, base Intersection) []Intersection {
+	switch p.effectiveSolid() {
+	case SolidBBox:
+		return intersectBox(ti, base, func(start, end mgl32.Vec3) collision.RayCastResult {
+			return collision.SweepAxisAlignedBoundingBox(start, end, ti.extents, p.min, p.max)
+		})
+
+	case SolidOBB, SolidOBBYaw:
+		return intersectBox(ti, base, func(start, end mgl32.Vec3) collision.RayCastResult {
+			return collision.SweepOrientedBoundingBox(start, end, ti.extents, p.obb)
+		})
+
+	case SolidVPhysics:
+		if len(p.triangles) > 0 {
+			return p.intersectTriangleMesh(ti, base)
+		}
+
+		return p.intersectHulls(ti, base)
+	}
+
+	return nil
+}
+
+// intersectBox finds the part of the trace that is inside of a convex shape
+// by sweeping forwards for the enter and backwards for the exit fraction.
+// Surfaces of base are cleared if the trace starts or ends inside of the shape.
+func intersectBox(ti *traceInfo, base Intersection, sweep func(start, end mgl32.Vec3) collision.RayCastResult) []Intersection {
+	enter := sweep(ti.start, ti.end)
+	if !enter.Hit || enter.T > 1 {
+		return nil
+	}
+
+	base.EnterFraction = float32(enter.T)
+	base.ExitFraction = 1
+
+	if enter.T == 0 && enter.Normal == (mgl32.Vec3{}) {
+		base.EnterSurface = Surface{} // started inside
+	}
+
+	exit := sweep(ti.end, ti.start)
+	if exit.Hit && exit.T > 0 {
+		base.ExitFraction = 1 - float32(exit.T)
+	} else {
+		base.ExitSurface = Surface{} // ends inside
+	}
+
+	return []Intersection{base}
+}
+
+// intersectTriangleMesh finds the parts of the trace that are inside of the (closed) render mesh of a prop.
+// Overlapping parts are handled by counting how many parts the trace is currently inside of.
+func (p *propCollision) intersectTriangleMesh(ti *traceInfo, base Intersection) []Intersection {
+	type meshHit struct {
+		t        float32
+		entering bool
+	}
+
+	var hits []meshHit
+
+	p.triangleTree.Sweep(ti.start, ti.end, mgl32.Vec3{}, func(i int) float32 {
+		t := p.triangles[i]
+
+		r := collision.RayIntersectsTriangle(ti.start, ti.delta, t)
+		if r.Hit && r.T <= 1 {
+			normal := t[1].Sub(t[0]).Cross(t[2].Sub(t[0]))
+			hits = append(hits, meshHit{t: float32(r.T), entering: normal.Dot(ti.delta) < 0})
+		}
+
+		return 1
+	})
+
+	if len(hits) == 0 {
+		return nil
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].t < hits[j].t
+	})
+
+	// the winding of the triangles isn't guaranteed,
+	// if the first hit is an exit even though we started outside of the prop the mesh is wound inwards
+	startsOutside := false
+
+	for i := 0; i < 3; i++ {
+		if ti.start[i] < p.min[i] || ti.start[i] > p.max[i] {
+			startsOutside = true
+		}
+	}
+
+	flip := startsOutside && !hits[0].entering
+
+	var (
+		res   []Intersection
+		depth int
+		open  = false
+		is    = base
+	)
+
+	for _, h := range hits {
+		if h.entering != flip {
+			if depth == 0 && !open {
+				is = base
+				is.EnterFraction = h.t
+				open = true
+			}
+
+			depth++
+
+			continue
+		}
+
+		if !open {
+			// started inside
+			is = base
+			is.EnterFraction = 0
+			is.EnterSurface = Surface{}
+			open = true
+		}
+
+		depth--
+
+		if depth <= 0 {
+			is.ExitFraction = h.t
+			res = append(res, is)
+			depth = 0
+			open = false
+		}
+	}
+
+	if open {
+		is.ExitFraction = 1
+		is.ExitSurface = Surface{}
+		res = append(res, is)
+	}
+
+	return res
+}
+
+// intersectHulls finds the parts of the trace that are inside of the convex solids of a prop.
+// Overlapping solids are merged, so each returned intersection is a continuous part of the prop.
+func (p *propCollision) intersectHulls(ti *traceInfo, base Intersection) []Intersection {
+	var hits []Intersection
+
+	p.hullTree.Sweep(ti.start, ti.end, ti.extents, func(i int) float32 {
+		hits = append(hits, intersectBox(ti, base, func(start, end mgl32.Vec3) collision.RayCastResult {
+			return collision.SweepConvexHull(start, end, ti.extents, p.hulls[i])
+		})...)
+
+		return 1
+	})
+
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].EnterFraction < hits[j].EnterFraction
+	})
+
+	segments := mergeIntersections(hits, 0)
+	res := make([]Intersection, len(segments))
+
+	for i, seg := range segments {
+		res[i] = seg.enter
+		res[i].ExitFraction = seg.exit.ExitFraction
+		res[i].ExitSurface = seg.exit.ExitSurface
+	}
+
+	return res
+}
+
+// intersectDisplacement returns the crossings of the trace with the surface of a displacement.
+// Crossings through an edge or vertex that is shared by several triangles are only reported once.
+func (m Map) intersectDisplacement(ti *traceInfo, disp *displacement) []Intersection {
+	var res []Intersection
+
+	disp.tree.Sweep(ti.start, ti.end, mgl32.Vec3{}, func(i int) float32 {
+		r := collision.RayIntersectsTriangle(ti.start, ti.delta, disp.triangles[i])
+		if !r.Hit || r.T > 1 {
+			return 1
+		}
+
+		surface := m.surface(m.surfaces[disp.face].TexInfo)
+
+		res = append(res, Intersection{
+			Kind:          HitDisplacement,
+			EnterFraction: float32(r.T),
+			ExitFraction:  float32(r.T),
+			Contents:      disp.contents,
+			EnterSurface:  surface,
+			ExitSurface:   surface,
+			Face:          int32(disp.face),
+		})
+
+		return 1
+	})
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].EnterFraction < res[j].EnterFraction
+	})
+
+	// crossings less than distEpsilon apart are the same
+	gap := distEpsilon / ti.delta.Len()
+	unique := res[:0]
+
+	for _, is := range res {
+		if n := len(unique); n > 0 && is.EnterFraction-unique[n-1].EnterFraction < gap {
+			continue
+		}
+
+		unique = append(unique, is)
+	}
+
+	return unique
+}
+
+// solidSegment is a part of a trace that is inside of one or more touching or overlapping objects.
+type solidSegment struct {
+	enter, exit Intersection // the intersections that define where the segment is entered and left
+}
+
+// mergeIntersections merges intersections that overlap or are less than gap (as a fraction of the trace) apart.
+// intersections must be sorted by EnterFraction.
+func mergeIntersections(intersections []Intersection, gap float32) []solidSegment {
+	var res []solidSegment
+
+	for _, is := range intersections {
+		if n := len(res); n > 0 && is.EnterFraction <= res[n-1].exit.ExitFraction+gap {
+			if is.ExitFraction > res[n-1].exit.ExitFraction {
+				res[n-1].exit = is
+			}
+
+			continue
+		}
+
+		res = append(res, solidSegment{enter: is, exit: is})
+	}
+
+	return res
+}
@@ -0,0 +1,95 @@
+package bsptracer
+
+import (
+	"github.com/galaco/bsp/primitives/brush"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// leaf.Leaf.Area() masks the wrong number of bits, the area is stored in the lower 9 bits of the bitfield
+const leafAreaMask = 0x1FF
+
+// LeafInfo describes a leaf of the BSP tree.
+type LeafInfo struct {
+	Index    int32 // index into the leaves lump
+	Cluster  int16 // visibility cluster, -1 if the leaf is solid / outside of the map
+	Area     int16 // area the leaf is in, see the areas lump
+	Contents int32 // CONTENTS_* flags of the leaf
+}
+
+// leafIndex is a port of CM_PointLeafnum_r, it returns the index of the leaf that contains the point.
+func (m Map) leafIndex(p mgl32.Vec3) int32 {
+	return m.leafIndexFrom(0, p)
+}
+
+// leafIndexFrom is like leafIndex for the tree of a brush model starting at headNode.
+func (m Map) leafIndexFrom(headNode int32, p mgl32.Vec3) int32 {
+	nodeIndex := headNode
+
+	for nodeIndex >= 0 {
+		node := m.nodes[nodeIndex]
+		plane := m.planes[node.PlaneNum]
+
+		var d float32
+		if plane.AxisType < 3 {
+			d = p[plane.AxisType] - plane.Distance
+		} else {
+			d = plane.Normal.Dot(p) - plane.Distance
+		}
+
+		if d < 0 {
+			nodeIndex = node.Children[1]
+		} else {
+			nodeIndex = node.Children[0]
+		}
+	}
+
+	return -nodeIndex - 1
+}
+
+// LeafAt returns the leaf that contains the point.
+func (m Map) LeafAt(p mgl32.Vec3) LeafInfo {
+	index := m.leafIndex(p)
+	leaf := m.leaves[index]
+
+	return LeafInfo{
+		Index:    index,
+		Cluster:  leaf.Cluster,
+		Area:     int16(uint16(leaf.BitField) & leafAreaMask),
+		Contents: leaf.Contents,
+	}
+}
+
+// PointContents returns the combined CONTENTS_* flags of all brushes that contain the point,
+// e.g. CONTENTS_SOLID if the point is inside of a wall or CONTENTS_PLAYERCLIP if it's inside of a player clip.
+// Static props and displacements are not taken into account.
+func (m Map) PointContents(p mgl32.Vec3) int32 {
+	leaf := m.leaves[m.leafIndex(p)]
+
+	var contents int32
+
+	for i := uint16(0); i < leaf.NumLeafBrushes; i++ {
+		b := &m.brushes[m.leafBrushes[leaf.FirstLeafBrush+i]]
+
+		if b.Contents&^contents != 0 && m.brushContainsPoint(b, p) {
+			contents |= b.Contents
+		}
+	}
+
+	return contents
+}
+
+func (m Map) brushContainsPoint(b *brush.Brush, p mgl32.Vec3) bool {
+	if b.NumSides == 0 {
+		return false
+	}
+
+	for i := int32(0); i < b.NumSides; i++ {
+		plane := m.planes[m.brushSides[b.FirstSide+i].PlaneNum]
+
+		if plane.Normal.Dot(p)-plane.Distance > 0 {
+			return false
+		}
+	}
+
+	return true
+}
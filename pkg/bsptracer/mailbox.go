@@ -0,0 +1,35 @@
+package bsptracer
+
+// mailbox remembers which static props and displacements a trace already tested,
+// so objects that are in multiple leaves are tested only once per trace.
+type mailbox struct {
+	props, displacements []uint64 // bit sets, allocated on first use
+}
+
+// testOnce returns true the first time it's called for index of set, which holds size bits.
+func testOnce(set *[]uint64, size, index int) bool {
+	if *set == nil {
+		*set = make([]uint64, (size+63)/64)
+	}
+
+	word, bit := index/64, uint64(1)<<(index%64)
+
+	if (*set)[word]&bit != 0 {
+		return false
+	}
+
+	(*set)[word] |= bit
+
+	return true
+}
+
+// reset forgets all tested objects but keeps the memory for the next trace.
+func (mb *mailbox) reset() {
+	for i := range mb.props {
+		mb.props[i] = 0
+	}
+
+	for i := range mb.displacements {
+		mb.displacements[i] = 0
+	}
+}
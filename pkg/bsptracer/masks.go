@@ -0,0 +1,53 @@
+package bsptracer
+
+import (
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/primitives/brush"
+)
+
+// Content masks for traces, these match the MASK_* presets of the engine (see bspflags.h).
+const (
+	// MaskSolid is everything that is normally solid.
+	MaskSolid int32 = bsp.MASK_SOLID
+	// MaskPlayerSolid is everything that blocks player movement, including player clips.
+	MaskPlayerSolid int32 = bsp.MASK_PLAYERSOLID
+	// MaskNPCSolid is everything that blocks NPC movement, including NPC clips.
+	MaskNPCSolid int32 = bsp.MASK_NPCSOLID
+	// MaskNPCWorldStatic is just the world, used for route rebuilding.
+	MaskNPCWorldStatic int32 = bsp.MASK_NPCWORLDSTATIC
+	// MaskWater is water and slime.
+	MaskWater int32 = bsp.MASK_WATER
+	// MaskOpaque is everything that blocks lighting.
+	MaskOpaque int32 = bsp.MASK_OPAQUE
+	// MaskVisible is everything that blocks line of sight for players, glass and grates (fences) are see-through.
+	MaskVisible int32 = bsp.MASK_VISIBLE
+	// MaskShot is everything bullets collide with, grates are passed through.
+	MaskShot int32 = bsp.MASK_SHOT
+	// MaskShotHull is everything non-raycasted weapons collide with, including grates.
+	// This is the mask used by TraceRay, TraceHull and IsVisible.
+	MaskShotHull int32 = bsp.MASK_SHOT_HULL
+)
+
+// brushMatchesMask returns true if the brush should be traced against for the given mask.
+func (m Map) brushMatchesMask(b *brush.Brush, mask int32) bool {
+	contents := b.Contents & mask
+	if contents == 0 {
+		return false
+	}
+
+	// brushes that are only opaque because of nodraw textures don't block sight
+	if mask&bsp.CONTENTS_IGNORE_NODRAW_OPAQUE != 0 && contents == bsp.CONTENTS_OPAQUE {
+		for i := int32(0); i < b.NumSides; i++ {
+			side := m.brushSides[b.FirstSide+i]
+
+			if side.TexInfo < 0 || int(side.TexInfo) >= len(m.texInfos) ||
+				m.texInfos[side.TexInfo].Flags&bsp.SURF_NODRAW == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
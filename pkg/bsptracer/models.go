@@ -1,29 +1,24 @@
 package bsptracer
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 
-	"github.com/galaco/bsp"
-	"github.com/galaco/bsp/lumps"
-	"github.com/galaco/studiomodel"
 	"github.com/galaco/studiomodel/mdl"
 	"github.com/galaco/studiomodel/phy"
 	"github.com/galaco/studiomodel/vtx"
 	"github.com/galaco/studiomodel/vvd"
-	vpk "github.com/galaco/vpk2"
+	"github.com/go-gl/mathgl/mgl32"
 	"github.com/pkg/errors"
 )
 
-type virtualFileSystem interface {
-	open(string) (io.ReadCloser, error)
-}
-
-func loadModelPart[T any](fs virtualFileSystem, filePath string, reader func(io.Reader) (T, error)) (T, error) {
+func loadModelPart[T any](fs ModelSource, filePath string, reader func(io.Reader) (T, error)) (T, error) {
 	var def T
 
-	f, err := fs.open(filePath)
+	f, err := fs.Open(filePath)
 	if err != nil {
 		return def, errors.Wrapf(err, "failed to open prop part file %q", filePath)
 	}
@@ -38,10 +33,37 @@ func loadModelPart[T any](fs virtualFileSystem, filePath string, reader func(io.
 	return part, nil
 }
 
-func loadModel(fs virtualFileSystem, filePath string) (*studiomodel.StudioModel, error) {
+// model is the collision data of a studio model (.mdl, .phy and the render mesh files).
+type model struct {
+	surfaceProp      string            // name of the model's surface property, e.g. "wood_crate"
+	hullMin, hullMax mgl32.Vec3        // collision hull in model space, see studioHull()
+	phySolids        [][][3]mgl32.Vec3 // convex solids of the physics model in model space, see phySolids()
+	renderMesh       [][3]mgl32.Vec3   // LOD0 render mesh in model space, only for models without physics data
+}
+
+// cString returns the null-terminated string at offset in b.
+func cString(b []byte, offset int32) string {
+	if offset <= 0 || int(offset) >= len(b) {
+		return ""
+	}
+
+	s := b[offset:]
+	if end := bytes.IndexByte(s, 0); end >= 0 {
+		s = s[:end]
+	}
+
+	return string(s)
+}
+
+func loadModel(fs ModelSource, filePath string) (*model, error) {
 	prop := strings.Split(filePath, ".mdl")[0]
 
-	mdlData, err := loadModelPart(fs, prop+".mdl", mdl.ReadFromStream)
+	mdlBytes, err := loadModelPart(fs, prop+".mdl", io.ReadAll)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read mdl")
+	}
+
+	mdlData, err := mdl.ReadFromStream(bytes.NewReader(mdlBytes))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read mdl")
 	}
@@ -56,20 +78,52 @@ func loadModel(fs virtualFileSystem, filePath string) (*studiomodel.StudioModel,
 		return nil, errors.Wrap(err, "failed to read vtx")
 	}
 
-	phyData, err := loadModelPart(fs, prop+".phy", phy.ReadFromStream)
-	if err != nil && !errors.Is(err, errFileNotFound) { // .phy is ok to be missing, it's optional
+	phyBytes, err := loadModelPart(fs, prop+".phy", io.ReadAll)
+	if err != nil && !errors.Is(err, os.ErrNotExist) { // .phy is ok to be missing, it's optional
 		return nil, errors.Wrap(err, "failed to read phy")
 	}
 
-	return &studiomodel.StudioModel{
-		Filename: prop,
-		Mdl:      mdlData,
-		Vvd:      vvdData,
-		Vtx:      vtxData,
-		Phy:      phyData,
+	var (
+		phyData *phy.Phy
+		solids  [][][3]mgl32.Vec3
+	)
+
+	if err == nil {
+		phyData, err = phy.ReadFromStream(bytes.NewReader(phyBytes))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read phy")
+		}
+
+		solids = phySolids(phyData, mdlData, boneNames(mdlBytes, mdlData), phySolidBones(phyText(phyBytes, phyData)))
+	}
+
+	var renderMesh [][3]mgl32.Vec3
+
+	if len(solids) == 0 {
+		renderMesh = renderMeshTriangles(mdlBytes, mdlData, vvdData, vtxData)
+	}
+
+	hullMin, hullMax := studioHull(&mdlData.Header)
+
+	return &model{
+		surfaceProp: cString(mdlBytes, mdlData.Header.SurfacePropertyIndex),
+		hullMin:     hullMin,
+		hullMax:     hullMax,
+		phySolids:   solids,
+		renderMesh:  renderMesh,
 	}, nil
 }
 
+// studioHull returns the collision hull of a model in model space.
+// Falls back to the view bounding box for models without a hull.
+func studioHull(h *mdl.Studiohdr) (min, max mgl32.Vec3) {
+	if h.HullMin == (mgl32.Vec3{}) && h.HullMax == (mgl32.Vec3{}) {
+		return h.ViewBBMin, h.ViewBBMax
+	}
+
+	return h.HullMin, h.HullMax
+}
+
 type MissingModelsError struct {
 	missingModels []string
 }
@@ -78,20 +132,15 @@ func (m MissingModelsError) Error() string {
 	return fmt.Sprintf(`missing models: ("%s")`, strings.Join(m.missingModels, `", "`))
 }
 
-func loadModels(bspfile *bsp.Bsp, vpks []*vpk.VPK) ([]*studiomodel.StudioModel, error) {
-	fs := vfs{
-		pakfile: bspfile.Lump(bsp.LumpPakfile).(*lumps.Pakfile).GetData(),
-		vpks:    vpks,
-	}
-
+// loadModels loads the models of the static prop dictionary (names), missing models are nil.
+// Returns the names of all models that couldn't be loaded.
+func loadModels(names []string, fs ModelSource) ([]*model, []string) {
 	var (
-		props         []*studiomodel.StudioModel
+		props         []*model
 		missingModels []string
 	)
 
-	gameLump := bspfile.Lump(bsp.LumpGame).(*lumps.Game).GetData()
-
-	for _, model := range gameLump.GetStaticPropLump().DictLump.Name {
+	for _, model := range names {
 		prop, err := loadModel(fs, model)
 		if err != nil {
 			missingModels = append(missingModels, model)
@@ -104,11 +153,16 @@ func loadModels(bspfile *bsp.Bsp, vpks []*vpk.VPK) ([]*studiomodel.StudioModel,
 		props = append(props, prop)
 	}
 
-	if len(missingModels) > 0 {
-		return props, MissingModelsError{
-			missingModels: missingModels,
-		}
+	return props, missingModels
+}
+
+// modelsByName returns the models of the static prop dictionary (names) by name.
+func modelsByName(names []string, models []*model) map[string]*model {
+	res := make(map[string]*model, len(names))
+
+	for i, name := range names {
+		res[name] = models[i]
 	}
 
-	return props, nil
+	return res
 }
@@ -0,0 +1,282 @@
+// Package nav implements loading and querying of navigation meshes (.nav files) of Counter-Strike maps,
+// e.g. to find the callout (place name) of a position or a walking path between two positions.
+package nav
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Direction is the side of an area that a connection leaves through.
+type Direction int
+
+// Directions of area connections.
+const (
+	North Direction = iota // -y
+	East                   // +x
+	South                  // +y
+	West                   // -x
+)
+
+// LadderDirection is the direction of a ladder connection of an area.
+type LadderDirection int
+
+// Directions of ladder connections.
+const (
+	LadderUp LadderDirection = iota
+	LadderDown
+)
+
+// Area is a walkable, axis-aligned quad of a navigation mesh.
+// The corners may have different heights (e.g. on slopes).
+type Area struct {
+	ID          uint32
+	Attributes  uint32       // NAV_MESH_* flags, e.g. crouch or jump
+	NorthWest   mgl32.Vec3   // corner with the lowest x and y
+	SouthEast   mgl32.Vec3   // corner with the highest x and y
+	NorthEastZ  float32      // height of the corner with the highest x and lowest y
+	SouthWestZ  float32      // height of the corner with the lowest x and highest y
+	Place       string       // name of the place the area belongs to, e.g. "BombsiteA", may be empty
+	Connections [4][]*Area   // areas that can be reached from this area, by Direction
+	Ladders     [2][]*Ladder // ladders that can be climbed from this area, by LadderDirection
+	HidingSpots []HidingSpot
+
+	// EarliestOccupyTime is the earliest time in seconds after the round start at which a team can reach the area,
+	// indexed by team (0 = T, 1 = CT).
+	EarliestOccupyTime [2]float32
+
+	// PotentiallyVisible are the areas that may be visible from this area, as computed when the mesh was analyzed.
+	// It's empty for meshes before version 16 or meshes that weren't analyzed, see VisibleFrom for exact tests.
+	PotentiallyVisible []*Area
+}
+
+// Ladder is a ladder that connects areas at its top and bottom.
+type Ladder struct {
+	ID          uint32
+	Width       float32
+	Top, Bottom mgl32.Vec3
+	Length      float32
+	Direction   Direction // direction the ladder faces
+	TopForward  *Area     // areas at the top and the bottom, may be nil
+	TopLeft     *Area
+	TopRight    *Area
+	TopBehind   *Area
+	BottomArea  *Area
+}
+
+// HidingSpot is a good position to hide in an area, e.g. behind a crate.
+type HidingSpot struct {
+	ID       uint32
+	Position mgl32.Vec3
+	Flags    uint8 // IN_COVER, GOOD_SNIPER_SPOT, IDEAL_SNIPER_SPOT, EXPOSED
+}
+
+// Center returns the center of the area.
+func (a *Area) Center() mgl32.Vec3 {
+	center := a.NorthWest.Add(a.SouthEast).Mul(0.5)
+	center[2] = a.Z(center[0], center[1])
+
+	return center
+}
+
+// Contains2D returns true if the point is inside of the area in the xy plane.
+func (a *Area) Contains2D(x, y float32) bool {
+	return x >= a.NorthWest[0] && x <= a.SouthEast[0] && y >= a.NorthWest[1] && y <= a.SouthEast[1]
+}
+
+// Z is a port of CNavArea::GetZ, it returns the height of the area at x, y (clamped to the area).
+func (a *Area) Z(x, y float32) float32 {
+	dx := a.SouthEast[0] - a.NorthWest[0]
+	dy := a.SouthEast[1] - a.NorthWest[1]
+
+	// degenerate areas are flat
+	if dx == 0 || dy == 0 {
+		return a.NorthEastZ
+	}
+
+	u := mgl32.Clamp((x-a.NorthWest[0])/dx, 0, 1)
+	v := mgl32.Clamp((y-a.NorthWest[1])/dy, 0, 1)
+
+	northZ := a.NorthWest[2] + u*(a.NorthEastZ-a.NorthWest[2])
+	southZ := a.SouthWestZ + u*(a.SouthEast[2]-a.SouthWestZ)
+
+	return northZ + v*(southZ-northZ)
+}
+
+// ClosestPoint returns the point of the area that is closest to p.
+func (a *Area) ClosestPoint(p mgl32.Vec3) mgl32.Vec3 {
+	x := mgl32.Clamp(p[0], a.NorthWest[0], a.SouthEast[0])
+	y := mgl32.Clamp(p[1], a.NorthWest[1], a.SouthEast[1])
+
+	return mgl32.Vec3{x, y, a.Z(x, y)}
+}
+
+const (
+	// areaAtStepHeight is added to the height of positions that are looked up, see CNavMesh::GetNavArea.
+	areaAtStepHeight = 5
+	// areaAtBeneathLimit is the maximum distance of an area below a position, see CNavMesh::GetNavArea.
+	areaAtBeneathLimit = 120
+	// gridCellSize is the size of the cells of the grid that is used to look up areas, like in CNavMesh.
+	gridCellSize = 300
+)
+
+// NavMesh is the navigation mesh of a map, see Parse.
+type NavMesh struct {
+	Version    uint32
+	SubVersion uint32
+	BSPSize    uint32 // size of the BSP file the mesh was generated for
+	Analyzed   bool
+	Places     []string // place names, e.g. "BombsiteA"
+	Areas      []*Area
+	Ladders    []*Ladder
+
+	areasByID map[uint32]*Area
+	grid      areaGrid
+}
+
+// areaGrid sorts areas into cells of gridCellSize in the xy plane.
+type areaGrid struct {
+	minX, minY    float32
+	width, height int
+	cells         [][]*Area
+}
+
+func newAreaGrid(areas []*Area) areaGrid {
+	if len(areas) == 0 {
+		return areaGrid{}
+	}
+
+	minX, minY := float32(math.MaxFloat32), float32(math.MaxFloat32)
+	maxX, maxY := float32(-math.MaxFloat32), float32(-math.MaxFloat32)
+
+	for _, a := range areas {
+		minX = float32(math.Min(float64(minX), float64(a.NorthWest[0])))
+		minY = float32(math.Min(float64(minY), float64(a.NorthWest[1])))
+		maxX = float32(math.Max(float64(maxX), float64(a.SouthEast[0])))
+		maxY = float32(math.Max(float64(maxY), float64(a.SouthEast[1])))
+	}
+
+	g := areaGrid{
+		minX:   minX,
+		minY:   minY,
+		width:  int((maxX-minX)/gridCellSize) + 1,
+		height: int((maxY-minY)/gridCellSize) + 1,
+	}
+
+	g.cells = make([][]*Area, g.width*g.height)
+
+	for _, a := range areas {
+		x0, y0 := g.cell(a.NorthWest[0], a.NorthWest[1])
+		x1, y1 := g.cell(a.SouthEast[0], a.SouthEast[1])
+
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				g.cells[y*g.width+x] = append(g.cells[y*g.width+x], a)
+			}
+		}
+	}
+
+	return g
+}
+
+// cell returns the cell that contains x, y, clamped to the grid.
+func (g areaGrid) cell(x, y float32) (int, int) {
+	cx := int((x - g.minX) / gridCellSize)
+	cy := int((y - g.minY) / gridCellSize)
+
+	if cx < 0 {
+		cx = 0
+	} else if cx >= g.width {
+		cx = g.width - 1
+	}
+
+	if cy < 0 {
+		cy = 0
+	} else if cy >= g.height {
+		cy = g.height - 1
+	}
+
+	return cx, cy
+}
+
+// areas returns the areas of the cell that contains x, y or nil if it's outside of the grid.
+func (g areaGrid) areas(x, y float32) []*Area {
+	if g.width == 0 || x < g.minX || y < g.minY {
+		return nil
+	}
+
+	cx, cy := int((x-g.minX)/gridCellSize), int((y-g.minY)/gridCellSize)
+	if cx >= g.width || cy >= g.height {
+		return nil
+	}
+
+	return g.cells[cy*g.width+cx]
+}
+
+// Area returns the area with the given ID or nil.
+func (m *NavMesh) Area(id uint32) *Area {
+	return m.areasByID[id]
+}
+
+// AreaAt is a port of CNavMesh::GetNavArea, it returns the highest area below p
+// (at most 120 units below, 5 units above to allow for small steps) or nil.
+func (m *NavMesh) AreaAt(p mgl32.Vec3) *Area {
+	var (
+		res  *Area
+		resZ = float32(-math.MaxFloat32)
+	)
+
+	for _, a := range m.grid.areas(p[0], p[1]) {
+		if !a.Contains2D(p[0], p[1]) {
+			continue
+		}
+
+		z := a.Z(p[0], p[1])
+		if z > p[2]+areaAtStepHeight || z < p[2]-areaAtBeneathLimit {
+			continue
+		}
+
+		if z > resZ {
+			res, resZ = a, z
+		}
+	}
+
+	return res
+}
+
+// NearestArea returns the area whose closest point is nearest to p or nil if the mesh has no areas.
+func (m *NavMesh) NearestArea(p mgl32.Vec3) *Area {
+	var (
+		res     *Area
+		resDist = float32(math.MaxFloat32)
+	)
+
+	for _, a := range m.Areas {
+		if d := a.ClosestPoint(p).Sub(p).LenSqr(); d < resDist {
+			res, resDist = a, d
+		}
+	}
+
+	return res
+}
+
+// PlaceName returns the name of the place at p, e.g. "BombsiteA" or "TSpawn".
+// The area below p is used (see AreaAt) or the nearest area if there is none (e.g. while falling).
+// Returns "" if the area has no place.
+func (m *NavMesh) PlaceName(p mgl32.Vec3) string {
+	a := m.areaAtOrNearest(p)
+	if a == nil {
+		return ""
+	}
+
+	return a.Place
+}
+
+func (m *NavMesh) areaAtOrNearest(p mgl32.Vec3) *Area {
+	if a := m.AreaAt(p); a != nil {
+		return a
+	}
+
+	return m.NearestArea(p)
+}
@@ -0,0 +1,329 @@
+package nav_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer"
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/nav"
+)
+
+type testArea struct {
+	id                     uint32
+	nw, se                 mgl32.Vec3
+	neZ, swZ               float32
+	place                  uint16
+	connections            [4][]uint32
+	ladders                [2][]uint32
+	visible                []uint32
+	hidingSpots, encounter bool
+}
+
+type testLadder struct {
+	id                uint32
+	top, bottom       mgl32.Vec3
+	topForward, below uint32
+}
+
+// writeMesh writes a version 16 (CS:GO) nav mesh.
+func writeMesh(places []string, areas []testArea, ladders []testLadder) []byte {
+	var buf bytes.Buffer
+
+	w := func(v any) {
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+	}
+
+	ids := func(ids []uint32) {
+		w(uint32(len(ids)))
+		w(ids)
+	}
+
+	w(uint32(0xFEEDFACE))
+	w(uint32(16)) // version
+	w(uint32(1))  // sub version
+	w(uint32(1234))
+	w(uint8(1)) // analyzed
+	w(uint16(len(places)))
+
+	for _, p := range places {
+		w(uint16(len(p) + 1))
+		w([]byte(p + "\x00"))
+	}
+
+	w(uint8(0)) // has unnamed areas
+	w(uint32(len(areas)))
+
+	for _, a := range areas {
+		w(a.id)
+		w(uint32(0)) // attributes
+		w(a.nw)
+		w(a.se)
+		w(a.neZ)
+		w(a.swZ)
+
+		for _, conns := range a.connections {
+			ids(conns)
+		}
+
+		if a.hidingSpots {
+			w(uint8(1))
+			w(uint32(7))
+			w(a.nw.Add(mgl32.Vec3{1, 2, 0}))
+			w(uint8(2))
+		} else {
+			w(uint8(0))
+		}
+
+		if a.encounter {
+			w(uint32(1))
+			w([]byte{1, 0, 0, 0, 1, 2, 0, 0, 0, 3})
+			w(uint8(2))
+			w([]byte{7, 0, 0, 0, 10, 8, 0, 0, 0, 20})
+		} else {
+			w(uint32(0))
+		}
+
+		w(a.place)
+
+		for _, l := range a.ladders {
+			ids(l)
+		}
+
+		w([2]float32{5, 10}) // earliest occupy times
+		w([4]float32{1, 1, 1, 1})
+		w(uint32(len(a.visible)))
+
+		for _, id := range a.visible {
+			w(id)
+			w(uint8(1))
+		}
+
+		w(uint32(0)) // inherit visibility from
+
+		// approach areas
+		w(uint8(1))
+		w([14]byte{})
+	}
+
+	w(uint32(len(ladders)))
+
+	for _, l := range ladders {
+		w(l.id)
+		w(float32(32))
+		w(l.top)
+		w(l.bottom)
+		w(l.top.Sub(l.bottom).Len())
+		w(uint32(nav.West))
+		w([5]uint32{l.topForward, 0, 0, 0, l.below})
+	}
+
+	return buf.Bytes()
+}
+
+// testMesh is a corridor of areas from T spawn to bomb site A, with a catwalk above A that is reached by a ladder
+// and that can be left by dropping down.
+func testMesh() []byte {
+	return writeMesh(
+		[]string{"TSpawn", "Mid", "BombsiteA", "Catwalk", "Outside"},
+		[]testArea{
+			{id: 1, nw: mgl32.Vec3{0, 0, 0}, se: mgl32.Vec3{100, 100, 0}, place: 1, connections: [4][]uint32{nav.East: {2}}, visible: []uint32{2}, hidingSpots: true},
+			// a ramp up to z 20
+			{id: 2, nw: mgl32.Vec3{100, 0, 0}, se: mgl32.Vec3{200, 100, 20}, neZ: 20, swZ: 0, place: 2, connections: [4][]uint32{nav.West: {1}, nav.East: {3, 99}}, encounter: true},
+			{id: 3, nw: mgl32.Vec3{200, 0, 20}, se: mgl32.Vec3{300, 100, 20}, neZ: 20, swZ: 20, place: 3, connections: [4][]uint32{nav.West: {2}}, ladders: [2][]uint32{nav.LadderUp: {1}}},
+			{id: 4, nw: mgl32.Vec3{200, 0, 200}, se: mgl32.Vec3{300, 100, 200}, neZ: 200, swZ: 200, place: 4, connections: [4][]uint32{nav.South: {3}}, ladders: [2][]uint32{nav.LadderDown: {1}}},
+			{id: 5, nw: mgl32.Vec3{1000, 1000, 0}, se: mgl32.Vec3{1100, 1100, 0}, place: 5},
+		},
+		[]testLadder{{id: 1, top: mgl32.Vec3{250, 0, 200}, bottom: mgl32.Vec3{250, 0, 20}, topForward: 4, below: 3}},
+	)
+}
+
+func areaIDs(areas []*nav.Area) []uint32 {
+	res := make([]uint32, len(areas))
+
+	for i, a := range areas {
+		res[i] = a.ID
+	}
+
+	return res
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	m, err := nav.Parse(bytes.NewReader(testMesh()))
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint32(16), m.Version)
+	assert.Equal(t, uint32(1234), m.BSPSize)
+	assert.True(t, m.Analyzed)
+	assert.Equal(t, []string{"TSpawn", "Mid", "BombsiteA", "Catwalk", "Outside"}, m.Places)
+	assert.Len(t, m.Areas, 5)
+	assert.Len(t, m.Ladders, 1)
+
+	tSpawn, mid, bombsite, catwalk := m.Area(1), m.Area(2), m.Area(3), m.Area(4)
+
+	assert.Equal(t, "TSpawn", tSpawn.Place)
+	assert.Equal(t, []*nav.Area{mid}, tSpawn.Connections[nav.East])
+	assert.Equal(t, []*nav.Area{bombsite}, mid.Connections[nav.East]) // 99 doesn't exist
+	assert.Equal(t, []nav.HidingSpot{{ID: 7, Position: mgl32.Vec3{1, 2, 0}, Flags: 2}}, tSpawn.HidingSpots)
+	assert.Equal(t, [2]float32{5, 10}, tSpawn.EarliestOccupyTime)
+	assert.Equal(t, []*nav.Area{mid}, tSpawn.PotentiallyVisible)
+	assert.Equal(t, m.Ladders, bombsite.Ladders[nav.LadderUp])
+	assert.Same(t, catwalk, m.Ladders[0].TopForward)
+	assert.Same(t, bombsite, m.Ladders[0].BottomArea)
+	assert.Nil(t, m.Ladders[0].TopLeft)
+	assert.Nil(t, m.Area(99))
+}
+
+func TestParse_Errors(t *testing.T) {
+	t.Parallel()
+
+	data := testMesh()
+
+	for i := 0; i < len(data); i++ {
+		_, err := nav.Parse(bytes.NewReader(data[:i]))
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+
+	_, err := nav.Parse(bytes.NewReader([]byte("not a nav mesh")))
+	assert.ErrorContains(t, err, "magic")
+
+	unsupported := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(unsupported[4:], 17)
+
+	_, err = nav.Parse(bytes.NewReader(unsupported))
+	assert.ErrorContains(t, err, "version")
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	src := bsptracer.NewFSSource(fstest.MapFS{
+		"maps/de_test.nav": {Data: testMesh()},
+	})
+
+	m, err := nav.Load(src, "de_test.bsp")
+	assert.NoError(t, err)
+	assert.Len(t, m.Areas, 5)
+
+	_, err = nav.Load(src, "de_missing")
+	assert.Error(t, err)
+}
+
+func TestArea_Z(t *testing.T) {
+	t.Parallel()
+
+	a := &nav.Area{NorthWest: mgl32.Vec3{0, 0, 0}, SouthEast: mgl32.Vec3{100, 100, 30}, NorthEastZ: 10, SouthWestZ: 20}
+
+	assert.InDelta(t, 0, a.Z(0, 0), 1e-4)
+	assert.InDelta(t, 10, a.Z(100, 0), 1e-4)
+	assert.InDelta(t, 20, a.Z(0, 100), 1e-4)
+	assert.InDelta(t, 30, a.Z(100, 100), 1e-4)
+	assert.InDelta(t, 15, a.Z(50, 50), 1e-4)
+	assert.InDelta(t, 30, a.Z(500, 500), 1e-4) // clamped
+	assert.Equal(t, mgl32.Vec3{50, 50, 15}, a.Center())
+	assert.Equal(t, mgl32.Vec3{100, 50, 20}, a.ClosestPoint(mgl32.Vec3{200, 50, 0}))
+}
+
+func TestNavMesh_AreaAt(t *testing.T) {
+	t.Parallel()
+
+	m, err := nav.Parse(bytes.NewReader(testMesh()))
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		p  mgl32.Vec3
+		id uint32 // 0 for none
+	}{
+		{mgl32.Vec3{50, 50, 10}, 1},
+		{mgl32.Vec3{50, 50, -3}, 1},  // slightly below the ground
+		{mgl32.Vec3{50, 50, 150}, 0}, // too high above
+		{mgl32.Vec3{150, 50, 12}, 2}, // ramp
+		{mgl32.Vec3{250, 50, 30}, 3},
+		{mgl32.Vec3{250, 50, 250}, 4}, // catwalk, bomb site is too far below
+		{mgl32.Vec3{250, 50, 199}, 4},
+		{mgl32.Vec3{250, 50, 130}, 3}, // below the catwalk
+		{mgl32.Vec3{250, 50, 190}, 0}, // too high above the bomb site, below the catwalk
+		{mgl32.Vec3{500, 500, 0}, 0},
+		{mgl32.Vec3{-500, -500, 0}, 0},
+	} {
+		a := m.AreaAt(tc.p)
+
+		if tc.id == 0 {
+			assert.Nil(t, a, "%v", tc.p)
+		} else if assert.NotNil(t, a, "%v", tc.p) {
+			assert.Equal(t, tc.id, a.ID, "%v", tc.p)
+		}
+	}
+
+	assert.Equal(t, "Mid", m.PlaceName(mgl32.Vec3{150, 50, 20}))
+	assert.Equal(t, "Catwalk", m.PlaceName(mgl32.Vec3{250, 50, 260}))
+	assert.Equal(t, "Outside", m.PlaceName(mgl32.Vec3{900, 900, 0})) // nearest area
+	assert.Equal(t, uint32(3), m.NearestArea(mgl32.Vec3{320, 50, 20}).ID)
+}
+
+func TestNavMesh_Path(t *testing.T) {
+	t.Parallel()
+
+	m, err := nav.Parse(bytes.NewReader(testMesh()))
+	assert.NoError(t, err)
+
+	// up the ladder
+	assert.Equal(t, []uint32{1, 2, 3, 4}, areaIDs(m.Path(m.Area(1), m.Area(4))))
+	// dropping down from the catwalk
+	assert.Equal(t, []uint32{4, 3, 2, 1}, areaIDs(m.Path(m.Area(4), m.Area(1))))
+	assert.Equal(t, []uint32{2}, areaIDs(m.Path(m.Area(2), m.Area(2))))
+	assert.Nil(t, m.Path(m.Area(1), m.Area(5)))
+	assert.Nil(t, m.Path(m.Area(5), m.Area(1)))
+	assert.Nil(t, m.Path(nil, m.Area(1)))
+
+	assert.Equal(t, []uint32{1, 2, 3}, areaIDs(m.PathBetween(mgl32.Vec3{10, 10, 0}, mgl32.Vec3{290, 90, 40})))
+}
+
+// wallTracer blocks all lines of sight that cross x = wallX.
+type wallTracer struct {
+	wallX float32
+}
+
+func (w wallTracer) IsVisible(origin, destination mgl32.Vec3) bool {
+	return (origin.X() < w.wallX) == (destination.X() < w.wallX)
+}
+
+func (w wallTracer) TraceBatch(rays []bsptracer.Ray, _ bsptracer.BatchOptions) []bsptracer.Trace {
+	res := make([]bsptracer.Trace, len(rays))
+
+	for i, r := range rays {
+		if w.IsVisible(r.Origin, r.Destination) {
+			res[i].Fraction = 1
+		}
+	}
+
+	return res
+}
+
+func TestVisibility(t *testing.T) {
+	t.Parallel()
+
+	m, err := nav.Parse(bytes.NewReader(testMesh()))
+	assert.NoError(t, err)
+
+	// the wall covers only part of the ramp
+	tracer := wallTracer{wallX: 150}
+
+	assert.True(t, m.Area(2).VisibleFrom(tracer, mgl32.Vec3{50, 50, 64}))
+	assert.False(t, m.Area(3).VisibleFrom(tracer, mgl32.Vec3{50, 50, 64}))
+	assert.True(t, nav.AreasVisible(tracer, m.Area(1), m.Area(2)))
+	assert.True(t, nav.AreasVisible(tracer, m.Area(2), m.Area(1)))
+	assert.False(t, nav.AreasVisible(tracer, m.Area(1), m.Area(3)))
+	// not potentially visible, even without a wall
+	assert.False(t, nav.AreasVisible(wallTracer{wallX: 5000}, m.Area(1), m.Area(5)))
+	assert.True(t, nav.AreasVisible(wallTracer{wallX: 5000}, m.Area(5), m.Area(1)))
+
+	assert.Equal(t, []uint32{1, 2}, areaIDs(m.VisibleAreas(tracer, mgl32.Vec3{50, 50, 64})))
+	assert.Equal(t, []uint32{2, 3, 4, 5}, areaIDs(m.VisibleAreas(tracer, mgl32.Vec3{250, 50, 64})))
+}
@@ -0,0 +1,354 @@
+package nav
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer"
+)
+
+const (
+	navMagic = 0xFEEDFACE
+
+	// minVersion is the oldest supported version, older meshes have no places.
+	minVersion = 5
+	// maxVersion is the version of CS:GO's meshes.
+	maxVersion = 16
+)
+
+// Load loads the navigation mesh of a map ("maps/<mapName>.nav") from a model source, e.g. a VPK or a directory.
+func Load(src bsptracer.ModelSource, mapName string) (*NavMesh, error) {
+	path := "maps/" + strings.TrimSuffix(mapName, ".bsp") + ".nav"
+
+	f, err := src.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// LoadFile loads a navigation mesh from the file system.
+func LoadFile(path string) (*NavMesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses a navigation mesh of Counter-Strike (version 5 to 16), see CNavMesh::Load.
+func Parse(r io.Reader) (*NavMesh, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read nav mesh")
+	}
+
+	p := &parser{b: b}
+	m := p.mesh()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return m, nil
+}
+
+// parser reads little-endian values, after the first error all reads return zero values.
+type parser struct {
+	b   []byte
+	err error
+
+	version uint32
+}
+
+func (p *parser) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+
+	if n > len(p.b) {
+		p.fail(errors.Wrap(io.ErrUnexpectedEOF, "failed to read nav mesh"))
+
+		return nil
+	}
+
+	res := p.b[:n]
+	p.b = p.b[n:]
+
+	return res
+}
+
+func (p *parser) uint8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (p *parser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (p *parser) uint32() uint32 {
+	if b := p.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (p *parser) float32() float32 {
+	return math.Float32frombits(p.uint32())
+}
+
+func (p *parser) vec3() mgl32.Vec3 {
+	return mgl32.Vec3{p.float32(), p.float32(), p.float32()}
+}
+
+// count reads a count of elements that are at least minSize bytes each, limited by the remaining data.
+func (p *parser) count(n, minSize int) int {
+	if n*minSize > len(p.b) {
+		p.fail(errors.Errorf("invalid count %d", n))
+
+		return 0
+	}
+
+	return n
+}
+
+// areaRefs are the unresolved area IDs of an area, they are resolved after all areas were read.
+type areaRefs struct {
+	connections [4][]uint32
+	ladders     [2][]uint32
+	visible     []uint32
+}
+
+func (p *parser) mesh() *NavMesh {
+	if magic := p.uint32(); p.err == nil && magic != navMagic {
+		p.fail(errors.Errorf("invalid magic number %#x, not a nav mesh", magic))
+	}
+
+	m := &NavMesh{
+		Version: p.uint32(),
+	}
+
+	p.version = m.Version
+
+	if p.err == nil && (m.Version < minVersion || m.Version > maxVersion) {
+		p.fail(errors.Errorf("unsupported nav mesh version %d", m.Version))
+	}
+
+	if m.Version >= 10 {
+		m.SubVersion = p.uint32()
+	}
+
+	m.BSPSize = p.uint32()
+
+	if m.Version >= 14 {
+		m.Analyzed = p.uint8() != 0
+	}
+
+	m.Places = make([]string, p.count(int(p.uint16()), 2))
+
+	for i := range m.Places {
+		name := p.bytes(int(p.uint16()))
+		m.Places[i] = strings.TrimRight(string(name), "\x00")
+	}
+
+	if m.Version > 11 {
+		p.uint8() // has unnamed areas
+	}
+
+	m.Areas = make([]*Area, p.count(int(p.uint32()), 40))
+	m.areasByID = make(map[uint32]*Area, len(m.Areas))
+	refs := make([]areaRefs, len(m.Areas))
+
+	for i := range m.Areas {
+		m.Areas[i] = p.area(m.Places, &refs[i])
+		m.areasByID[m.Areas[i].ID] = m.Areas[i]
+	}
+
+	m.Ladders = make([]*Ladder, p.count(int(p.uint32()), 60))
+	laddersByID := make(map[uint32]*Ladder, len(m.Ladders))
+
+	for i := range m.Ladders {
+		m.Ladders[i] = p.ladder(m)
+		laddersByID[m.Ladders[i].ID] = m.Ladders[i]
+	}
+
+	if p.err != nil {
+		return nil
+	}
+
+	// connections to areas and ladders that don't exist are ignored, like in CNavArea::PostLoad
+	for i, a := range m.Areas {
+		for dir, ids := range refs[i].connections {
+			for _, id := range ids {
+				if other := m.areasByID[id]; other != nil {
+					a.Connections[dir] = append(a.Connections[dir], other)
+				}
+			}
+		}
+
+		for dir, ids := range refs[i].ladders {
+			for _, id := range ids {
+				if l := laddersByID[id]; l != nil {
+					a.Ladders[dir] = append(a.Ladders[dir], l)
+				}
+			}
+		}
+
+		for _, id := range refs[i].visible {
+			if other := m.areasByID[id]; other != nil {
+				a.PotentiallyVisible = append(a.PotentiallyVisible, other)
+			}
+		}
+	}
+
+	m.grid = newAreaGrid(m.Areas)
+
+	return m
+}
+
+// area is a port of CNavArea::Load and CCSNavArea::Load.
+func (p *parser) area(places []string, refs *areaRefs) *Area {
+	a := &Area{
+		ID: p.uint32(),
+	}
+
+	switch {
+	case p.version <= 8:
+		a.Attributes = uint32(p.uint8())
+	case p.version <= 12:
+		a.Attributes = uint32(p.uint16())
+	default:
+		a.Attributes = p.uint32()
+	}
+
+	a.NorthWest = p.vec3()
+	a.SouthEast = p.vec3()
+	a.NorthEastZ = p.float32()
+	a.SouthWestZ = p.float32()
+
+	for dir := range refs.connections {
+		refs.connections[dir] = p.ids(p.count(int(p.uint32()), 4))
+	}
+
+	a.HidingSpots = make([]HidingSpot, p.count(int(p.uint8()), 17))
+
+	for i := range a.HidingSpots {
+		a.HidingSpots[i] = HidingSpot{
+			ID:       p.uint32(),
+			Position: p.vec3(),
+			Flags:    p.uint8(),
+		}
+	}
+
+	if p.version < 15 {
+		p.approachAreas()
+	}
+
+	// encounter paths: from ID, from direction, to ID, to direction and spots (ID and position along the path)
+	for n := p.count(int(p.uint32()), 11); n > 0; n-- {
+		p.bytes(10)
+		p.bytes(p.count(int(p.uint8()), 5) * 5)
+	}
+
+	// 1-based, 0 means no place
+	if place := int(p.uint16()); place > 0 && place <= len(places) {
+		a.Place = places[place-1]
+	}
+
+	for dir := range refs.ladders {
+		refs.ladders[dir] = p.ids(p.count(int(p.uint32()), 4))
+	}
+
+	if p.version >= 8 {
+		a.EarliestOccupyTime = [2]float32{p.float32(), p.float32()}
+	}
+
+	if p.version >= 11 {
+		p.bytes(4 * 4) // light intensity of the corners
+	}
+
+	if p.version >= 16 {
+		n := p.count(int(p.uint32()), 5)
+		refs.visible = make([]uint32, 0, n)
+
+		for i := 0; i < n; i++ {
+			refs.visible = append(refs.visible, p.uint32())
+			p.uint8() // visibility attributes
+		}
+
+		p.uint32() // area to inherit visibility from
+	}
+
+	// since version 15 the approach areas are custom data of CCSNavArea
+	if p.version >= 15 {
+		p.approachAreas()
+	}
+
+	return a
+}
+
+// approachAreas skips approach areas: here, prev, how to get from prev to here, next and how to get from here to next.
+func (p *parser) approachAreas() {
+	p.bytes(p.count(int(p.uint8()), 14) * 14)
+}
+
+func (p *parser) ids(n int) []uint32 {
+	ids := make([]uint32, n)
+
+	for i := range ids {
+		ids[i] = p.uint32()
+	}
+
+	return ids
+}
+
+// ladder is a port of CNavLadder::Load.
+func (p *parser) ladder(m *NavMesh) *Ladder {
+	l := &Ladder{
+		ID:        p.uint32(),
+		Width:     p.float32(),
+		Top:       p.vec3(),
+		Bottom:    p.vec3(),
+		Length:    p.float32(),
+		Direction: Direction(p.uint32()),
+	}
+
+	if p.version == 6 {
+		p.uint8() // dangling
+	}
+
+	l.TopForward = m.areasByID[p.uint32()]
+	l.TopLeft = m.areasByID[p.uint32()]
+	l.TopRight = m.areasByID[p.uint32()]
+	l.TopBehind = m.areasByID[p.uint32()]
+	l.BottomArea = m.areasByID[p.uint32()]
+
+	return l
+}
@@ -0,0 +1,141 @@
+package nav
+
+import (
+	"container/heap"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Path returns the shortest path of areas from one area to another (both included) or nil if there is none.
+// It's an A* search over the connections and ladders of the areas, the cost is the distance between area centers.
+// Connections are one-way, e.g. a drop down can't be walked up.
+func (m *NavMesh) Path(from, to *Area) []*Area {
+	if from == nil || to == nil {
+		return nil
+	}
+
+	goal := to.Center()
+
+	nodes := map[*Area]*pathNode{
+		from: {area: from, heuristic: from.Center().Sub(goal).Len()},
+	}
+
+	open := pathQueue{nodes[from]}
+
+	for len(open) > 0 {
+		current := heap.Pop(&open).(*pathNode)
+
+		if current.area == to {
+			return current.path()
+		}
+
+		current.closed = true
+		center := current.area.Center()
+
+		current.area.neighbors(func(next *Area) {
+			cost := current.cost + next.Center().Sub(center).Len()
+
+			n, ok := nodes[next]
+			if !ok {
+				n = &pathNode{area: next, heuristic: next.Center().Sub(goal).Len(), index: -1}
+				nodes[next] = n
+			} else if n.closed || cost >= n.cost {
+				return
+			}
+
+			n.cost = cost
+			n.parent = current
+
+			if n.index < 0 {
+				heap.Push(&open, n)
+			} else {
+				heap.Fix(&open, n.index)
+			}
+		})
+	}
+
+	return nil
+}
+
+// PathBetween is like Path for the areas at two positions, see PlaceName for how the areas are found.
+func (m *NavMesh) PathBetween(from, to mgl32.Vec3) []*Area {
+	return m.Path(m.areaAtOrNearest(from), m.areaAtOrNearest(to))
+}
+
+// neighbors calls visit for all areas that can be reached from the area, through connections and ladders.
+func (a *Area) neighbors(visit func(*Area)) {
+	for _, conns := range a.Connections {
+		for _, next := range conns {
+			visit(next)
+		}
+	}
+
+	for _, l := range a.Ladders[LadderUp] {
+		for _, next := range [...]*Area{l.TopForward, l.TopLeft, l.TopRight, l.TopBehind} {
+			if next != nil {
+				visit(next)
+			}
+		}
+	}
+
+	for _, l := range a.Ladders[LadderDown] {
+		if l.BottomArea != nil {
+			visit(l.BottomArea)
+		}
+	}
+}
+
+type pathNode struct {
+	area      *Area
+	parent    *pathNode
+	cost      float32 // from the start
+	heuristic float32 // estimated cost to the goal
+	closed    bool
+	index     int // in pathQueue, -1 if not queued
+}
+
+func (n *pathNode) path() []*Area {
+	var res []*Area
+
+	for ; n != nil; n = n.parent {
+		res = append(res, n.area)
+	}
+
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+
+	return res
+}
+
+// pathQueue is a priority queue of the open nodes of Path, see container/heap.
+type pathQueue []*pathNode
+
+func (q pathQueue) Len() int {
+	return len(q)
+}
+
+func (q pathQueue) Less(i, j int) bool {
+	return q[i].cost+q[i].heuristic < q[j].cost+q[j].heuristic
+}
+
+func (q pathQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *pathQueue) Push(x any) {
+	n := x.(*pathNode)
+	n.index = len(*q)
+	*q = append(*q, n)
+}
+
+func (q *pathQueue) Pop() any {
+	old := *q
+	n := old[len(old)-1]
+	n.index = -1
+	*q = old[:len(old)-1]
+
+	return n
+}
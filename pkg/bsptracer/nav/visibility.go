@@ -0,0 +1,110 @@
+package nav
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer"
+)
+
+// Tracer traces lines of sight, it's implemented by bsptracer.Map.
+type Tracer interface {
+	IsVisible(origin, destination mgl32.Vec3) bool
+	TraceBatch(rays []bsptracer.Ray, opts bsptracer.BatchOptions) []bsptracer.Trace
+}
+
+var _ Tracer = bsptracer.Map{}
+
+const (
+	// EyeHeight is the height of the eyes of a standing player above the ground.
+	EyeHeight = 64
+	// sampleInset is the distance of corner samples from the edges of an area, so they aren't inside of walls.
+	sampleInset = 16
+)
+
+// samples returns the center and the (inset) corners of the area at EyeHeight above it.
+func (a *Area) samples() [5]mgl32.Vec3 {
+	insetX := mgl32.Clamp(sampleInset, 0, (a.SouthEast[0]-a.NorthWest[0])/2)
+	insetY := mgl32.Clamp(sampleInset, 0, (a.SouthEast[1]-a.NorthWest[1])/2)
+	minX, minY := a.NorthWest[0]+insetX, a.NorthWest[1]+insetY
+	maxX, maxY := a.SouthEast[0]-insetX, a.SouthEast[1]-insetY
+
+	res := [5]mgl32.Vec3{
+		a.Center(),
+		{minX, minY, a.Z(minX, minY)},
+		{maxX, minY, a.Z(maxX, minY)},
+		{minX, maxY, a.Z(minX, maxY)},
+		{maxX, maxY, a.Z(maxX, maxY)},
+	}
+
+	for i := range res {
+		res[i][2] += EyeHeight
+	}
+
+	return res
+}
+
+// VisibleFrom returns true if the eyes of a player standing anywhere in the area may be visible from p,
+// which is checked with IsVisible for the center and corners of the area.
+func (a *Area) VisibleFrom(m Tracer, p mgl32.Vec3) bool {
+	for _, s := range a.samples() {
+		if m.IsVisible(p, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AreasVisible returns true if players standing in the two areas may see each other, see VisibleFrom.
+// If the mesh was analyzed (see Area.PotentiallyVisible) it's used to skip areas that can't be visible.
+func AreasVisible(m Tracer, a, b *Area) bool {
+	if len(a.PotentiallyVisible) > 0 && !containsArea(a.PotentiallyVisible, b) && a != b {
+		return false
+	}
+
+	for _, s := range a.samples() {
+		if b.VisibleFrom(m, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsArea(areas []*Area, a *Area) bool {
+	for _, other := range areas {
+		if other == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VisibleAreas returns all areas of the mesh that are visible from p, see VisibleFrom.
+// The traces are done in parallel with TraceBatch.
+func (m *NavMesh) VisibleAreas(bspMap Tracer, p mgl32.Vec3) []*Area {
+	rays := make([]bsptracer.Ray, 0, len(m.Areas)*5)
+
+	for _, a := range m.Areas {
+		for _, s := range a.samples() {
+			rays = append(rays, bsptracer.Ray{Origin: p, Destination: s})
+		}
+	}
+
+	traces := bspMap.TraceBatch(rays, bsptracer.BatchOptions{Packets: true})
+
+	var res []*Area
+
+	for i, a := range m.Areas {
+		for _, tr := range traces[i*5 : (i+1)*5] {
+			if tr.Fraction >= 1 {
+				res = append(res, a)
+
+				break
+			}
+		}
+	}
+
+	return res
+}
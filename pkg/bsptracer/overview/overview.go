@@ -0,0 +1,210 @@
+// Package overview implements the radar overviews of Counter-Strike maps (resource/overviews/<map>.txt),
+// i.e. the mapping between world and radar image coordinates, and drawing onto radar images.
+package overview
+
+import (
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
+
+	"github.com/saiko-tech/bsp-tracer/internal/keyvalues"
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer"
+)
+
+// DefaultSection is the name of the vertical section that uses the primary radar image.
+const DefaultSection = "default"
+
+// VerticalSection is a level of a multi-level map (e.g. the lower level of de_nuke) that has its own radar image.
+// A position belongs to the section if AltitudeMin <= z < AltitudeMax.
+type VerticalSection struct {
+	Name        string // e.g. "default" or "lower"
+	AltitudeMin float32
+	AltitudeMax float32
+}
+
+// Contains returns true if the height z belongs to the section.
+func (s VerticalSection) Contains(z float32) bool {
+	return z >= s.AltitudeMin && z < s.AltitudeMax
+}
+
+// RadarImage returns the name of the radar image of the section (without extension),
+// e.g. "de_nuke_radar" for the default section and "de_nuke_lower_radar" for the lower section.
+func (s VerticalSection) RadarImage(mapName string) string {
+	if s.Name == "" || strings.EqualFold(s.Name, DefaultSection) {
+		return mapName + "_radar"
+	}
+
+	return mapName + "_" + s.Name + "_radar"
+}
+
+// Overview is the radar overview of a map.
+type Overview struct {
+	Map      string  // name of the map, e.g. "de_nuke"
+	Material string  // e.g. "overviews/de_nuke"
+	PosX     float32 // world x of the left edge of the radar image
+	PosY     float32 // world y of the top edge of the radar image
+	Scale    float32 // world units per radar pixel
+
+	// VerticalSections are the levels of multi-level maps, empty for maps with a single radar image.
+	VerticalSections []VerticalSection
+}
+
+// Load loads the overview of a map ("resource/overviews/<mapName>.txt") from a model source, e.g. a VPK or a directory.
+func Load(src bsptracer.ModelSource, mapName string) (*Overview, error) {
+	path := "resource/overviews/" + strings.TrimSuffix(mapName, ".bsp") + ".txt"
+
+	f, err := src.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// LoadFile loads an overview from the file system.
+func LoadFile(path string) (*Overview, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses an overview in KeyValues format.
+func Parse(r io.Reader) (*Overview, error) {
+	kvs, err := keyvalues.Parse(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse overview")
+	}
+
+	var root *keyvalues.KeyValue
+
+	for _, kv := range kvs {
+		if kv.IsBlock() {
+			root = kv
+
+			break
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("failed to parse overview: no overview block")
+	}
+
+	o := &Overview{
+		Map:      root.Key,
+		Material: root.String("material"),
+	}
+
+	for _, f := range []struct {
+		key string
+		dst *float32
+	}{
+		{"pos_x", &o.PosX},
+		{"pos_y", &o.PosY},
+		{"scale", &o.Scale},
+	} {
+		*f.dst, err = parseFloat32(root, f.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.Scale <= 0 {
+		return nil, errors.Errorf("failed to parse overview: invalid scale %v", o.Scale)
+	}
+
+	if sections := root.Find("verticalsections"); sections != nil {
+		for _, s := range sections.Children {
+			if !s.IsBlock() {
+				continue
+			}
+
+			section := VerticalSection{
+				Name:        s.Key,
+				AltitudeMin: -math.MaxFloat32,
+				AltitudeMax: math.MaxFloat32,
+			}
+
+			if s.Find("AltitudeMin") != nil {
+				if section.AltitudeMin, err = parseFloat32(s, "AltitudeMin"); err != nil {
+					return nil, err
+				}
+			}
+
+			if s.Find("AltitudeMax") != nil {
+				if section.AltitudeMax, err = parseFloat32(s, "AltitudeMax"); err != nil {
+					return nil, err
+				}
+			}
+
+			o.VerticalSections = append(o.VerticalSections, section)
+		}
+	}
+
+	return o, nil
+}
+
+func parseFloat32(kv *keyvalues.KeyValue, key string) (float32, error) {
+	c := kv.Find(key)
+	if c == nil {
+		return 0, errors.Errorf("failed to parse overview: missing %q", key)
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(c.Value), 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse overview: invalid %q", key)
+	}
+
+	return float32(f), nil
+}
+
+// WorldToRadar converts a world position to radar image pixel coordinates.
+// The height is ignored, the pixel coordinates are the same for all vertical sections.
+func (o *Overview) WorldToRadar(p mgl32.Vec3) mgl32.Vec2 {
+	return mgl32.Vec2{
+		(p[0] - o.PosX) / o.Scale,
+		(o.PosY - p[1]) / o.Scale,
+	}
+}
+
+// RadarToWorld converts radar image pixel coordinates to a world position (x and y only).
+func (o *Overview) RadarToWorld(px mgl32.Vec2) mgl32.Vec2 {
+	return mgl32.Vec2{
+		o.PosX + px[0]*o.Scale,
+		o.PosY - px[1]*o.Scale,
+	}
+}
+
+// Section returns the vertical section that contains the height z.
+// If no section contains z (or the map has none) the default section is returned,
+// for maps without vertical sections it covers all heights.
+func (o *Overview) Section(z float32) VerticalSection {
+	for _, s := range o.VerticalSections {
+		if s.Contains(z) {
+			return s
+		}
+	}
+
+	for _, s := range o.VerticalSections {
+		if strings.EqualFold(s.Name, DefaultSection) {
+			return s
+		}
+	}
+
+	return VerticalSection{
+		Name:        DefaultSection,
+		AltitudeMin: -math.MaxFloat32,
+		AltitudeMax: math.MaxFloat32,
+	}
+}
@@ -0,0 +1,176 @@
+package overview_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer"
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/overview"
+)
+
+const nukeOverview = `// HLTV overview description file for de_nuke.bsp
+
+"de_nuke"
+{
+	"material"	"overviews/de_nuke"	// texture file
+	"pos_x"		"-3453"	// upper left world coordinate
+	"pos_y"		"2887"
+	"scale"		"7.0"
+
+	"verticalsections"
+	{
+		"default" // use the primary radar image
+		{
+			"AltitudeMax" "10000"
+			"AltitudeMin" "-495"
+		}
+		"lower" // i.e. de_nuke_lower_radar.dds
+		{
+			"AltitudeMax" "-495"
+			"AltitudeMin" "-10000"
+		}
+	}
+
+	"CTSpawn_x"	"0.82"
+	"CTSpawn_y"	"0.45"
+}
+`
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	o, err := overview.Parse(strings.NewReader(nukeOverview))
+	assert.NoError(t, err)
+	assert.Equal(t, &overview.Overview{
+		Map:      "de_nuke",
+		Material: "overviews/de_nuke",
+		PosX:     -3453,
+		PosY:     2887,
+		Scale:    7,
+		VerticalSections: []overview.VerticalSection{
+			{Name: "default", AltitudeMin: -495, AltitudeMax: 10000},
+			{Name: "lower", AltitudeMin: -10000, AltitudeMax: -495},
+		},
+	}, o)
+}
+
+func TestParse_Errors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		text string
+		err  string
+	}{
+		{`"de_test" { "pos_x" "0" "pos_y" "0"`, "missing '}'"},
+		{`"key" "value"`, "no overview block"},
+		{`"de_test" { "pos_x" "0" "pos_y" "0" }`, `missing "scale"`},
+		{`"de_test" { "pos_x" "abc" "pos_y" "0" "scale" "5" }`, `invalid "pos_x"`},
+		{`"de_test" { "pos_x" "0" "pos_y" "0" "scale" "0" }`, "invalid scale"},
+	} {
+		_, err := overview.Parse(strings.NewReader(tc.text))
+		assert.ErrorContains(t, err, tc.err, tc.text)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	src := bsptracer.NewFSSource(fstest.MapFS{
+		"resource/overviews/de_nuke.txt": {Data: []byte(nukeOverview)},
+	})
+
+	o, err := overview.Load(src, "de_nuke.bsp")
+	assert.NoError(t, err)
+	assert.Equal(t, "de_nuke", o.Map)
+
+	_, err = overview.Load(src, "de_dust2")
+	assert.Error(t, err)
+}
+
+func TestOverview_WorldToRadar(t *testing.T) {
+	t.Parallel()
+
+	o, err := overview.Parse(strings.NewReader(nukeOverview))
+	assert.NoError(t, err)
+
+	assert.Equal(t, mgl32.Vec2{0, 0}, o.WorldToRadar(mgl32.Vec3{-3453, 2887, 0}))
+	assert.Equal(t, mgl32.Vec2{100, 200}, o.WorldToRadar(mgl32.Vec3{-3453 + 700, 2887 - 1400, -600}))
+
+	for _, p := range []mgl32.Vec3{{0, 0, 0}, {-1000, 500, 0}, {1234.5, -2345.5, 0}} {
+		px := o.WorldToRadar(p)
+		assert.True(t, mgl32.Vec2{p[0], p[1]}.ApproxEqualThreshold(o.RadarToWorld(px), 1e-3), "%v", p)
+	}
+}
+
+func TestOverview_Section(t *testing.T) {
+	t.Parallel()
+
+	o, err := overview.Parse(strings.NewReader(nukeOverview))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "default", o.Section(0).Name)
+	assert.Equal(t, "default", o.Section(-495).Name)
+	assert.Equal(t, "lower", o.Section(-600).Name)
+	assert.Equal(t, "default", o.Section(20000).Name, "outside of all sections")
+	assert.Equal(t, "de_nuke_radar", o.Section(0).RadarImage(o.Map))
+	assert.Equal(t, "de_nuke_lower_radar", o.Section(-600).RadarImage(o.Map))
+
+	single := &overview.Overview{Map: "de_dust2", Scale: 4.4}
+	assert.Equal(t, "default", single.Section(-10000).Name)
+	assert.True(t, single.Section(0).Contains(1e6))
+}
+
+func TestRadar(t *testing.T) {
+	t.Parallel()
+
+	o := &overview.Overview{PosX: -100, PosY: 100, Scale: 10}
+	background := image.NewRGBA(image.Rect(0, 0, 20, 20))
+
+	r := overview.NewRadar(o, background)
+	r.DrawVisibility(mgl32.Vec3{-100, 50, 0}, mgl32.Vec3{90, 50, 0}, true)    // row 5
+	r.DrawVisibility(mgl32.Vec3{-50, 100, 0}, mgl32.Vec3{-50, -90, 0}, false) // column 5, drawn last
+	r.DrawTrace(mgl32.Vec3{0, 0, 0}, &bsptracer.Trace{Fraction: 0.5, EndPos: mgl32.Vec3{50, 0, 0}}, color.White)
+
+	assert.Equal(t, overview.ColorVisible, r.Image.At(0, 5))
+	assert.Equal(t, overview.ColorVisible, r.Image.At(19, 5))
+	assert.Equal(t, overview.ColorOccluded, r.Image.At(5, 0))
+	assert.Equal(t, overview.ColorOccluded, r.Image.At(5, 5))
+	assert.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, r.Image.At(12, 10))
+	assert.Equal(t, overview.ColorHit, r.Image.At(15, 10))
+	assert.Equal(t, color.RGBA{}, r.Image.At(0, 0))
+	assert.Equal(t, color.RGBA{}, background.At(0, 5), "background must not be modified")
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.EncodePNG(&buf))
+
+	decoded, err := overview.DecodeRadar(o, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Image.Pix, decoded.Image.Pix)
+
+	_, err = overview.DecodeRadar(o, strings.NewReader("not a png"))
+	assert.Error(t, err)
+
+	assert.Equal(t, image.Rect(0, 0, 1024, 1024), overview.NewRadar(o, nil).Image.Bounds())
+}
+
+func TestDecodeRadar(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	img.SetGray(1, 1, color.Gray{Y: 128})
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+
+	r, err := overview.DecodeRadar(&overview.Overview{Scale: 1}, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 128, G: 128, B: 128, A: 255}, r.Image.At(1, 1))
+}
@@ -0,0 +1,125 @@
+package overview
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer"
+)
+
+// Default colors of Radar.
+var (
+	ColorVisible  = color.RGBA{G: 255, A: 255}
+	ColorOccluded = color.RGBA{R: 255, A: 255}
+	ColorHit      = color.RGBA{R: 255, G: 255, A: 255}
+)
+
+// radarSize is the size of CS:GO's radar images, used if there is no background.
+const radarSize = 1024
+
+// Radar draws world positions, traces and lines of sight onto a radar image.
+type Radar struct {
+	Overview *Overview
+	Image    *image.RGBA
+
+	VisibleColor  color.Color // color of visible lines of sight, see DrawVisibility
+	OccludedColor color.Color // color of occluded lines of sight, see DrawVisibility
+	HitColor      color.Color // color of trace hits, see DrawTrace
+}
+
+// NewRadar returns a radar that draws onto a copy of the background image (usually the radar image of the map).
+// If background is nil a transparent 1024x1024 image is used.
+func NewRadar(o *Overview, background image.Image) *Radar {
+	bounds := image.Rect(0, 0, radarSize, radarSize)
+	if background != nil {
+		bounds = background.Bounds()
+	}
+
+	img := image.NewRGBA(bounds)
+
+	if background != nil {
+		draw.Draw(img, bounds, background, bounds.Min, draw.Src)
+	}
+
+	return &Radar{
+		Overview:      o,
+		Image:         img,
+		VisibleColor:  ColorVisible,
+		OccludedColor: ColorOccluded,
+		HitColor:      ColorHit,
+	}
+}
+
+// DecodeRadar returns a radar that draws onto a PNG radar image, see NewRadar.
+func DecodeRadar(o *Overview, r io.Reader) (*Radar, error) {
+	img, err := png.Decode(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode radar image")
+	}
+
+	return NewRadar(o, img), nil
+}
+
+// EncodePNG writes the radar image as PNG.
+func (r *Radar) EncodePNG(w io.Writer) error {
+	return errors.Wrap(png.Encode(w, r.Image), "failed to encode radar image")
+}
+
+// DrawPoint draws a filled circle at a world position.
+func (r *Radar) DrawPoint(p mgl32.Vec3, radius int, c color.Color) {
+	center := r.Overview.WorldToRadar(p)
+	cx, cy := int(math.Round(float64(center[0]))), int(math.Round(float64(center[1])))
+
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			if x*x+y*y <= radius*radius {
+				r.Image.Set(cx+x, cy+y, c)
+			}
+		}
+	}
+}
+
+// DrawLine draws a line between two world positions.
+func (r *Radar) DrawLine(from, to mgl32.Vec3, c color.Color) {
+	a := r.Overview.WorldToRadar(from)
+	b := r.Overview.WorldToRadar(to)
+	d := b.Sub(a)
+
+	steps := int(math.Ceil(math.Max(math.Abs(float64(d[0])), math.Abs(float64(d[1])))))
+	if steps == 0 {
+		r.Image.Set(int(math.Round(float64(a[0]))), int(math.Round(float64(a[1]))), c)
+
+		return
+	}
+
+	for i := 0; i <= steps; i++ {
+		p := a.Add(d.Mul(float32(i) / float32(steps)))
+		r.Image.Set(int(math.Round(float64(p[0]))), int(math.Round(float64(p[1]))), c)
+	}
+}
+
+// DrawTrace draws a trace from its origin to its end position and marks the end position if something was hit.
+func (r *Radar) DrawTrace(origin mgl32.Vec3, tr *bsptracer.Trace, c color.Color) {
+	r.DrawLine(origin, tr.EndPos, c)
+
+	if tr.Fraction < 1 {
+		r.DrawPoint(tr.EndPos, 2, r.HitColor)
+	}
+}
+
+// DrawVisibility draws a line of sight between two positions in VisibleColor or OccludedColor.
+func (r *Radar) DrawVisibility(from, to mgl32.Vec3, visible bool) {
+	c := r.OccludedColor
+	if visible {
+		c = r.VisibleColor
+	}
+
+	r.DrawLine(from, to, c)
+}
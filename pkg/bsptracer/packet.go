@@ -0,0 +1,225 @@
+package bsptracer
+
+import (
+	"github.com/galaco/bsp/primitives/node"
+	"github.com/galaco/bsp/primitives/plane"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// PacketSize is the number of rays that are traced together, see BatchOptions.Packets.
+const PacketSize = 8
+
+// nodePlanes are the split planes and children of the BSP nodes in struct-of-arrays layout,
+// so a packet of rays can be classified against a node with tight loops over the lanes.
+type nodePlanes struct {
+	normal   [3][]float32
+	dist     []float32
+	axis     []uint8 // plane.AxisType, < 3 for axis aligned planes
+	children [][2]int32
+}
+
+func newNodePlanes(nodes []node.Node, planes []plane.Plane) nodePlanes {
+	res := nodePlanes{
+		dist:     make([]float32, len(nodes)),
+		axis:     make([]uint8, len(nodes)),
+		children: make([][2]int32, len(nodes)),
+	}
+
+	for i := range res.normal {
+		res.normal[i] = make([]float32, len(nodes))
+	}
+
+	for i, n := range nodes {
+		p := planes[n.PlaneNum]
+
+		for j := range res.normal {
+			res.normal[j][i] = p.Normal[j]
+		}
+
+		res.dist[i] = p.Distance
+		res.axis[i] = uint8(p.AxisType)
+		res.children[i] = n.Children
+	}
+
+	return res
+}
+
+// laneMask has one bit per ray of a packet.
+type laneMask uint8
+
+// packetSegment is the part of every ray of a packet that is inside of a node, see rayCastNode.
+type packetSegment struct {
+	startFraction, endFraction [PacketSize]float32
+	origin, destination        [3][PacketSize]float32
+}
+
+// tracePacket is like traceInto for up to PacketSize point traces (ti[i] into out[i]).
+// The traces share the traversal of the BSP tree, which is faster than tracing them one by one
+// if they are coherent, i.e. visit mostly the same nodes.
+// The results are exactly the same as of traceInto.
+func (m Map) tracePacket(ti []traceInfo, out []Trace) {
+	var (
+		seg   packetSegment
+		lanes laneMask
+	)
+
+	for l := range ti {
+		out[l] = Trace{
+			Fraction: 1,
+		}
+
+		seg.endFraction[l] = 1
+
+		for i := 0; i < 3; i++ {
+			seg.origin[i][l] = ti[l].start[i]
+			seg.destination[i][l] = ti[l].end[i]
+		}
+
+		lanes |= 1 << l
+	}
+
+	m.rayCastNodePacket(ti, out, 0, lanes, &seg)
+
+	for l := range ti {
+		m.finishTrace(&ti[l], &out[l])
+	}
+}
+
+// rayCastNodePacket is rayCastNode for the rays in lanes.
+// Every ray visits the same leaves in the same order as with rayCastNode.
+func (m Map) rayCastNodePacket(ti []traceInfo, out []Trace, nodeIndex int32, lanes laneMask, seg *packetSegment) {
+	for l := range ti {
+		if lanes&(1<<l) != 0 && out[l].Fraction <= seg.startFraction[l] {
+			lanes &^= 1 << l
+		}
+	}
+
+	if lanes == 0 {
+		return
+	}
+
+	if nodeIndex < 0 {
+		for l := range ti {
+			if lanes&(1<<l) != 0 {
+				m.rayCastLeaf(&ti[l], -nodeIndex-1, &out[l])
+			}
+		}
+
+		return
+	}
+
+	var startDistance, endDistance [PacketSize]float32
+
+	// all lanes are computed to keep the loops branch free, inactive ones are ignored below
+	if axis := m.nodePlanes.axis[nodeIndex]; axis < 3 {
+		dist := m.nodePlanes.dist[nodeIndex]
+
+		for l := 0; l < PacketSize; l++ {
+			startDistance[l] = seg.origin[axis][l] - dist
+			endDistance[l] = seg.destination[axis][l] - dist
+		}
+	} else {
+		var (
+			nx, ny, nz = m.nodePlanes.normal[0][nodeIndex], m.nodePlanes.normal[1][nodeIndex], m.nodePlanes.normal[2][nodeIndex]
+			dist       = m.nodePlanes.dist[nodeIndex]
+		)
+
+		for l := 0; l < PacketSize; l++ {
+			startDistance[l] = seg.origin[0][l]*nx + seg.origin[1][l]*ny + seg.origin[2][l]*nz - dist
+			endDistance[l] = seg.destination[0][l]*nx + seg.destination[1][l]*ny + seg.destination[2][l]*nz - dist
+		}
+	}
+
+	// point traces have no offset, see rayCastNode
+	var front, back, crossFront, crossBack laneMask
+
+	for l := range ti {
+		bit := laneMask(1 << l)
+
+		switch {
+		case lanes&bit == 0:
+		case startDistance[l] >= 0 && endDistance[l] >= 0:
+			front |= bit
+		case startDistance[l] < 0 && endDistance[l] < 0:
+			back |= bit
+		case startDistance[l] < endDistance[l]:
+			crossBack |= bit
+		default:
+			crossFront |= bit
+		}
+	}
+
+	children := m.nodePlanes.children[nodeIndex]
+
+	if lanes == front {
+		m.rayCastNodePacket(ti, out, children[0], lanes, seg)
+
+		return
+	}
+
+	if lanes == back {
+		m.rayCastNodePacket(ti, out, children[1], lanes, seg)
+
+		return
+	}
+
+	// first holds the segments of the lanes in the child they visit first, second in the other child
+	var first, second packetSegment
+
+	first = *seg
+
+	for l := range ti {
+		if (crossFront|crossBack)&(1<<l) == 0 {
+			continue
+		}
+
+		var fractionFirst, fractionSecond float32
+
+		inversedDistance := 1 / (startDistance[l] - endDistance[l])
+
+		if crossBack&(1<<l) != 0 {
+			fractionFirst = (startDistance[l] - distEpsilon) * inversedDistance
+			fractionSecond = (startDistance[l] + distEpsilon) * inversedDistance
+		} else if endDistance[l] < startDistance[l] {
+			fractionFirst = (startDistance[l] + distEpsilon) * inversedDistance
+			fractionSecond = (startDistance[l] - distEpsilon) * inversedDistance
+		} else {
+			fractionFirst = 1
+			fractionSecond = 0
+		}
+
+		startFraction, endFraction := seg.startFraction[l], seg.endFraction[l]
+
+		fractionFirst = mgl32.Clamp(fractionFirst, 0, 1)
+		first.endFraction[l] = startFraction + (endFraction-startFraction)*fractionFirst
+
+		fractionSecond = mgl32.Clamp(fractionSecond, 0, 1)
+		second.startFraction[l] = startFraction + (endFraction-startFraction)*fractionSecond
+		second.endFraction[l] = endFraction
+
+		for i := 0; i < 3; i++ {
+			origin, destination := seg.origin[i][l], seg.destination[i][l]
+
+			first.destination[i][l] = origin + (destination-origin)*fractionFirst
+			second.origin[i][l] = origin + (destination-origin)*fractionSecond
+			second.destination[i][l] = destination
+		}
+	}
+
+	// lanes that start in front visit the front child first, the others the back child
+	if firstFront := front | crossFront; firstFront != 0 {
+		m.rayCastNodePacket(ti, out, children[0], firstFront, &first)
+
+		if crossFront != 0 {
+			m.rayCastNodePacket(ti, out, children[1], crossFront, &second)
+		}
+	}
+
+	if firstBack := back | crossBack; firstBack != 0 {
+		m.rayCastNodePacket(ti, out, children[1], firstBack, &first)
+
+		if crossBack != 0 {
+			m.rayCastNodePacket(ti, out, children[0], crossBack, &second)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package bsptracer
+
+import (
+	"math"
+
+	"github.com/galaco/bsp"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// WeaponParams are the bullet parameters of a weapon, as found in CS:GO's items_game.txt.
+type WeaponParams struct {
+	Damage        float32 // base damage
+	RangeModifier float32 // damage is multiplied by RangeModifier every 500 units
+	Penetration   float32 // penetration power
+	Range         float32 // maximum distance a bullet can travel
+}
+
+// CS:GO weapon presets for TracePenetration.
+var (
+	WeaponAK47   = WeaponParams{Damage: 36, RangeModifier: 0.98, Penetration: 2, Range: 8192}
+	WeaponM4A4   = WeaponParams{Damage: 33, RangeModifier: 0.97, Penetration: 2, Range: 8192}
+	WeaponM4A1S  = WeaponParams{Damage: 38, RangeModifier: 0.94, Penetration: 2, Range: 8192}
+	WeaponAWP    = WeaponParams{Damage: 115, RangeModifier: 0.99, Penetration: 2.5, Range: 8192}
+	WeaponSSG08  = WeaponParams{Damage: 88, RangeModifier: 0.98, Penetration: 2.5, Range: 8192}
+	WeaponDeagle = WeaponParams{Damage: 63, RangeModifier: 0.81, Penetration: 2, Range: 4096}
+	WeaponUSPS   = WeaponParams{Damage: 35, RangeModifier: 0.91, Penetration: 1, Range: 4096}
+	WeaponGlock  = WeaponParams{Damage: 30, RangeModifier: 0.85, Penetration: 1, Range: 4096}
+)
+
+const (
+	// CS_MASK_SHOOT
+	csMaskShoot = bsp.MASK_SOLID | bsp.CONTENTS_DEBRIS
+
+	maxPenetrationCount    = 4
+	maxPenetrationDistance = 90   // how far TraceToExit looks for the exit of a wall
+	penetrationRange       = 3000 // bullets can't penetrate anything after travelling this far
+	rangeModifierDistance  = 500
+
+	// walls that are less than this many units apart are treated as one, TraceToExit steps through them
+	penetrationMergeDistance = 1
+)
+
+// PenetrationSegment is a solid part of a bullet's path, e.g. a wall.
+type PenetrationSegment struct {
+	Enter, Exit  mgl32.Vec3 // where the bullet enters and (would) exit the solid
+	Thickness    float32
+	EnterSurface Surface // the surface of the entry point, for static props only SurfaceProp is set
+	ExitSurface  Surface // the surface of the exit point, empty if the exit wasn't found
+	Kind         HitKind // what kind of object was entered
+	Contents     int32   // contents of the entered object
+	DamageBefore float32 // damage when hitting the segment (after range falloff)
+	DamageAfter  float32 // damage after penetrating the segment, 0 if it wasn't penetrated
+	Penetrated   bool
+}
+
+// PenetrationResult is the result of TracePenetration.
+type PenetrationResult struct {
+	// Segments are all solids the bullet hit, in order.
+	// The last segment is the one that stopped the bullet, unless it reached the destination.
+	Segments []PenetrationSegment
+	// Damage is the damage at the destination (before hitgroup and armor modifiers), 0 if the bullet didn't reach it.
+	Damage float32
+}
+
+// Wallbang returns true if the bullet reached the destination after penetrating at least one solid.
+func (r *PenetrationResult) Wallbang() bool {
+	return r.Damage > 0 && len(r.Segments) > 0
+}
+
+// TracePenetration simulates a bullet fired from origin at destination with CS:GO's penetration rules
+// (see HandleBulletPenetration with sv_penetration_type 1) and returns every solid the bullet enters,
+// the thickness and materials of those solids and the remaining damage.
+//
+// Surface properties are only known if the map was loaded with the game's VPKs.
+// Walls are detected with the map geometry, which approximates the engine's TraceToExit.
+func (m Map) TracePenetration(origin, destination mgl32.Vec3, weapon WeaponParams) *PenetrationResult {
+	res := new(PenetrationResult)
+
+	dir := destination.Sub(origin)
+	targetDistance := dir.Len()
+
+	if targetDistance == 0 {
+		res.Damage = weapon.Damage
+
+		return res
+	}
+
+	dir = dir.Mul(1 / targetDistance)
+
+	// trace a bit further so exits of walls at the destination are found
+	traceLength := targetDistance + maxPenetrationDistance
+	ti := newTraceInfo(origin, origin.Add(dir.Mul(traceLength)), mgl32.Vec3{}, mgl32.Vec3{}, csMaskShoot)
+	segments := mergeIntersections(m.intersections(ti, false), penetrationMergeDistance/traceLength)
+
+	var (
+		damage           = weapon.Damage
+		distance         = weapon.Range // flDistance, how far the bullet can still travel from src
+		currentDistance  float32        // flCurrentDistance
+		src              float32        // distance of the bullet's current start from origin
+		penetrationsLeft = maxPenetrationCount
+	)
+
+	for _, seg := range segments {
+		enter := seg.enter.EnterFraction * traceLength
+		exit := seg.exit.ExitFraction * traceLength
+
+		if enter < src {
+			continue // inside the last penetrated segment
+		}
+
+		if enter >= targetDistance || enter-src > distance {
+			break
+		}
+
+		currentDistance += enter - src
+		damage *= float32(math.Pow(float64(weapon.RangeModifier), float64(currentDistance/rangeModifierDistance)))
+
+		if currentDistance > penetrationRange && weapon.Penetration > 0 {
+			penetrationsLeft = 0
+		}
+
+		ps := PenetrationSegment{
+			Enter:        origin.Add(dir.Mul(enter)),
+			Exit:         origin.Add(dir.Mul(exit)),
+			Thickness:    exit - enter,
+			EnterSurface: seg.enter.EnterSurface,
+			ExitSurface:  seg.exit.ExitSurface,
+			Kind:         seg.enter.Kind,
+			Contents:     seg.enter.Contents,
+			DamageBefore: damage,
+		}
+
+		damage = m.penetrate(&ps, seg.exit.ExitFraction < 1, damage, weapon.Penetration, penetrationsLeft)
+		ps.DamageAfter = damage
+		ps.Penetrated = damage > 0
+
+		res.Segments = append(res.Segments, ps)
+
+		if !ps.Penetrated {
+			return res
+		}
+
+		src = exit
+		distance = (distance - currentDistance) * 0.5
+		penetrationsLeft--
+	}
+
+	if targetDistance-src > distance {
+		return res // out of range
+	}
+
+	currentDistance += targetDistance - src
+	res.Damage = damage * float32(math.Pow(float64(weapon.RangeModifier), float64(currentDistance/rangeModifierDistance)))
+
+	return res
+}
+
+// penetrate returns the damage after penetrating the segment, or 0 if the bullet is stopped.
+func (m Map) penetrate(ps *PenetrationSegment, exitFound bool, damage, penetration float32, penetrationsLeft int) float32 {
+	enterProps := m.SurfaceProperties(ps.EnterSurface.SurfaceProp)
+	exitProps := m.SurfaceProperties(ps.ExitSurface.SurfaceProp)
+
+	hitGrate := ps.Contents&bsp.CONTENTS_GRATE != 0
+	isNodraw := ps.EnterSurface.Flags&bsp.SURF_NODRAW != 0
+	isGlassOrGrate := enterProps.GameMaterial == GameMaterialGlass || enterProps.GameMaterial == GameMaterialGrate
+
+	// grates, glass and nodraw surfaces are penetrated even without penetration power or penetrations left
+	if !hitGrate && !isNodraw && !isGlassOrGrate && (penetrationsLeft <= 0 || penetration <= 0) {
+		return 0
+	}
+
+	if !exitFound || ps.Thickness > maxPenetrationDistance {
+		return 0
+	}
+
+	damageLostPercent := float32(0.16)
+
+	var penetrationModifier float32
+
+	switch {
+	case isGlassOrGrate:
+		penetrationModifier = 3
+		damageLostPercent = 0.05
+
+	case hitGrate || isNodraw:
+		penetrationModifier = 1
+
+	default:
+		penetrationModifier = (enterProps.PenetrationModifier + exitProps.PenetrationModifier) / 2
+	}
+
+	if enterProps.GameMaterial == exitProps.GameMaterial {
+		switch exitProps.GameMaterial {
+		case GameMaterialWood, GameMaterialCardboard:
+			penetrationModifier = 3
+
+		case GameMaterialPlastic:
+			penetrationModifier = 2
+		}
+	}
+
+	var penModInv float32
+	if penetrationModifier > 0 {
+		penModInv = 1 / penetrationModifier
+	}
+
+	var weaponLoss float32
+	if penetration > 0 {
+		weaponLoss = 3 / penetration * 1.25
+	}
+
+	damageChunk := damage * damageLostPercent
+	penWeaponMod := damageChunk + weaponLoss*(penModInv*3)
+	lostDamageObject := penModInv * ps.Thickness * ps.Thickness / 24
+
+	damage -= float32(math.Max(0, float64(penWeaponMod+lostDamageObject)))
+	if damage < 1 {
+		return 0
+	}
+
+	return damage
+}
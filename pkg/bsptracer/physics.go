@@ -0,0 +1,207 @@
+package bsptracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/galaco/studiomodel/mdl"
+	"github.com/galaco/studiomodel/phy"
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/saiko-tech/bsp-tracer/internal/keyvalues"
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
+)
+
+// phyText returns the key-values text section at the end of a .phy file,
+// it follows the collision data of all solids.
+func phyText(b []byte, p *phy.Phy) string {
+	offset := int(p.Header.Size)
+
+	for _, s := range p.CompactSurfaces {
+		offset += int(s.Size) + 4
+	}
+
+	if offset <= 0 || offset >= len(b) {
+		return ""
+	}
+
+	text := b[offset:]
+	if end := bytes.IndexByte(text, 0); end >= 0 {
+		text = text[:end]
+	}
+
+	return string(text)
+}
+
+// phySolidBones returns the bone names of the solids of a .phy file by solid index,
+// see the "solid" blocks of the text section.
+func phySolidBones(text string) map[int]string {
+	kvs, err := keyvalues.Parse(strings.NewReader(text))
+	if err != nil {
+		return nil
+	}
+
+	res := make(map[int]string)
+
+	for _, kv := range kvs {
+		if !strings.EqualFold(kv.Key, "solid") {
+			continue
+		}
+
+		index, err := strconv.Atoi(kv.String("index"))
+		if err != nil {
+			continue
+		}
+
+		res[index] = kv.String("name")
+	}
+
+	return res
+}
+
+// boneNames returns the names of all bones of a model, mdlBytes is the raw .mdl file.
+func boneNames(mdlBytes []byte, m *mdl.Mdl) []string {
+	size := int32(binary.Size(mdl.Bone{}))
+	res := make([]string, len(m.Bones))
+
+	for i, b := range m.Bones {
+		res[i] = cString(mdlBytes, m.Header.BoneOffset+int32(i)*size+b.NameIndex)
+	}
+
+	return res
+}
+
+// phySolids returns the convex solids of a physics model as triangles in model space.
+// The vertices of models with multiple solids (e.g. ragdolls) are in the space of the solid's bone,
+// they are transformed back to model space with the bone's PoseToBone matrix.
+// solidBones are the bone names by solid index, see phySolidBones().
+func phySolids(p *phy.Phy, m *mdl.Mdl, bones []string, solidBones map[int]string) [][][3]mgl32.Vec3 {
+	if p == nil {
+		return nil
+	}
+
+	var (
+		res   [][][3]mgl32.Vec3
+		faces = p.TriangleFaces
+		verts = p.Vertices
+		// the phy reader skips some solids, we can only map them to bones if none were skipped
+		mapBones = p.Header.SolidCount > 1 && len(p.TriangleFaceHeaders) == int(p.Header.SolidCount)
+	)
+
+	for i, h := range p.TriangleFaceHeaders {
+		if int(h.FaceCount) > len(faces) {
+			break
+		}
+
+		solidFaces := faces[:h.FaceCount]
+		faces = faces[h.FaceCount:]
+
+		// vertices are stored per solid, the reader reads up to the highest index
+		numVerts := 0
+
+		for _, f := range solidFaces {
+			for _, v := range [3]uint16{f.V1, f.V2, f.V3} {
+				if int(v) >= numVerts {
+					numVerts = int(v) + 1
+				}
+			}
+		}
+
+		if numVerts > len(verts) {
+			break
+		}
+
+		solidVerts := verts[:numVerts]
+		verts = verts[numVerts:]
+
+		var bone *mdl.Bone
+
+		if mapBones {
+			bone = findBone(m, bones, solidBones[i])
+		}
+
+		tris := make([][3]mgl32.Vec3, len(solidFaces))
+
+		for j, f := range solidFaces {
+			tris[j] = [3]mgl32.Vec3{
+				transformPhyVertex(bone, solidVerts[f.V1].Vec3()),
+				transformPhyVertex(bone, solidVerts[f.V2].Vec3()),
+				transformPhyVertex(bone, solidVerts[f.V3].Vec3()),
+			}
+		}
+
+		res = append(res, tris)
+	}
+
+	return res
+}
+
+func findBone(m *mdl.Mdl, bones []string, name string) *mdl.Bone {
+	if name == "" {
+		return nil
+	}
+
+	for i, n := range bones {
+		if strings.EqualFold(n, name) {
+			return &m.Bones[i]
+		}
+	}
+
+	return nil
+}
+
+func vectorITransform(in1 mgl32.Vec3, in2 mgl32.Mat3x4) (out mgl32.Vec3) {
+	t := mgl32.Vec3{}
+	t[0] = in1[0] - in2.Col(3)[0]
+	t[1] = in1[1] - in2.Col(3)[1]
+	t[2] = in1[2] - in2.Col(3)[2]
+
+	out[0] = t[0]*in2.Col(0)[0] + t[1]*in2.Col(0)[1] + t[2]*in2.Col(0)[2]
+	out[1] = t[0]*in2.Col(1)[0] + t[1]*in2.Col(1)[1] + t[2]*in2.Col(1)[2]
+	out[2] = t[0]*in2.Col(2)[0] + t[1]*in2.Col(2)[1] + t[2]*in2.Col(2)[2]
+
+	return out
+}
+
+// transformPhyVertex converts a phy vertex (meters, physics axes) to model space.
+func transformPhyVertex(bone *mdl.Bone, vertex mgl32.Vec3) (out mgl32.Vec3) {
+	out[0] = 1 / 0.0254 * vertex[0]
+	out[1] = 1 / 0.0254 * vertex[2]
+	out[2] = 1 / 0.0254 * -vertex[1]
+
+	if bone != nil {
+		out = vectorITransform(out, bone.PoseToBone)
+	} else {
+		out[0] = 1 / 0.0254 * vertex[2]
+		out[1] = 1 / 0.0254 * -vertex[0]
+		out[2] = 1 / 0.0254 * -vertex[1]
+	}
+
+	return out
+}
+
+// convexHulls returns the convex solids of the model placed at origin with the given angles and scale.
+func convexHulls(m *model, origin, angles mgl32.Vec3, scale float32) []collision.ConvexHull {
+	if len(m.phySolids) == 0 {
+		return nil
+	}
+
+	rotation := angleMatrix(angles)
+	res := make([]collision.ConvexHull, 0, len(m.phySolids))
+
+	for _, solid := range m.phySolids {
+		tris := make([][3]mgl32.Vec3, len(solid))
+
+		for i, t := range solid {
+			for j, v := range t {
+				tris[i][j] = origin.Add(rotation.Mul3x1(v).Mul(scale))
+			}
+		}
+
+		res = append(res, collision.NewConvexHull(tris))
+	}
+
+	return res
+}
@@ -7,12 +7,11 @@ import (
 )
 
 type polygon struct {
-	verts      [maxSurfinfoVerts]mgl32.Vec3
-	numVerts   int
-	plane      vplane
-	edgePlanes []vplane
-	vec2d      [maxSurfinfoVerts]mgl32.Vec3
-	skip       int
+	verts    [maxSurfinfoVerts]mgl32.Vec3
+	numVerts int
+	plane    vplane
+	vec2d    [maxSurfinfoVerts]mgl32.Vec3
+	skip     int
 }
 
 type vplane struct {
@@ -31,13 +30,15 @@ func buildPolygons(bspfile *bsp.Bsp) []polygon {
 	edges := bspfile.Lump(bsp.LumpEdges).(*lumps.Edge).GetData()
 	planes := bspfile.Lump(bsp.LumpPlanes).(*lumps.Planes).GetData()
 
-	polygons := make([]polygon, len(surfaces), 2*len(surfaces))
+	// polygons are indexed like the faces lump, faces that can't be traced against have no vertices
+	polygons := make([]polygon, len(surfaces))
 
-	for _, surface := range surfaces {
+	for faceIndex, surface := range surfaces {
 		firstEdge := int(surface.FirstEdge)
 		numEdges := int(surface.NumEdges)
 
-		if numEdges < 3 || numEdges > maxSurfinfoVerts || surface.TexInfo <= 0 {
+		// displacements are traced against their triangles, not their base faces
+		if numEdges < 3 || numEdges > maxSurfinfoVerts || surface.TexInfo <= 0 || surface.DispInfo >= 0 {
 			continue
 		}
 
@@ -60,7 +61,7 @@ func buildPolygons(bspfile *bsp.Bsp) []polygon {
 		poly.numVerts = numEdges
 		poly.plane.origin = planes[surface.Planenum].Normal
 		poly.plane.distance = planes[surface.Planenum].Distance
-		polygons = append(polygons, poly)
+		polygons[faceIndex] = poly
 	}
 
 	return polygons
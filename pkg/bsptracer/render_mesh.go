@@ -0,0 +1,170 @@
+package bsptracer
+
+import (
+	"encoding/binary"
+
+	"github.com/galaco/studiomodel/mdl"
+	"github.com/galaco/studiomodel/vtx"
+	"github.com/galaco/studiomodel/vvd"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// sizes of the studio model structs that aren't parsed by the studiomodel package.
+const (
+	mdlBodyPartSize = 16  // mstudiobodyparts_t
+	mdlModelSize    = 148 // mstudiomodel_t
+	mdlMeshSize     = 116 // mstudiomesh_t
+	vvdVertexSize   = 48  // mstudiovertex_t
+)
+
+// mdlMeshVertexOffsets returns the index of the first vertex of every mesh by body part, model and mesh.
+// It reads the body part tables of the raw .mdl file, returns nil if they are malformed.
+func mdlMeshVertexOffsets(mdlBytes []byte, m *mdl.Mdl) [][][]int {
+	le := binary.LittleEndian
+
+	i32 := func(off int) (int, bool) {
+		if off < 0 || off+4 > len(mdlBytes) {
+			return 0, false
+		}
+
+		return int(int32(le.Uint32(mdlBytes[off:]))), true
+	}
+
+	res := make([][][]int, m.Header.BodyPartCount)
+
+	for i := range res {
+		bodyPart := int(m.Header.BodypartOffset) + i*mdlBodyPartSize
+
+		numModels, ok1 := i32(bodyPart + 4)
+		modelIndex, ok2 := i32(bodyPart + 12)
+
+		if !ok1 || !ok2 || numModels < 0 {
+			return nil
+		}
+
+		res[i] = make([][]int, numModels)
+
+		for j := range res[i] {
+			model := bodyPart + modelIndex + j*mdlModelSize
+
+			numMeshes, ok1 := i32(model + 72)
+			meshIndex, ok2 := i32(model + 76)
+			vertexIndex, ok3 := i32(model + 84) // byte offset into the vertex data
+
+			if !ok1 || !ok2 || !ok3 || numMeshes < 0 {
+				return nil
+			}
+
+			res[i][j] = make([]int, numMeshes)
+
+			for k := range res[i][j] {
+				vertexOffset, ok := i32(model + meshIndex + k*mdlMeshSize + 12)
+				if !ok {
+					return nil
+				}
+
+				res[i][j][k] = vertexIndex/vvdVertexSize + vertexOffset
+			}
+		}
+	}
+
+	return res
+}
+
+// lod0Vertices returns the vertex positions of the highest level of detail, see Studio_LoadVertexes.
+func lod0Vertices(v *vvd.Vvd) []mgl32.Vec3 {
+	var res []mgl32.Vec3
+
+	if len(v.Fixups) == 0 {
+		res = make([]mgl32.Vec3, len(v.Vertices))
+
+		for i, vert := range v.Vertices {
+			res[i] = vert.Position
+		}
+
+		return res
+	}
+
+	for _, f := range v.Fixups {
+		if f.Lod < 0 {
+			continue
+		}
+
+		end := int(f.SourceVertexID + f.NumVertexes)
+		if f.SourceVertexID < 0 || end > len(v.Vertices) {
+			return nil
+		}
+
+		for _, vert := range v.Vertices[f.SourceVertexID:end] {
+			res = append(res, vert.Position)
+		}
+	}
+
+	return res
+}
+
+// renderMeshTriangles returns the triangles of the LOD0 render mesh in model space.
+// Strip groups are read as triangle lists, which is what studiomdl has been writing for ages.
+// Returns nil if the model files don't match.
+func renderMeshTriangles(mdlBytes []byte, m *mdl.Mdl, v *vvd.Vvd, x *vtx.Vtx) [][3]mgl32.Vec3 {
+	if m == nil || v == nil || x == nil {
+		return nil
+	}
+
+	offsets := mdlMeshVertexOffsets(mdlBytes, m)
+	vertices := lod0Vertices(v)
+
+	if len(offsets) != len(x.BodyParts) {
+		return nil
+	}
+
+	var res [][3]mgl32.Vec3
+
+	for i, bodyPart := range x.BodyParts {
+		if len(offsets[i]) != len(bodyPart.Models) {
+			return nil
+		}
+
+		for j, model := range bodyPart.Models {
+			if len(model.LODS) == 0 {
+				continue
+			}
+
+			meshes := model.LODS[0].Meshes
+			if len(offsets[i][j]) != len(meshes) {
+				return nil
+			}
+
+			for k, mesh := range meshes {
+				for _, sg := range mesh.StripGroups {
+					vertex := func(index uint16) (mgl32.Vec3, bool) {
+						if int(index) >= len(sg.Vertexes) {
+							return mgl32.Vec3{}, false
+						}
+
+						vi := offsets[i][j][k] + int(sg.Vertexes[index].OriginalMeshVertexID)
+						if vi < 0 || vi >= len(vertices) {
+							return mgl32.Vec3{}, false
+						}
+
+						return vertices[vi], true
+					}
+
+					for t := 0; t+2 < len(sg.Indices); t += 3 {
+						a, okA := vertex(sg.Indices[t])
+						b, okB := vertex(sg.Indices[t+1])
+						c, okC := vertex(sg.Indices[t+2])
+
+						if !okA || !okB || !okC {
+							return nil
+						}
+
+						res = append(res, [3]mgl32.Vec3{a, b, c})
+					}
+				}
+			}
+		}
+	}
+
+	return res
+}
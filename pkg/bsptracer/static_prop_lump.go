@@ -0,0 +1,222 @@
+package bsptracer
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+
+	"github.com/galaco/bsp/lumps"
+	"github.com/galaco/bsp/primitives/game"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/pkg/errors"
+)
+
+// staticPropLump is the static prop game lump ("sprp").
+// It's parsed here instead of using the bsp package because its v11 layout is wrong
+// (UniformScale is read from the padding after DisableX360) and it doesn't support newer versions.
+type staticPropLump struct {
+	names  []string // model names, indexed by prop type
+	leaves []uint16 // leaves of all props
+	props  []staticPropEntry
+}
+
+type staticPropEntry struct {
+	StaticProp
+
+	propType             uint16 // index in names
+	firstLeaf, leafCount uint16 // range in leaves
+}
+
+// minStaticPropSizes are the sizes of a static prop entry by lump version.
+var minStaticPropSizes = map[uint16]int{
+	4:  56,
+	5:  60,
+	6:  64,
+	7:  68,
+	8:  68,
+	9:  72,
+	10: 76,
+	11: 80,
+}
+
+// latestStaticPropVersion is the newest version we know the layout of,
+// newer versions are read like it if their entries are at least as big.
+const latestStaticPropVersion = 11
+
+// readStaticPropLump reads the static prop game lump, a missing lump is not an error.
+func readStaticPropLump(gameLump *lumps.Game) (staticPropLump, error) {
+	for i, def := range gameLump.Header.GameLumps {
+		if def.Id != game.StaticPropLumpId {
+			continue
+		}
+
+		lump, err := parseStaticPropLump(gameLump.GameLumps[i].Data, def.Version)
+
+		return lump, errors.Wrapf(err, "failed to parse static prop lump v%d", def.Version)
+	}
+
+	return staticPropLump{}, nil
+}
+
+// lumpReader reads little-endian values from a byte slice and remembers the first error.
+type lumpReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *lumpReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if n < 0 || r.off+n > len(r.b) {
+		r.err = errors.Errorf("unexpected end of lump at offset %d (reading %d bytes of %d)", r.off, n, len(r.b))
+
+		return make([]byte, n)
+	}
+
+	b := r.b[r.off : r.off+n]
+	r.off += n
+
+	return b
+}
+
+func (r *lumpReader) int32() int32 {
+	return int32(binary.LittleEndian.Uint32(r.next(4)))
+}
+
+func (r *lumpReader) uint8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *lumpReader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(r.next(2))
+}
+
+func (r *lumpReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *lumpReader) float32() float32 {
+	return math.Float32frombits(r.uint32())
+}
+
+func parseStaticPropLump(b []byte, version uint16) (staticPropLump, error) {
+	var (
+		lump staticPropLump
+		r    = &lumpReader{b: b}
+	)
+
+	numNames := r.int32()
+	if numNames < 0 {
+		return lump, errors.Errorf("invalid number of model names %d", numNames)
+	}
+
+	for i := int32(0); i < numNames && r.err == nil; i++ {
+		lump.names = append(lump.names, strings.TrimRight(string(r.next(128)), "\x00"))
+	}
+
+	numLeaves := r.int32()
+	if numLeaves < 0 {
+		return lump, errors.Errorf("invalid number of leaves %d", numLeaves)
+	}
+
+	leaves := r.next(2 * int(numLeaves))
+	lump.leaves = make([]uint16, numLeaves)
+
+	for i := range lump.leaves {
+		lump.leaves[i] = binary.LittleEndian.Uint16(leaves[2*i:])
+	}
+
+	numProps := int(r.int32())
+
+	if r.err != nil {
+		return lump, r.err
+	}
+
+	if numProps <= 0 {
+		return lump, nil
+	}
+
+	minSize, ok := minStaticPropSizes[version]
+	if !ok && version > latestStaticPropVersion {
+		minSize = minStaticPropSizes[latestStaticPropVersion]
+	} else if !ok {
+		return lump, errors.Errorf("unsupported static prop lump version %d", version)
+	}
+
+	// newer versions may append fields, derive the entry size from the lump size
+	size := (len(b) - r.off) / numProps
+	if size < minSize {
+		return lump, errors.Errorf("static prop entries are too small (%d bytes, expected at least %d)", size, minSize)
+	}
+
+	for i := 0; i < numProps; i++ {
+		entry := r.next(size)
+
+		p := parseStaticProp(entry, version)
+		if int(p.propType) >= len(lump.names) {
+			return lump, errors.Errorf("static prop %d has invalid model index %d", i, p.propType)
+		}
+
+		if int(p.firstLeaf)+int(p.leafCount) > len(lump.leaves) {
+			return lump, errors.Errorf("static prop %d has invalid leaves %d+%d", i, p.firstLeaf, p.leafCount)
+		}
+
+		p.Index = i
+		p.Model = lump.names[p.propType]
+
+		lump.props = append(lump.props, p)
+	}
+
+	return lump, r.err
+}
+
+// parseStaticProp parses a single static prop entry, see StaticPropLump_t in gamebspfile.h.
+func parseStaticProp(b []byte, version uint16) (p staticPropEntry) {
+	le := binary.LittleEndian
+
+	vec3 := func(off int) mgl32.Vec3 {
+		return mgl32.Vec3{
+			math.Float32frombits(le.Uint32(b[off:])),
+			math.Float32frombits(le.Uint32(b[off+4:])),
+			math.Float32frombits(le.Uint32(b[off+8:])),
+		}
+	}
+
+	f32 := func(off int) float32 {
+		return math.Float32frombits(le.Uint32(b[off:]))
+	}
+
+	p.Origin = vec3(0)
+	p.Angles = vec3(12)
+	p.propType = le.Uint16(b[24:])
+	p.firstLeaf = le.Uint16(b[26:])
+	p.leafCount = le.Uint16(b[28:])
+	p.Solid = int(b[30])
+	p.Flags = b[31]
+	p.Skin = int32(le.Uint32(b[32:]))
+	p.FadeMinDist = f32(36)
+	p.FadeMaxDist = f32(40)
+	// 44: lighting origin, 56: forced fade scale (v5+)
+	// v6 and v7: 60: min / max DX level, v7: 64: diffuse modulation
+	// v8+: 60: min / max CPU and GPU level, 64: diffuse modulation
+	p.UniformScale = 1
+
+	if version >= 9 {
+		p.DisableX360 = b[68] != 0
+	}
+
+	if version >= 10 {
+		p.FlagsEx = le.Uint32(b[72:])
+	}
+
+	if version >= 11 {
+		if s := f32(76); s > 0 && !math.IsInf(float64(s), 0) {
+			p.UniformScale = s
+		}
+	}
+
+	return p
+}
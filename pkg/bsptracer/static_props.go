@@ -1,106 +1,243 @@
 package bsptracer
 
 import (
-	"github.com/galaco/bsp"
-	"github.com/galaco/bsp/lumps"
-	"github.com/galaco/bsp/primitives/game"
-	"github.com/galaco/studiomodel"
-	"github.com/galaco/studiomodel/mdl"
-	"github.com/galaco/studiomodel/phy"
 	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/saiko-tech/bsp-tracer/pkg/bsptracer/collision"
 )
 
-type staticProp struct {
-	prop      game.IStaticPropDataLump
-	model     *studiomodel.StudioModel
-	triangles [][3]mgl32.Vec3
-	min, max  mgl32.Vec3 // AABB extents
+// propCollision is the collision model of a prop in world space.
+type propCollision struct {
+	solid        int                           // Solid*
+	hulls        []collision.ConvexHull        // convex solids of the physics model, or the hull of the render mesh for PhysicsFallbackHull
+	hullTree     collision.BVH                 // over hulls
+	triangles    [][3]mgl32.Vec3               // render mesh, only for PhysicsFallbackRenderMesh
+	triangleTree collision.BVH                 // over triangles
+	obb          collision.OrientedBoundingBox // hull of the model, used for SolidOBB, SolidOBBYaw and as fallback
+	min, max     mgl32.Vec3                    // AABB extents
+	fallback     bool                          // SolidVPhysics without physics data, see PhysicsFallback
 }
 
-func vectorITransform(in1 mgl32.Vec3, in2 mgl32.Mat3x4) (out mgl32.Vec3) {
-	t := mgl32.Vec3{}
-	t[0] = in1[0] - in2.Col(3)[0]
-	t[1] = in1[1] - in2.Col(3)[1]
-	t[2] = in1[2] - in2.Col(3)[2]
+// newPropCollision places the collision model of mdl at origin with the given angles and scale.
+// mdl may be nil for missing models, the prop is not solid then.
+// fallback is used for SolidVPhysics if the model has no physics data.
+func newPropCollision(solid int, mdl *model, origin, angles mgl32.Vec3, scale float32, fallback PhysicsFallback) propCollision {
+	p := propCollision{solid: solid}
+
+	if mdl == nil {
+		p.solid = SolidNone
+
+		return p
+	}
+
+	hullAngles := angles
+	if solid == SolidOBBYaw {
+		hullAngles = mgl32.Vec3{0, angles[1], 0}
+	}
+
+	p.obb = collision.NewOrientedBoundingBox(mdl.hullMin.Mul(scale), mdl.hullMax.Mul(scale), origin, angleMatrix(hullAngles))
+
+	p.hulls = convexHulls(mdl, origin, angles, scale)
+
+	if len(p.hulls) == 0 && solid == SolidVPhysics {
+		p.fallback = true
+
+		switch fallback {
+		case PhysicsFallbackNone:
+			p.solid = SolidNone
+
+		case PhysicsFallbackRenderMesh:
+			p.triangles = transformTriangles(mdl.renderMesh, origin, angles, scale)
+
+		case PhysicsFallbackHull:
+			if hull, ok := renderMeshHull(mdl, origin, angles, scale); ok {
+				p.hulls = []collision.ConvexHull{hull}
+			} else {
+				p.solid = SolidOBB
+			}
+		}
+	}
+
+	p.buildTrees()
+
+	if len(p.triangles) > 0 {
+		p.min, p.max = extents(p.triangles)
+	}
+
+	if len(p.hulls) == 0 {
+		if len(p.triangles) == 0 {
+			p.min, p.max = p.obb.Bounds()
+		}
+
+		return p
+	}
+
+	p.min, p.max = p.hulls[0].Min, p.hulls[0].Max
 
-	out[0] = t[0]*in2.Col(0)[0] + t[1]*in2.Col(0)[1] + t[2]*in2.Col(0)[2]
-	out[1] = t[0]*in2.Col(1)[0] + t[1]*in2.Col(1)[1] + t[2]*in2.Col(1)[2]
-	out[2] = t[0]*in2.Col(2)[0] + t[1]*in2.Col(2)[1] + t[2]*in2.Col(2)[2]
+	for _, h := range p.hulls[1:] {
+		for i := 0; i < 3; i++ {
+			if h.Min[i] < p.min[i] {
+				p.min[i] = h.Min[i]
+			}
+
+			if h.Max[i] > p.max[i] {
+				p.max[i] = h.Max[i]
+			}
+		}
+	}
 
-	return out
+	return p
 }
 
-func transformPhyVertex(bone *mdl.Bone, vertex mgl32.Vec3, orientation mgl32.Quat) (out mgl32.Vec3) {
-	out[0] = 1 / 0.0254 * vertex[0]
-	out[1] = 1 / 0.0254 * vertex[2]
-	out[2] = 1 / 0.0254 * -vertex[1]
-
-	if bone != nil {
-		out = vectorITransform(out, bone.PoseToBone)
-	} else {
-		out[0] = 1 / 0.0254 * vertex[2]
-		out[1] = 1 / 0.0254 * -vertex[0]
-		out[2] = 1 / 0.0254 * -vertex[1]
+// buildTrees builds the bounding volume hierarchies over the hulls and triangles.
+func (p *propCollision) buildTrees() {
+	p.triangleTree = collision.NewTriangleBVH(p.triangles)
+
+	mins := make([]mgl32.Vec3, len(p.hulls))
+	maxs := make([]mgl32.Vec3, len(p.hulls))
+
+	for i, h := range p.hulls {
+		mins[i], maxs[i] = h.Min, h.Max
 	}
 
-	return orientation.Rotate(out)
+	p.hullTree = collision.NewBVH(mins, maxs)
 }
 
-func triangles(prop game.IStaticPropDataLump, phy *phy.Phy) [][3]mgl32.Vec3 {
-	if phy == nil {
-		return nil
+// effectiveSolid returns the solid type that is actually used for collision.
+// Like the engine, SolidBSP and SolidCustom use the physics model of the prop if there is one and the hull otherwise.
+func (p *propCollision) effectiveSolid() int {
+	switch p.solid {
+	case SolidBSP, SolidCustom:
+		if len(p.hulls) > 0 {
+			return SolidVPhysics
+		}
+
+		return SolidOBB
 	}
 
-	angles := prop.GetAngles()
-	orientation := mgl32.AnglesToQuat(mgl32.DegToRad(angles[0]), mgl32.DegToRad(angles[1]), mgl32.DegToRad(angles[2]), mgl32.YZX)
+	return p.solid
+}
+
+// Static prop flags, see StaticProp.Flags.
+const (
+	StaticPropFlagFades               = 0x1
+	StaticPropFlagUseLightingOrigin   = 0x2
+	StaticPropFlagNoDraw              = 0x4
+	StaticPropFlagIgnoreNormals       = 0x8
+	StaticPropFlagNoShadow            = 0x10
+	StaticPropFlagNoPerVertexLighting = 0x40
+	StaticPropFlagNoSelfShadowing     = 0x80
+)
+
+// StaticProp is a prop_static of the map, see Map.StaticProps().
+type StaticProp struct {
+	Index        int        // index in the static prop game lump, see Trace.StaticProp
+	Model        string     // e.g. "models/props/de_cache/bench/bench.mdl"
+	Origin       mgl32.Vec3 // position of the prop
+	Angles       mgl32.Vec3 // orientation of the prop (pitch, yaw, roll in degrees)
+	UniformScale float32    // scale of the prop, 1 for lump versions before v11
+	Solid        int        // Solid*, props with SolidNone don't collide
+	Skin         int32
+	Flags        uint8  // StaticPropFlag*
+	FlagsEx      uint32 // extended flags (v10+)
+	FadeMinDist  float32
+	FadeMaxDist  float32
+	DisableX360  bool // v9+
+
+	// CollisionFallback is true if the prop is SolidVPhysics but its model has no physics data,
+	// its collision is defined by LoadOptions.PhysicsFallback then.
+	CollisionFallback bool
+}
+
+type staticProp struct {
+	StaticProp
+	propCollision
+
+	model *model
+}
+
+// loadStaticProps places the collision models of all solid static props and sorts them into the leaves they touch.
+func loadStaticProps(lump staticPropLump, models []*model, fallback PhysicsFallback) ([]staticProp, map[uint16][]*staticProp) {
+	var props []staticProp
 
-	out := make([][3]mgl32.Vec3, len(phy.TriangleFaces))
+	for index := range lump.props {
+		p := &lump.props[index]
+		if p.Solid == SolidNone {
+			continue // not in the collision lists of the engine either
+		}
 
-	for i, t := range phy.TriangleFaces {
-		a := prop.GetOrigin().Add(transformPhyVertex(nil, phy.Vertices[t.V1].Vec3(), orientation))
-		b := prop.GetOrigin().Add(transformPhyVertex(nil, phy.Vertices[t.V2].Vec3(), orientation))
-		c := prop.GetOrigin().Add(transformPhyVertex(nil, phy.Vertices[t.V3].Vec3(), orientation))
+		model := models[p.propType]
+		collision := newPropCollision(p.Solid, model, p.Origin, p.Angles, p.UniformScale, fallback)
+		p.CollisionFallback = collision.fallback
 
-		out[i] = [3]mgl32.Vec3{a, b, c}
+		props = append(props, staticProp{
+			StaticProp:    p.StaticProp,
+			propCollision: collision,
+			model:         model,
+		})
 	}
 
-	return out
+	return props, staticPropsByLeaf(lump, props)
 }
 
-func staticPropsByLeaf(bspfile *bsp.Bsp, models []*studiomodel.StudioModel) map[uint16][]staticProp {
-	res := make(map[uint16][]staticProp)
+// staticPropsByLeaf returns the props in every leaf, props must not grow anymore since they're referenced.
+func staticPropsByLeaf(lump staticPropLump, props []staticProp) map[uint16][]*staticProp {
+	byLeaf := make(map[uint16][]*staticProp)
 
-	gameLump := bspfile.Lump(bsp.LumpGame).(*lumps.Game).GetData()
-	spLump := gameLump.GetStaticPropLump()
+	for i := range props {
+		entry := lump.props[props[i].Index]
 
-	for _, p := range spLump.PropLumps {
-		leafIndices := spLump.LeafLump.Leaf[p.GetFirstLeaf() : p.GetFirstLeaf()+p.GetLeafCount()]
+		for _, leaf := range lump.leaves[entry.firstLeaf : entry.firstLeaf+entry.leafCount] {
+			byLeaf[leaf] = append(byLeaf[leaf], &props[i])
+		}
+	}
 
-		for _, i := range leafIndices {
-			model := models[p.GetPropType()]
+	return byLeaf
+}
 
-			var tris [][3]mgl32.Vec3
-			var min, max mgl32.Vec3
+// StaticProps returns all static props of the map, indices match Trace.StaticProp.
+// Props with CollisionFallback set may collide differently than in the game.
+func (m Map) StaticProps() []StaticProp {
+	res := make([]StaticProp, len(m.staticPropLump.props))
 
-			// missing model
-			if model != nil {
-				tris = triangles(p, model.Phy)
-				min, max = extents(tris)
-			}
+	for i, p := range m.staticPropLump.props {
+		res[i] = p.StaticProp
+	}
+
+	return res
+}
 
-			res[i] = append(res[i], staticProp{
-				prop:      p,
-				model:     model,
-				triangles: tris,
-				min:       min,
-				max:       max,
-			})
+// transformTriangles places triangles in model space at origin with the given angles and scale.
+func transformTriangles(tris [][3]mgl32.Vec3, origin, angles mgl32.Vec3, scale float32) [][3]mgl32.Vec3 {
+	if len(tris) == 0 {
+		return nil
+	}
+
+	rotation := angleMatrix(angles)
+	res := make([][3]mgl32.Vec3, len(tris))
+
+	for i, t := range tris {
+		for j, v := range t {
+			res[i][j] = origin.Add(rotation.Mul3x1(v).Mul(scale))
 		}
 	}
 
 	return res
 }
 
+// renderMeshHull returns the convex hull of the render mesh of mdl placed at origin with the given angles and scale,
+// false if the model has no render mesh or it's flat.
+func renderMeshHull(mdl *model, origin, angles mgl32.Vec3, scale float32) (collision.ConvexHull, bool) {
+	tris := transformTriangles(mdl.renderMesh, origin, angles, scale)
+	points := make([]mgl32.Vec3, 0, 3*len(tris))
+
+	for _, t := range tris {
+		points = append(points, t[:]...)
+	}
+
+	return collision.NewConvexHullFromPoints(points)
+}
+
 // find minimum and maximum extents of mesh
 func extents(tris [][3]mgl32.Vec3) (min, max mgl32.Vec3) {
 	min = mgl32.Vec3{mgl32.MaxValue, mgl32.MaxValue, mgl32.MaxValue}
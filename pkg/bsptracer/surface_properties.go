@@ -0,0 +1,172 @@
+package bsptracer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/saiko-tech/bsp-tracer/internal/keyvalues"
+)
+
+// game materials (CHAR_TEX_* in the engine), used by SurfaceProperties.GameMaterial
+const (
+	GameMaterialConcrete  = 'C'
+	GameMaterialMetal     = 'M'
+	GameMaterialDirt      = 'D'
+	GameMaterialVent      = 'V'
+	GameMaterialGrate     = 'G'
+	GameMaterialTile      = 'T'
+	GameMaterialWood      = 'W'
+	GameMaterialGlass     = 'Y'
+	GameMaterialFlesh     = 'F'
+	GameMaterialPlastic   = 'L'
+	GameMaterialCardboard = 'U'
+)
+
+const (
+	surfacePropertiesManifest = "scripts/surfaceproperties_manifest.txt"
+	defaultSurfaceProp        = "default"
+	maxMaterialIncludeDepth   = 4
+)
+
+// SurfaceProperties are the physical properties of a surface, as defined in scripts/surfaceproperties*.txt.
+type SurfaceProperties struct {
+	Name                string
+	GameMaterial        byte // one of GameMaterial*
+	PenetrationModifier float32
+	DamageModifier      float32
+}
+
+var defaultSurfaceProperties = SurfaceProperties{
+	Name:                defaultSurfaceProp,
+	GameMaterial:        GameMaterialConcrete,
+	PenetrationModifier: 1,
+	DamageModifier:      1,
+}
+
+func openKeyValues(fs ModelSource, path string) ([]*keyvalues.KeyValue, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return keyvalues.Parse(f)
+}
+
+func parseFloat32(s string, def float32) float32 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+	if err != nil {
+		return def
+	}
+
+	return float32(f)
+}
+
+// loadSurfaceProperties loads all surface properties listed in the manifest.
+// If the manifest can't be found only the default surface properties are returned.
+func loadSurfaceProperties(fs ModelSource) map[string]SurfaceProperties {
+	res := map[string]SurfaceProperties{
+		defaultSurfaceProp: defaultSurfaceProperties,
+	}
+
+	manifest, err := openKeyValues(fs, surfacePropertiesManifest)
+	if err != nil || len(manifest) == 0 {
+		return res
+	}
+
+	for _, file := range manifest[0].FindAll("file") {
+		entries, err := openKeyValues(fs, file.Value)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := strings.ToLower(entry.Key)
+
+			props, ok := res[strings.ToLower(entry.String("base"))]
+			if !ok {
+				props = res[defaultSurfaceProp]
+			}
+
+			if existing, ok := res[name]; ok {
+				props = existing // later files may override single values
+			}
+
+			props.Name = name
+			props.PenetrationModifier = parseFloat32(entry.String("penetrationmodifier"), props.PenetrationModifier)
+			props.DamageModifier = parseFloat32(entry.String("damagemodifier"), props.DamageModifier)
+
+			if gameMaterial := entry.String("gamematerial"); gameMaterial != "" {
+				props.GameMaterial = gameMaterial[0]
+			}
+
+			res[name] = props
+		}
+	}
+
+	return res
+}
+
+// materialSurfaceProp returns the $surfaceprop of a material, following patch material includes.
+func materialSurfaceProp(fs ModelSource, path string, depth int) string {
+	if depth > maxMaterialIncludeDepth {
+		return ""
+	}
+
+	kvs, err := openKeyValues(fs, path)
+	if err != nil || len(kvs) == 0 {
+		return ""
+	}
+
+	root := kvs[0]
+
+	if surfaceProp := root.String("$surfaceprop"); surfaceProp != "" {
+		return strings.ToLower(surfaceProp)
+	}
+
+	if !strings.EqualFold(root.Key, "patch") {
+		return ""
+	}
+
+	for _, block := range []string{"replace", "insert"} {
+		if b := root.Find(block); b != nil {
+			if surfaceProp := b.String("$surfaceprop"); surfaceProp != "" {
+				return strings.ToLower(surfaceProp)
+			}
+		}
+	}
+
+	include := strings.ToLower(strings.ReplaceAll(root.String("include"), "\\", "/"))
+	if include == "" {
+		return ""
+	}
+
+	return materialSurfaceProp(fs, include, depth+1)
+}
+
+// materialSurfaceProps resolves the surface properties of all materials.
+func materialSurfaceProps(fs ModelSource, materials []string) []string {
+	res := make([]string, len(materials))
+
+	for i, name := range materials {
+		if name == "" {
+			continue
+		}
+
+		path := "materials/" + strings.ToLower(strings.ReplaceAll(name, "\\", "/")) + ".vmt"
+		res[i] = materialSurfaceProp(fs, path, 0)
+	}
+
+	return res
+}
+
+// SurfaceProperties returns the surface properties with the given name (e.g. Trace.Surface.SurfaceProp).
+// If no surface properties with this name exist, the default surface properties are returned.
+func (m Map) SurfaceProperties(name string) SurfaceProperties {
+	if props, ok := m.surfaceProps[strings.ToLower(name)]; ok {
+		return props
+	}
+
+	return defaultSurfaceProperties
+}
@@ -0,0 +1,134 @@
+package bsptracer
+
+import (
+	"strings"
+
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/lumps"
+	"github.com/galaco/bsp/primitives/plane"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// HitKind describes what kind of object a trace hit.
+type HitKind int
+
+const (
+	HitNone HitKind = iota
+	HitBrush
+	HitFace
+	HitStaticProp
+	HitDisplacement
+	HitDynamicProp
+)
+
+func (k HitKind) String() string {
+	switch k {
+	case HitNone:
+		return "none"
+	case HitBrush:
+		return "brush"
+	case HitFace:
+		return "face"
+	case HitStaticProp:
+		return "static prop"
+	case HitDisplacement:
+		return "displacement"
+	case HitDynamicProp:
+		return "dynamic prop"
+	}
+
+	return "unknown"
+}
+
+// Surface describes the texture of a hit surface.
+type Surface struct {
+	Name        string // material name, e.g. "CONCRETE/CONCRETEWALL002A"
+	SurfaceProp string // surface properties name ($surfaceprop of the material), see Map.SurfaceProperties()
+	Flags       int32  // SURF_* flags of the texinfo
+	TexInfo     int16  // index into the TexInfo lump
+	TexData     int32  // index into the TexData lump
+}
+
+// texDataNames resolves the material names of all TexData entries through the TexDataStringTable.
+func texDataNames(bspfile *bsp.Bsp) []string {
+	texData := bspfile.Lump(bsp.LumpTexData).(*lumps.TexData).GetData()
+	table := bspfile.Lump(bsp.LumpTexDataStringTable).(*lumps.TexDataStringTable).GetData()
+	data := bspfile.Lump(bsp.LumpTexDataStringData).(*lumps.TexDataStringData).GetData()
+
+	names := make([]string, len(texData))
+
+	for i, td := range texData {
+		if td.NameStringTableID < 0 || int(td.NameStringTableID) >= len(table) {
+			continue
+		}
+
+		offset := int(table[td.NameStringTableID])
+		if offset < 0 || offset >= len(data) {
+			continue
+		}
+
+		name := data[offset:]
+		if end := strings.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		names[i] = name
+	}
+
+	return names
+}
+
+func (m Map) surface(texInfoIndex int16) Surface {
+	if texInfoIndex < 0 || int(texInfoIndex) >= len(m.texInfos) {
+		return Surface{TexInfo: texInfoIndex, TexData: -1}
+	}
+
+	texInfo := m.texInfos[texInfoIndex]
+
+	s := Surface{
+		Flags:   texInfo.Flags,
+		TexInfo: texInfoIndex,
+		TexData: texInfo.TexData,
+	}
+
+	if texInfo.TexData >= 0 && int(texInfo.TexData) < len(m.texDataNames) {
+		s.Name = m.texDataNames[texInfo.TexData]
+	}
+
+	if texInfo.TexData >= 0 && int(texInfo.TexData) < len(m.texDataSurfaceProps) {
+		s.SurfaceProp = m.texDataSurfaceProps[texInfo.TexData]
+	}
+
+	return s
+}
+
+// setHit records what was hit and resets the details of any previous hit.
+func (t *Trace) setHit(kind HitKind) {
+	t.HitKind = kind
+	t.Plane = plane.Plane{}
+	t.Surface = Surface{}
+	t.Brush = nil
+	t.BrushSide = 0
+	t.Face = 0
+	t.DispFlags = 0
+	t.StaticProp = 0
+	t.Model = ""
+	t.Entity = 0
+}
+
+// newPlane creates a plane through point with the given normal.
+func newPlane(normal, point mgl32.Vec3) plane.Plane {
+	axisType := int32(3)
+
+	for i := int32(0); i < 3; i++ {
+		if normal[i] == 1 || normal[i] == -1 {
+			axisType = i
+		}
+	}
+
+	return plane.Plane{
+		Normal:   normal,
+		Distance: normal.Dot(point),
+		AxisType: axisType,
+	}
+}
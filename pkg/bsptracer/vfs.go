@@ -2,58 +2,157 @@ package bsptracer
 
 import (
 	"archive/zip"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path"
 	"strings"
 
 	"github.com/galaco/vpk2"
 	"github.com/pkg/errors"
 )
 
-type vfs struct {
-	pakfile *zip.Reader
-	vpks    []*vpk.VPK
-
-	pakfileIndex map[string]*zip.File
+// ModelSource provides the game files that are needed to load maps:
+// models (.mdl, .phy, .vvd, .vtx), materials (.vmt) and scripts (surfaceproperties*.txt).
+// Paths are relative to the game directory (e.g. "models/props/de_cache/crate.mdl" for csgo/models/props/de_cache/crate.mdl).
+// Sources are tried in order of priority, see LoadMapWithModelSources.
+type ModelSource interface {
+	// Open opens a file, it must return an error matching fs.ErrNotExist if the file doesn't exist.
+	// Other errors aren't hidden by sources with lower priority, loading the file fails with the error instead.
+	Open(path string) (io.ReadCloser, error)
 }
 
-var errFileNotFound = errors.New("file not found")
+// errFileNotFound is returned by the built-in sources for missing files, it matches fs.ErrNotExist.
+var errFileNotFound = fmt.Errorf("file not found: %w", fs.ErrNotExist)
+
+// modelSources tries multiple sources in order, until one of them has the file.
+type modelSources []ModelSource
 
-func (v vfs) open(path string) (io.ReadCloser, error) {
-	f, err := v.pakfile.Open(path)
-	if err == nil {
-		stat, err := f.Stat()
-		if err == nil && stat.Size() > 0 {
+func (sources modelSources) Open(path string) (io.ReadCloser, error) {
+	for _, src := range sources {
+		f, err := src.Open(path)
+		if err == nil {
 			return f, nil
 		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.Wrapf(err, "failed to open %s", path)
+		}
 	}
 
-	// try case-insensitive
-	if v.pakfileIndex == nil {
-		v.pakfileIndex = make(map[string]*zip.File)
+	return nil, errors.Wrapf(errFileNotFound, "%s not found", path)
+}
 
-		for _, f := range v.pakfile.File {
-			v.pakfileIndex[strings.ToLower(f.Name)] = f
+type vpkSource struct {
+	vpk *vpk.VPK
+}
+
+// NewVPKSource returns a source for the files of a VPK.
+func NewVPKSource(v *vpk.VPK) ModelSource {
+	return vpkSource{vpk: v}
+}
+
+// OpenVPKSource opens a VPK from the file system, see LoadMapFromFileSystem for the format of path.
+func OpenVPKSource(path string) (ModelSource, error) {
+	v, err := vpk.Open(vpk.MultiVPK(path))
+	if err != nil {
+		v, err = vpk.Open(vpk.SingleVPK(path))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open vpk %q", path)
 		}
 	}
 
-	pakF, ok := v.pakfileIndex[strings.ToLower(path)]
-	if ok {
-		f, err := pakF.Open()
-		if err == nil {
-			return f, nil
-		}
+	return NewVPKSource(v), nil
+}
+
+func (s vpkSource) Open(path string) (io.ReadCloser, error) {
+	f, err := s.vpk.Open(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// try vpk
-	for _, vpkF := range v.vpks {
-		f, err = vpkF.Open(path)
-		if err == nil {
-			stat, err := f.Stat()
-			if err == nil && stat.Size() > 0 {
-				return f, nil
-			}
+	// missing files are sometimes empty entries
+	if stat, err := f.Stat(); err != nil || stat.Size() == 0 {
+		f.Close()
+
+		return nil, errors.Wrapf(errFileNotFound, "%s not found", path)
+	}
+
+	return f, nil
+}
+
+type fsSource struct {
+	fsys fs.FS
+}
+
+// NewFSSource returns a source for the files of fsys, e.g. an embed.FS with test fixtures.
+// Paths are looked up as they are and in lower case, since Source paths are case-insensitive
+// and extracted game files are usually lower case.
+func NewFSSource(fsys fs.FS) ModelSource {
+	return fsSource{fsys: fsys}
+}
+
+// NewDirSource returns a source for loose files in a directory on disk,
+// e.g. "Counter-Strike Global Offensive/csgo" for files extracted to csgo/models/...
+func NewDirSource(dir string) ModelSource {
+	return NewFSSource(os.DirFS(dir))
+}
+
+func (s fsSource) Open(name string) (io.ReadCloser, error) {
+	name = cleanPath(name)
+
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		if lower := strings.ToLower(name); lower != name {
+			f, err = s.fsys.Open(lower)
+		}
+
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return nil, errors.Wrapf(errFileNotFound, "%s not found", path)
+	return f, nil
+}
+
+type zipSource struct {
+	files map[string]*zip.File // by lower case path
+}
+
+// NewZipSource returns a source for the files of a zip archive, like the pakfile that is embedded in BSPs.
+// Paths are case-insensitive.
+func NewZipSource(r *zip.Reader) ModelSource {
+	s := zipSource{
+		files: make(map[string]*zip.File, len(r.File)),
+	}
+
+	for _, f := range r.File {
+		s.files[strings.ToLower(cleanPath(f.Name))] = f
+	}
+
+	return s
+}
+
+func (s zipSource) Open(name string) (io.ReadCloser, error) {
+	f, ok := s.files[strings.ToLower(cleanPath(name))]
+	if !ok || f.UncompressedSize64 == 0 {
+		return nil, errors.Wrapf(errFileNotFound, "%s not found", name)
+	}
+
+	return f.Open()
+}
+
+// cleanPath converts a Source path (e.g. "models\props\crate.mdl") to an io/fs path.
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, `\`, "/")), "/")
+}
+
+// newVFS returns the sources of a map, the files embedded in the BSP have the highest priority.
+func newVFS(pakfile *zip.Reader, sources []ModelSource) modelSources {
+	if pakfile == nil {
+		return sources
+	}
+
+	return append(modelSources{NewZipSource(pakfile)}, sources...)
 }
@@ -0,0 +1,88 @@
+package bsptracer
+
+import (
+	"github.com/galaco/bsp"
+	"github.com/galaco/bsp/lumps"
+	visprimitives "github.com/galaco/bsp/primitives/visibility"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// clusterSets are the decompressed PVS or PAS bit vectors of all clusters.
+type clusterSets [][]uint64
+
+func (s clusterSets) contains(a, b int16) bool {
+	// no vis data or outside of the map (in solid), we can't tell
+	if len(s) == 0 || a < 0 || b < 0 || int(a) >= len(s) || int(b) >= len(s) {
+		return true
+	}
+
+	return s[a][b/64]&(1<<(uint(b)%64)) != 0
+}
+
+// decompressVis is a port of CM_DecompressVis, the bit vectors are run-length encoded (zero bytes followed by a count).
+func decompressVis(data []byte, offset int32, numClusters int) []uint64 {
+	res := make([]uint64, (numClusters+63)/64)
+	numBytes := (numClusters + 7) / 8
+
+	for i, v := 0, int(offset); i < numBytes && v >= 0 && v < len(data); v++ {
+		if data[v] != 0 {
+			res[i/8] |= uint64(data[v]) << (8 * (uint(i) % 8))
+			i++
+
+			continue
+		}
+
+		v++
+		if v >= len(data) {
+			break
+		}
+
+		i += int(data[v])
+	}
+
+	return res
+}
+
+// loadVisibility decompresses the PVS and PAS of all clusters.
+func loadVisibility(bspfile *bsp.Bsp) (pvs, pas clusterSets) {
+	vis := bspfile.Lump(bsp.LumpVisibility).(*lumps.Visibility).GetData()
+	numClusters := int(vis.NumClusters)
+
+	if numClusters <= 0 || len(vis.ByteOffset) < numClusters {
+		return nil, nil
+	}
+
+	pvs = make(clusterSets, numClusters)
+	pas = make(clusterSets, numClusters)
+
+	for i, offsets := range vis.ByteOffset[:numClusters] {
+		pvs[i] = decompressVis(vis.BitVectors, offsets[visprimitives.VisPVS], numClusters)
+		pas[i] = decompressVis(vis.BitVectors, offsets[visprimitives.VisPAS], numClusters)
+	}
+
+	return pvs, pas
+}
+
+// ClusterVisible returns true if cluster b is in the potentially visible set (PVS) of cluster a.
+// Returns true if the map has no vis data or one of the clusters is invalid (-1, i.e. inside of solid).
+func (m Map) ClusterVisible(a, b int16) bool {
+	return m.pvs.contains(a, b)
+}
+
+// ClusterAudible returns true if cluster b is in the potentially audible set (PAS) of cluster a.
+// Returns true if the map has no vis data or one of the clusters is invalid (-1, i.e. inside of solid).
+func (m Map) ClusterAudible(a, b int16) bool {
+	return m.pas.contains(a, b)
+}
+
+// PotentiallyVisible returns true if p2 may be visible from p1 according to the PVS.
+// This is a conservative check, if it returns false TraceRay between the points will always hit something,
+// if it returns true the points may or may not be visible from each other.
+func (m Map) PotentiallyVisible(p1, p2 mgl32.Vec3) bool {
+	return m.ClusterVisible(m.LeafAt(p1).Cluster, m.LeafAt(p2).Cluster)
+}
+
+// PotentiallyAudible returns true if p2 may be audible from p1 according to the PAS.
+func (m Map) PotentiallyAudible(p1, p2 mgl32.Vec3) bool {
+	return m.ClusterAudible(m.LeafAt(p1).Cluster, m.LeafAt(p2).Cluster)
+}
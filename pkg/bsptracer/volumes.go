@@ -0,0 +1,85 @@
+package bsptracer
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Volume is a non-solid brush entity that marks a region of the map,
+// e.g. a bomb site (func_bomb_target), a buy zone (func_buyzone) or a trigger (trigger_*).
+type Volume struct {
+	BrushEntity
+
+	Min, Max mgl32.Vec3 // AABB in world space
+}
+
+// Volumes returns all volumes with the given classname (case-insensitive), see FindByClassname for wildcards.
+// Every brush entity is either a volume or solid, see BrushEntities.
+func (m Map) Volumes(className string) []Volume {
+	var res []Volume
+
+	for i := range m.volumes {
+		if v := &m.volumes[i]; matchEntityName(className, v.ClassName) {
+			res = append(res, v.volume())
+		}
+	}
+
+	return res
+}
+
+// VolumesAt returns all volumes with the given classname (see Volumes) that contain the point,
+// e.g. the func_bomb_target a player is standing in.
+// The exact geometry of the brush models is used, Enabled is ignored.
+func (m Map) VolumesAt(p mgl32.Vec3, className string) []Volume {
+	var res []Volume
+
+	for i := range m.volumes {
+		if v := &m.volumes[i]; matchEntityName(className, v.ClassName) && m.volumeContains(v, p) {
+			res = append(res, v.volume())
+		}
+	}
+
+	return res
+}
+
+// PointInVolume returns true if any volume with the given classname contains the point, see VolumesAt.
+// E.g. PointInVolume(p, "func_buyzone") returns true if a player at p can buy.
+func (m Map) PointInVolume(p mgl32.Vec3, className string) bool {
+	for i := range m.volumes {
+		v := &m.volumes[i]
+
+		if matchEntityName(className, v.ClassName) && m.volumeContains(v, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *brushEntity) volume() Volume {
+	return Volume{
+		BrushEntity: e.BrushEntity,
+		Min:         e.min,
+		Max:         e.max,
+	}
+}
+
+// volumeContains returns true if a brush of the volume's model contains the point.
+func (m Map) volumeContains(v *brushEntity, p mgl32.Vec3) bool {
+	for i := 0; i < 3; i++ {
+		if p[i] < v.min[i] || p[i] > v.max[i] {
+			return false
+		}
+	}
+
+	// the brushes of the model are in its local space
+	local := v.rotation.Transpose().Mul3x1(p.Sub(v.Origin))
+	leaf := m.leaves[m.leafIndexFrom(v.headNode, local)]
+
+	for i := uint16(0); i < leaf.NumLeafBrushes; i++ {
+		if m.brushContainsPoint(&m.brushes[m.leafBrushes[leaf.FirstLeafBrush+i]], local) {
+			return true
+		}
+	}
+
+	return false
+}